@@ -0,0 +1,393 @@
+// Command 2ch-downloader watches the boards in config.json and downloads the files of matching threads
+package main
+
+import (
+	"cmp"
+	"context"
+	"flag"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/alekxeyuk/makaba-downloader/download"
+	"github.com/alekxeyuk/makaba-downloader/dvach"
+	"github.com/alekxeyuk/makaba-downloader/dvach/cassette"
+	"github.com/alekxeyuk/makaba-downloader/logger"
+	"github.com/alekxeyuk/makaba-downloader/monitor"
+	"github.com/alekxeyuk/makaba-downloader/notify"
+	"github.com/alekxeyuk/makaba-downloader/proxy"
+	"github.com/alekxeyuk/makaba-downloader/store"
+)
+
+// stringList is a repeatable string flag
+type stringList []string
+
+func (s *stringList) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringList) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+func main() {
+	var manualThreads stringList
+	flag.Var(&manualThreads, "thread", "download a thread ahead of everything else, as board/number (repeatable)")
+	var watchThreads stringList
+	flag.Var(&watchThreads, "watch", "poll a thread every pass whether or not it matches the tags, as board/number (repeatable)")
+	watchFor := flag.Duration("watch-for", 0, "stop watching the threads given with -watch after this long, e.g. 72h (default until they 404)")
+	catalogBoard := flag.String("catalog", "", "list the threads of a board catalog with what the tags make of them and exit")
+	var query monitor.CatalogQuery
+	flag.StringVar(&query.Text, "query", "", "with -catalog, only threads mentioning this in the subject, tags or comment")
+	flag.Int64Var(&query.MinFiles, "min-files", 0, "with -catalog, only threads with at least this many files")
+	flag.Int64Var(&query.MinPosts, "min-posts", 0, "with -catalog, only threads with at least this many posts")
+	flag.BoolVar(&query.OnlyMatching, "matching", false, "with -catalog, only threads the tags match")
+	format := flag.String("format", "table", "output of -catalog, table or json")
+	phashReport := flag.Bool("phash-report", false, "list clusters of near-duplicate images and exit")
+	recordDir := flag.String("record", "", "record API responses to a cassette directory")
+	recordMedia := flag.Bool("record-media", false, "also record status and headers of media requests with -record")
+	replayDir := flag.String("replay", "", "run one pass offline from a cassette directory recorded with -record")
+	importCookies := flag.String("import-cookies", "", "add the cookies of a cookies.txt file or JSON browser export to "+cookiesFile)
+	flag.Parse()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Keep the listing on stdout clean
+	if *catalogBoard != "" {
+		logger.Log.SetOutput(os.Stderr)
+	}
+
+	appConfig, err := monitor.LoadConfig("config.json")
+	if err != nil {
+		logger.Log.Error("Error loading config: %v", err)
+		os.Exit(1)
+	}
+
+	if *phashReport {
+		var config download.PHashConfig
+		if appConfig.PHash != nil {
+			config = *appConfig.PHash
+		}
+		download.LoadPHashes("phash.json", config).WriteReport(os.Stdout)
+		return
+	}
+
+	// Replayed media are zero-filled stand-ins, they must never reach the real storage, md5 index or state files
+	if *replayDir != "" {
+		startReplay(appConfig, replayDir)
+	}
+
+	// The transport carries API and media requests alike, through proxies if there are any
+	var transportConfig dvach.TransportConfig
+	if appConfig.Transport != nil {
+		transportConfig = *appConfig.Transport
+	}
+	base := transportConfig.NewTransport()
+	var transport http.RoundTripper = base
+	if proxyConfig := appConfig.ProxyConfig(); proxyConfig != nil && *replayDir == "" {
+		router, err := proxy.NewRouter(*proxyConfig, base)
+		if err != nil {
+			logger.Log.Fatal("Error setting up proxies: %v", err)
+		}
+		transport = router
+		if proxyConfig.HealthCheckMinutes >= 0 {
+			checkURL := proxyConfig.HealthCheckURL
+			if checkURL == "" {
+				checkURL = dvach.DefaultBaseURL
+			}
+			interval := time.Duration(cmp.Or(proxyConfig.HealthCheckMinutes, 10)) * time.Minute
+			go router.RunHealthChecks(ctx, checkURL, interval)
+		}
+	}
+	transport = transportConfig.Wrap(transport)
+
+	// Cookies persist across restarts so a challenge solved in a browser stays valid
+	jar := dvach.NewJar()
+	if err := jar.Load(cookiesFile); err != nil {
+		logger.Log.Error("Error loading %s: %v", cookiesFile, err)
+	}
+	if *importCookies != "" {
+		importCookiesFile(jar, *importCookies)
+	}
+	defer saveCookies(jar)
+
+	clientOpts := []dvach.Option{dvach.WithUsercode(appConfig.UsercodeAuth)}
+	switch {
+	case *recordDir != "" && *replayDir != "":
+		logger.Log.Fatal("-record and -replay can't be used together")
+	case *replayDir != "":
+		logger.Log.Info("Replaying API responses from %s", *replayDir)
+		clientOpts = append(clientOpts, dvach.WithHTTPClient(&http.Client{Transport: cassette.NewReplayer(*replayDir)}))
+	case *recordDir != "":
+		logger.Log.Info("Recording API responses to %s", *recordDir)
+		clientOpts = append(clientOpts, dvach.WithHTTPClient(&http.Client{Transport: cassette.NewRecorder(*recordDir, *recordMedia, transport), Jar: jar}))
+	default:
+		clientOpts = append(clientOpts, dvach.WithHTTPClient(&http.Client{Transport: transport, Jar: jar}))
+	}
+	// A replayed run has no login to replay
+	if *replayDir == "" {
+		clientOpts = append(clientOpts, dvach.WithPasscode(appConfig.Passcode))
+	}
+	api := dvach.NewClient(clientOpts...)
+
+	if *catalogBoard != "" {
+		searchCatalog(api, appConfig, *catalogBoard, query, *format)
+		return
+	}
+
+	// Find out about a bad passcode or usercode_auth now rather than from degraded catalogs
+	if (appConfig.UsercodeAuth != "" || appConfig.Passcode != "") && *replayDir == "" && len(appConfig.Boards) > 0 {
+		if err := api.CheckAuth(appConfig.Boards[0].Board); err != nil {
+			logger.Log.Error("Auth check failed, continuing without: %v", err)
+		} else {
+			logger.Log.Success("Authenticated")
+		}
+	}
+
+	// Remote storages get the timeouts of the transport but none of the proxies, and their requests are cancelled on shutdown
+	storage, err := store.New(appConfig.Storage, store.WithHTTPClient(&http.Client{Transport: base}), store.WithContext(ctx))
+	if err != nil {
+		logger.Log.Fatal("Error setting up storage: %v", err)
+	}
+	defer flushStorage(storage)
+	opts := []download.Option{
+		download.WithContext(ctx), // A shutdown signal ends downloads, even ones waiting for disk space
+		download.WithWorkers(5),   // Max 5 concurrent downloads
+		download.WithDiskGuard(appConfig.Disk),
+		download.WithStorage(storage),
+	}
+	if len(appConfig.Hooks) > 0 {
+		hooks, err := download.NewHooks(appConfig.Hooks, appConfig.MaxConcurrentHooks)
+		if err != nil {
+			logger.Log.Fatal("Error setting up hooks: %v", err)
+		}
+		opts = append(opts, download.WithHooks(hooks))
+	}
+
+	// Alerts about new threads, failing boards and rejected auth
+	var notifier *notify.Notifier
+	if appConfig.Notifications != nil {
+		notifier, err = notify.New(*appConfig.Notifications)
+		if err != nil {
+			logger.Log.Fatal("Error setting up notifications: %v", err)
+		}
+		defer notifier.Wait()
+	}
+
+	// Failed downloads are retried in later passes
+	failures := download.LoadFailures("failures.json", appConfig.MaxDownloadAttempts)
+	defer failures.Save()
+	opts = append(opts, download.WithFailures(failures))
+
+	// Near-duplicate images are detected after download
+	var phashes *download.PHashStore
+	if appConfig.PHash != nil && appConfig.PHash.Enabled {
+		phashes = download.LoadPHashes("phash.json", *appConfig.PHash)
+		defer phashes.Save()
+		opts = append(opts, download.WithPHashes(phashes))
+	}
+
+	// Resume downloads interrupted by the previous run
+	journal, pendingJobs, err := download.OpenJournal("queue.json")
+	if err != nil {
+		logger.Log.Error("Error opening queue journal: %v", err)
+	} else {
+		defer journal.Close()
+		opts = append(opts, download.WithJournal(journal))
+	}
+
+	downloader := download.New(api.HTTPClient(), opts...)
+	if len(pendingJobs) > 0 {
+		logger.Log.Info("Resuming %d downloads from the previous run", len(pendingJobs))
+		downloader.Resume(pendingJobs)
+	}
+
+	watchlist := monitor.LoadWatchlist("watchlist.json")
+	for _, ref := range watchThreads {
+		entry := monitor.WatchEntry{Thread: ref}
+		if *watchFor > 0 {
+			entry.Until = time.Now().Add(*watchFor)
+		}
+		if err := watchlist.Add(entry); err != nil {
+			logger.Log.Fatal("Error adding %s to the watchlist: %v", ref, err)
+		}
+		logger.Log.Info("Watching %s", ref)
+	}
+	watchlist.Save()
+
+	mon := monitor.New(appConfig, api, downloader, monitor.WithNotifier(notifier), monitor.WithWatchlist(watchlist))
+
+	// Load last hits from file
+	lastHits := monitor.LoadLastHits("lasthits.json")
+
+	// Handle graceful shutdown
+	setupGracefulShutdown(cancel)
+
+	// Manually requested threads go first
+	mon.ProcessThreads(ctx, manualThreads, lastHits)
+
+	// Main processing loop
+	for {
+		if checkContextCancellation(ctx, downloader) {
+			return
+		}
+
+		if n := downloader.RetryDue(); n > 0 {
+			logger.Log.Info("Retrying %d failed downloads", n)
+		}
+
+		// Process all boards
+		mon.RunPass(ctx, lastHits)
+		if checkContextCancellation(ctx, downloader) {
+			return
+		}
+
+		if pending, active := downloader.Len(); pending+active > 0 {
+			logger.Log.Info("Waiting for %d queued and %d active downloads", pending, active)
+		}
+
+		// Wait for all downloads to complete
+		downloader.Wait()
+
+		// Save updated last hits
+		monitor.SaveLastHits("lasthits.json", lastHits)
+		failures.Save()
+		if journal != nil {
+			if err := journal.Compact(); err != nil {
+				logger.Log.Error("Error compacting queue journal: %v", err)
+			}
+		}
+		if phashes != nil {
+			phashes.Save()
+		}
+		saveCookies(jar)
+		watchlist.Save()
+		flushStorage(storage)
+
+		// A replayed cassette has nothing new to offer
+		if *replayDir != "" {
+			downloader.Stop()
+			return
+		}
+
+		// Sleep before next iteration
+		if !sleepOrCancel(ctx, downloader, 180*time.Second) {
+			return
+		}
+	}
+}
+
+// searchCatalog prints the threads of a board catalog passing the query
+func searchCatalog(api *dvach.Client, config *monitor.Config, board string, query monitor.CatalogQuery, format string) {
+	if format != "table" && format != "json" {
+		logger.Log.Fatal("Unknown -format %q, expected table or json", format)
+	}
+	catalog, err := api.Catalog(board)
+	if err != nil {
+		logger.Log.Fatal("Error getting catalog for %s: %v", board, err)
+	}
+	entries := monitor.SearchCatalog(api, catalog, config, query)
+	if format == "json" {
+		if err := monitor.WriteCatalogJSON(os.Stdout, entries); err != nil {
+			logger.Log.Fatal("Error writing catalog: %v", err)
+		}
+		return
+	}
+	monitor.WriteCatalogTable(os.Stdout, entries)
+}
+
+// startReplay moves the process into a scratch directory with local storage and no hooks or
+// notifications, so a replay starts from empty state and leaves the real one alone
+func startReplay(config *monitor.Config, cassetteDir *string) {
+	dir, err := filepath.Abs(*cassetteDir)
+	if err != nil {
+		logger.Log.Fatal("Error finding cassette %s: %v", *cassetteDir, err)
+	}
+	*cassetteDir = dir
+	scratch, err := os.MkdirTemp("", "2ch-replay-")
+	if err != nil {
+		logger.Log.Fatal("Error creating replay directory: %v", err)
+	}
+	if err := os.Chdir(scratch); err != nil {
+		logger.Log.Fatal("Error entering replay directory: %v", err)
+	}
+	config.Storage = nil
+	config.Hooks = nil
+	config.Notifications = nil
+	logger.Log.Info("Replaying into %s, files and state are left there for inspection", scratch)
+}
+
+// cookiesFile keeps the cookie jar between runs
+const cookiesFile = "cookies.txt"
+
+// importCookiesFile adds the cookies of a browser export to the jar and saves it right away
+func importCookiesFile(jar *dvach.Jar, name string) {
+	file, err := os.Open(name)
+	if err != nil {
+		logger.Log.Fatal("Error importing cookies: %v", err)
+	}
+	defer file.Close()
+	n, err := jar.Import(file)
+	if err != nil {
+		logger.Log.Fatal("Error importing cookies from %s: %v", name, err)
+	}
+	logger.Log.Info("Imported %d cookies from %s", n, name)
+	saveCookies(jar)
+}
+
+// saveCookies writes the jar to cookiesFile
+func saveCookies(jar *dvach.Jar) {
+	if err := jar.Save(cookiesFile); err != nil {
+		logger.Log.Error("Error saving %s: %v", cookiesFile, err)
+	}
+}
+
+// setupGracefulShutdown sets up signal handling for graceful shutdown
+func setupGracefulShutdown(cancel context.CancelFunc) {
+	go func() {
+		sigChan := make(chan os.Signal, 1)
+		signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+		<-sigChan
+		logger.Log.Info("Received shutdown signal, initiating graceful shutdown...")
+		cancel()
+	}()
+}
+
+// flushStorage writes out the md5 index lines remote storages buffer
+func flushStorage(storage store.Storage) {
+	if err := store.Flush(storage); err != nil {
+		logger.Log.Error("Error flushing storage: %v", err)
+	}
+}
+
+// checkContextCancellation checks if context is cancelled and performs shutdown
+func checkContextCancellation(ctx context.Context, downloader *download.Downloader) bool {
+	select {
+	case <-ctx.Done():
+		logger.Log.Info("Shutting down...")
+		downloader.Stop()
+		return true
+	default:
+		return false
+	}
+}
+
+// sleepOrCancel sleeps for the specified duration or returns early if context is cancelled
+func sleepOrCancel(ctx context.Context, downloader *download.Downloader, duration time.Duration) bool {
+	logger.Log.Info("Done... Sleeping for %v", duration)
+
+	select {
+	case <-ctx.Done():
+		logger.Log.Info("Shutting down...")
+		downloader.Stop()
+		return false
+	case <-time.After(duration):
+		return true
+	}
+}
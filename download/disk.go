@@ -0,0 +1,61 @@
+package download
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/alekxeyuk/makaba-downloader/logger"
+	"github.com/alekxeyuk/makaba-downloader/store"
+)
+
+const (
+	bytesPerGB        = 1 << 30
+	diskCheckInterval = time.Minute
+)
+
+// DiskConfig protects the disk from filling up
+type DiskConfig struct {
+	MinFreeGB float64 `json:"min_free_gb,omitempty"` // pause downloads below this much free space
+	DryRun    bool    `json:"dry_run,omitempty"`     // only log what the space guard, quotas and retention rules would do
+}
+
+// waitForSpace blocks while free space under dir is below the configured minimum
+func (d *Downloader) waitForSpace(ctx context.Context, dir string) error {
+	if d.disk == nil || d.disk.MinFreeGB <= 0 {
+		return nil
+	}
+	if _, err := os.Stat(dir); err != nil {
+		dir = "."
+	}
+
+	minFree := uint64(d.disk.MinFreeGB * bytesPerGB)
+	warned := false
+	for {
+		free, err := store.FreeSpace(dir)
+		if err != nil {
+			logger.Log.Trace("Can't check free space of %s: %v", dir, err)
+			return nil
+		}
+		if free >= minFree {
+			if warned {
+				logger.Log.Info("Free space on %s is back to %.1f GB, resuming downloads", dir, float64(free)/bytesPerGB)
+			}
+			return nil
+		}
+		if d.disk.DryRun {
+			logger.Log.Warning("Dry run: only %.1f GB free on %s, downloads would be paused", float64(free)/bytesPerGB, dir)
+			return nil
+		}
+		if !warned {
+			logger.Log.Warning("Only %.1f GB free on %s, pausing downloads", float64(free)/bytesPerGB, dir)
+			warned = true
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(diskCheckInterval):
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package download
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alekxeyuk/makaba-downloader/store"
+)
+
+func TestWaitForSpace(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := store.FreeSpace(dir); err != nil {
+		t.Skipf("free space can't be checked here: %v", err)
+	}
+	const plenty = 1 << 20 // GB, more than any test machine has
+
+	tests := []struct {
+		name    string
+		disk    *DiskConfig
+		wantErr error
+	}{
+		{"no guard", nil, nil},
+		{"no minimum", &DiskConfig{}, nil},
+		{"enough space", &DiskConfig{MinFreeGB: 0.001}, nil},
+		{"dry run", &DiskConfig{MinFreeGB: plenty, DryRun: true}, nil},
+		{"full disk waits", &DiskConfig{MinFreeGB: plenty}, context.DeadlineExceeded},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := New(nil, WithWorkers(0), WithDiskGuard(tt.disk))
+			defer d.Stop()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			// Waiting would run into the deadline
+			if err := d.waitForSpace(ctx, dir); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("waitForSpace = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestWaitForSpaceMissingDir(t *testing.T) {
+	// The temp directory of a new thread doesn't exist yet, its filesystem is checked through the working directory
+	d := New(nil, WithWorkers(0), WithDiskGuard(&DiskConfig{MinFreeGB: 0.001}))
+	defer d.Stop()
+	if err := d.waitForSpace(context.Background(), "does/not/exist"); err != nil {
+		t.Errorf("waitForSpace = %v", err)
+	}
+}
+
+func TestCancelEndsSpaceWait(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := store.FreeSpace(dir); err != nil {
+		t.Skipf("free space can't be checked here: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	d := New(nil, WithContext(ctx), WithWorkers(1), WithStorage(store.NewDisk(dir)), WithDiskGuard(&DiskConfig{MinFreeGB: 1 << 20}))
+	defer d.Stop()
+	d.Enqueue(Job{URL: "http://127.0.0.1/a.jpg", Path: "b/1/a.jpg"})
+	d.Enqueue(Job{URL: "http://127.0.0.1/b.jpg", Path: "b/1/b.jpg"})
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if _, active := d.Len(); active == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("no download started")
+		}
+	}
+
+	// The shutdown signal arrives while the download waits for space
+	cancel()
+	waited := make(chan struct{})
+	go func() {
+		d.Wait()
+		close(waited)
+	}()
+	select {
+	case <-waited:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Wait still blocked after the context was cancelled")
+	}
+}
@@ -0,0 +1,644 @@
+// Package download fetches files through a prioritized queue with resumable
+// downloads, a persistent journal, retries, duplicate detection and hooks
+package download
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alekxeyuk/makaba-downloader/dvach"
+	"github.com/alekxeyuk/makaba-downloader/logger"
+	"github.com/alekxeyuk/makaba-downloader/store"
+	"golang.org/x/time/rate"
+)
+
+type downloaderError struct {
+	err       error
+	permanent bool
+}
+
+func (e *downloaderError) Error() string {
+	return fmt.Sprintf("error downloading %s, permanent %v", e.err, e.permanent)
+}
+
+func (e *downloaderError) Unwrap() error {
+	return e.err
+}
+
+// statusError classifies an unexpected HTTP status, client errors are permanent
+// except for the ones that depend on auth, timing or rate limits
+func statusError(code int) *downloaderError {
+	permanent := code >= 400 && code < 500
+	switch code {
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusRequestTimeout, http.StatusTooManyRequests:
+		permanent = false
+	}
+	return &downloaderError{
+		err:       fmt.Errorf("unexpected status code: %d", code),
+		permanent: permanent,
+	}
+}
+
+// Downloader downloads jobs from a priority queue with a pool of workers
+// and stores the files with the post-download steps enabled by its options
+type Downloader struct {
+	client   *http.Client
+	limiter  *rate.Limiter
+	queue    *DownloadQueue
+	journal  *Journal
+	failures *FailureStore
+	phashes  *PHashStore
+	disk     *DiskConfig
+	storage  store.Storage
+	hooks    *Hooks
+
+	workerCount int
+	workers     sync.WaitGroup
+	ctx         context.Context
+	cancel      context.CancelFunc
+}
+
+// Option configures a Downloader
+type Option func(*Downloader)
+
+// WithWorkers sets how many files are downloaded at once, 5 by default
+func WithWorkers(n int) Option {
+	return func(d *Downloader) {
+		d.workerCount = n
+	}
+}
+
+// WithStorage sets where downloaded files are stored, the working directory by default
+func WithStorage(storage store.Storage) Option {
+	return func(d *Downloader) {
+		d.storage = storage
+	}
+}
+
+// WithJournal records queued jobs so they can be resumed after a restart
+func WithJournal(journal *Journal) Option {
+	return func(d *Downloader) {
+		d.journal = journal
+	}
+}
+
+// WithFailures remembers failed jobs and retries them in later passes
+func WithFailures(failures *FailureStore) Option {
+	return func(d *Downloader) {
+		d.failures = failures
+	}
+}
+
+// WithPHashes enables near-duplicate detection of downloaded images
+func WithPHashes(phashes *PHashStore) Option {
+	return func(d *Downloader) {
+		d.phashes = phashes
+	}
+}
+
+// WithHooks runs hooks after every downloaded file
+func WithHooks(hooks *Hooks) Option {
+	return func(d *Downloader) {
+		d.hooks = hooks
+	}
+}
+
+// WithDiskGuard makes downloads wait while the disk is almost full
+func WithDiskGuard(disk *DiskConfig) Option {
+	return func(d *Downloader) {
+		d.disk = disk
+	}
+}
+
+// WithContext stops the downloader like Stop once ctx is done, so a shutdown signal
+// also ends downloads paused by the space guard and unblocks Wait
+func WithContext(ctx context.Context) Option {
+	return func(d *Downloader) {
+		d.ctx = ctx
+	}
+}
+
+// New creates a downloader and starts its workers, client is used for all file requests
+func New(client *http.Client, opts ...Option) *Downloader {
+	d := &Downloader{
+		client:      client,
+		limiter:     rate.NewLimiter(rate.Every(200*time.Millisecond), 10), // 10 requests per second
+		queue:       NewDownloadQueue(),
+		storage:     store.NewDisk("."),
+		workerCount: 5,
+		ctx:         context.Background(),
+	}
+	for _, opt := range opts {
+		opt(d)
+	}
+	d.ctx, d.cancel = context.WithCancel(d.ctx)
+	// Pending jobs are dropped but stay in the journal, as with Stop
+	context.AfterFunc(d.ctx, d.queue.Close)
+	for range d.workerCount {
+		d.workers.Go(d.worker)
+	}
+	return d
+}
+
+// worker takes jobs from the queue until it is closed
+func (d *Downloader) worker() {
+	for {
+		item, ctx := d.queue.pop(d.ctx)
+		if item == nil {
+			return
+		}
+		err := d.downloadFile(ctx, item.job.URL, item.job.Path)
+		if err == nil && item.job.Resumed {
+			err = d.verifyResumed(item.job)
+		}
+		switch {
+		case err == nil:
+			if err = d.finish(item.job); err == nil {
+				d.hooks.Fire(d.fileEvent(item.job))
+			}
+		case errors.Is(err, errFileExists):
+			d.index(item.job, item.job.Path)
+			err = nil
+		}
+		switch {
+		case d.ctx.Err() != nil:
+			// Shutting down, the job is resumed from the journal
+		case errors.Is(err, context.Canceled):
+			logger.Log.Info("Download of %s cancelled", item.job.URL)
+		case err != nil:
+			d.recordFailure(item.job, err)
+		case d.failures != nil:
+			d.failures.Clear(item.job.Key())
+		}
+		if err == nil && d.ctx.Err() == nil && item.job.Next != nil && !d.Blocked(*item.job.Next) {
+			d.Enqueue(*item.job.Next)
+		}
+		// Jobs interrupted by shutdown stay in the journal to be resumed on next start
+		if d.journal != nil && d.ctx.Err() == nil {
+			d.journal.Remove(item.job.Key())
+		}
+		d.queue.done(item)
+	}
+}
+
+// errFileExists is returned by downloadFile when the destination is already in storage
+var errFileExists = errors.New("file already exists")
+
+// DownloadFile downloads url to name right away, bypassing the queue
+func (d *Downloader) DownloadFile(url, name string) error {
+	err := d.downloadFile(d.ctx, url, name)
+	if errors.Is(err, errFileExists) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := d.storage.Commit(d.storage.TempPath(name), name); err != nil {
+		return err
+	}
+	d.hooks.Fire(d.fileEvent(Job{URL: url, Path: name}))
+	return nil
+}
+
+// downloadFile downloads url to the temp path of dest in storage, the caller commits it
+func (d *Downloader) downloadFile(ctx context.Context, url, dest string) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+	}
+
+	err := d.limiter.Wait(ctx)
+	if err != nil {
+		return err
+	}
+
+	if _, err := d.storage.Stat(dest); err == nil {
+		logger.Log.Info("File %s already exists, skipping", dest)
+		return errFileExists
+	}
+
+	tempFile := d.storage.TempPath(dest)
+	if err := d.waitForSpace(ctx, filepath.Dir(tempFile)); err != nil {
+		return err
+	}
+
+	logger.Log.Info("Downloading %s", url)
+
+	if err := os.MkdirAll(filepath.Dir(tempFile), 0755); err != nil {
+		return fmt.Errorf("error creating directory: %w", err)
+	}
+
+	// Quick retries for network hiccups, longer outages are retried in later passes
+	const maxRetries = 3
+	var lastErr error
+	for attempt := range maxRetries {
+		if attempt > 0 {
+			backoff := time.Duration(1<<uint(attempt-1)) * time.Second
+			logger.Log.Warning("Retrying download (attempt %d/%d) after %v", attempt+1, maxRetries, backoff)
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(backoff):
+			}
+		}
+
+		err := d.downloadWithResume(ctx, url, tempFile)
+		if err == nil {
+			return nil
+		} else if e, ok := err.(*downloaderError); ok && e.permanent {
+			os.Remove(tempFile)
+			return err
+		}
+
+		// Check if it's a context cancellation - don't retry
+		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+			// Keep the partial file on shutdown so the journal can resume it
+			if d.ctx.Err() == nil {
+				os.Remove(tempFile)
+			}
+			return err
+		}
+
+		logger.Log.Error("Download attempt %d failed: %v", attempt+1, err)
+		lastErr = err
+	}
+
+	// The partial file is kept for the next pass to resume
+	return fmt.Errorf("failed to download after %d attempts: %w", maxRetries, lastErr)
+}
+
+// finish moves a downloaded file into storage and runs the post-download steps of its job
+func (d *Downloader) finish(job Job) error {
+	tempFile := d.storage.TempPath(job.Path)
+	indexPath, kept := job.Path, true
+	if d.phashes != nil && !job.Thumbnail {
+		indexPath, kept = d.phashes.Process(d.storage, tempFile, job.Path, job.MD5)
+	}
+	if kept {
+		if err := d.storage.Commit(tempFile, job.Path); err != nil {
+			return fmt.Errorf("error saving file: %w", err)
+		}
+	}
+	d.index(job, indexPath)
+	if kept && job.Meta != nil {
+		store.WriteMetadata(d.storage, job.Path, job.Meta, job.MetaOptions)
+	}
+	return nil
+}
+
+// verifyResumed checks a download resumed from the journal against the size and md5 recorded
+// with its job, a partial file from a previous run may belong to another version of the file
+func (d *Downloader) verifyResumed(job Job) error {
+	tempFile := d.storage.TempPath(job.Path)
+	file, err := os.Open(tempFile)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	hash := md5.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return fmt.Errorf("error reading %s: %w", tempFile, err)
+	}
+	var mismatch error
+	// The API reports sizes in whole KB
+	if job.Size > 0 && (size < job.Size-1024 || size > job.Size+1024) {
+		mismatch = fmt.Errorf("resumed %s has %d bytes, the journal expects about %d", job.Path, size, job.Size)
+	} else if sum := hex.EncodeToString(hash.Sum(nil)); job.MD5 != "" && !job.Thumbnail && !strings.EqualFold(sum, job.MD5) {
+		// Thumbnails carry the md5 of their full file
+		mismatch = fmt.Errorf("resumed %s has md5 %s, the journal expects %s", job.Path, sum, job.MD5)
+	}
+	if mismatch != nil {
+		// The next attempt starts from scratch
+		os.Remove(tempFile)
+		return &downloaderError{err: mismatch}
+	}
+	return nil
+}
+
+// fileEvent returns the hook event of a finished job
+func (d *Downloader) fileEvent(job Job) HookEvent {
+	event := HookEvent{
+		Type:      HookEventFile,
+		Board:     job.Board,
+		Thread:    job.Thread,
+		Path:      filepath.ToSlash(job.Path),
+		URL:       job.URL,
+		MD5:       job.MD5,
+		Thumbnail: job.Thumbnail,
+		Meta:      job.Meta,
+	}
+	if local, ok := d.storage.(store.LocalPather); ok {
+		event.LocalPath = local.LocalPath(job.Path)
+	}
+	return event
+}
+
+// index records the file of a job in the md5 index of its board directory
+func (d *Downloader) index(job Job, path string) {
+	if job.Root != "" && job.MD5 != "" {
+		store.AppendMD5Index(d.storage, job.Root, job.indexKey(), path)
+	}
+}
+
+// recordFailure schedules a failed job for a later pass or marks it dead
+func (d *Downloader) recordFailure(job Job, err error) {
+	if d.failures == nil {
+		logger.Log.Error("Error downloading %s: %v", job.URL, err)
+		return
+	}
+	f := d.failures.Record(job, err)
+	if f.Dead {
+		os.Remove(d.storage.TempPath(job.Path))
+		logger.Log.Error("Giving up on %s after %d attempts: %s", job.URL, f.Attempts, f.Reason)
+		return
+	}
+	logger.Log.Warning("Download of %s failed (%s), retrying after %s", job.URL, f.Reason, f.NextRetry.Format(time.DateTime))
+}
+
+func (d *Downloader) downloadWithResume(ctx context.Context, url, filepath string) error {
+	// Check if partial file exists
+	var bytesDownloaded int64
+	fileInfo, err := os.Stat(filepath)
+	if err == nil {
+		bytesDownloaded = fileInfo.Size()
+	}
+
+	// Create or open file, writes are positioned explicitly so a restart can truncate it
+	file, err := os.OpenFile(filepath, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("error opening file: %w", err)
+	}
+	defer file.Close()
+
+	// Create request with Range header if resuming
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return fmt.Errorf("error creating request: %w", err)
+	}
+
+	if bytesDownloaded > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", bytesDownloaded))
+		logger.Log.Info("Resuming download %s from byte %d", filepath, bytesDownloaded)
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error sending request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	// An anti-bot page would otherwise be saved as the file
+	if err := dvach.CheckChallenge(resp, url); err != nil {
+		return &downloaderError{err: err}
+	}
+
+	// An error page served with a success status is no file, retrying won't change that
+	if resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusPartialContent {
+		if err := checkContentType(resp); err != nil {
+			return err
+		}
+	}
+
+	// Work out where the body starts and how big the whole file is, -1 if unknown
+	var offset, total int64
+	switch resp.StatusCode {
+	case http.StatusOK:
+		if bytesDownloaded > 0 {
+			logger.Log.Warning("Server ignored range request for %s, restarting from scratch", url)
+		}
+		offset, total = 0, resp.ContentLength
+	case http.StatusPartialContent:
+		start, _, size, err := parseContentRange(resp.Header.Get("Content-Range"))
+		if err != nil {
+			return restartPartial(file, fmt.Errorf("invalid partial response: %w", err))
+		}
+		if start != bytesDownloaded {
+			return restartPartial(file, fmt.Errorf("server resumed from byte %d instead of %d", start, bytesDownloaded))
+		}
+		offset, total = start, size
+		if total < 0 && resp.ContentLength >= 0 {
+			total = start + resp.ContentLength
+		}
+	case http.StatusRequestedRangeNotSatisfiable:
+		// The partial file may already be complete, otherwise it can't be trusted
+		_, _, size, err := parseContentRange(resp.Header.Get("Content-Range"))
+		if err == nil && size == bytesDownloaded {
+			return nil
+		}
+		return restartPartial(file, fmt.Errorf("range %d- not satisfiable", bytesDownloaded))
+	default:
+		return statusError(resp.StatusCode)
+	}
+
+	if err := file.Truncate(offset); err != nil {
+		return fmt.Errorf("error truncating file: %w", err)
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return fmt.Errorf("error seeking file: %w", err)
+	}
+
+	logger.Log.Trace("Saving file to %s", filepath)
+
+	// Copy with a wrapper that can detect context cancellation
+	written, err := copyWithContext(ctx, file, resp.Body)
+	if err != nil {
+		return fmt.Errorf("error copying data: %w", err)
+	}
+
+	if total >= 0 && offset+written != total {
+		if offset+written > total {
+			return restartPartial(file, fmt.Errorf("got %d bytes, expected %d", offset+written, total))
+		}
+		return fmt.Errorf("incomplete download: got %d of %d bytes", offset+written, total)
+	}
+
+	return nil
+}
+
+// errUnsupportedType is wrapped by errors of responses that are not media files
+var errUnsupportedType = errors.New("unsupported file type")
+
+// checkContentType rejects pages and API responses returned instead of a file
+func checkContentType(resp *http.Response) error {
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	switch mediaType {
+	case "text/html", "application/xhtml+xml", "application/json":
+		return &downloaderError{err: fmt.Errorf("%w %s", errUnsupportedType, mediaType), permanent: true}
+	}
+	return nil
+}
+
+// restartPartial drops a partial file that can't be resumed so the next attempt starts from scratch
+func restartPartial(file *os.File, err error) error {
+	if terr := file.Truncate(0); terr != nil {
+		return fmt.Errorf("%w (error truncating file: %v)", err, terr)
+	}
+	return err
+}
+
+// parseContentRange parses a "bytes start-end/total" header, total is -1 when reported as "*"
+func parseContentRange(header string) (start, end, total int64, err error) {
+	spec, ok := strings.CutPrefix(header, "bytes ")
+	if !ok {
+		return 0, 0, 0, fmt.Errorf("unsupported Content-Range %q", header)
+	}
+	rng, size, ok := strings.Cut(spec, "/")
+	if !ok {
+		return 0, 0, 0, fmt.Errorf("malformed Content-Range %q", header)
+	}
+
+	total = -1
+	if size != "*" {
+		if total, err = strconv.ParseInt(size, 10, 64); err != nil {
+			return 0, 0, 0, fmt.Errorf("malformed Content-Range %q", header)
+		}
+	}
+	if rng == "*" {
+		return 0, 0, total, nil
+	}
+
+	first, last, ok := strings.Cut(rng, "-")
+	if !ok {
+		return 0, 0, 0, fmt.Errorf("malformed Content-Range %q", header)
+	}
+	if start, err = strconv.ParseInt(first, 10, 64); err != nil {
+		return 0, 0, 0, fmt.Errorf("malformed Content-Range %q", header)
+	}
+	if end, err = strconv.ParseInt(last, 10, 64); err != nil || end < start {
+		return 0, 0, 0, fmt.Errorf("malformed Content-Range %q", header)
+	}
+	return start, end, total, nil
+}
+
+func copyWithContext(ctx context.Context, dst io.Writer, src io.Reader) (int64, error) {
+	buf := make([]byte, 32*1024) // 32KB buffer
+	var written int64
+
+	for {
+		select {
+		case <-ctx.Done():
+			return written, ctx.Err()
+		default:
+		}
+
+		nr, er := src.Read(buf)
+		if nr > 0 {
+			nw, ew := dst.Write(buf[0:nr])
+			if nw > 0 {
+				written += int64(nw)
+			}
+			if ew != nil {
+				return written, ew
+			}
+			if nr != nw {
+				return written, io.ErrShortWrite
+			}
+		}
+		if er != nil {
+			if er != io.EOF {
+				return written, er
+			}
+			break
+		}
+	}
+	return written, nil
+}
+
+// DownloadFileAsync queues a download of url to filepath
+func (d *Downloader) DownloadFileAsync(url, filepath string) {
+	d.Enqueue(Job{URL: url, Path: filepath})
+}
+
+// Resume schedules jobs left over from a previous run ahead of new ones
+func (d *Downloader) Resume(jobs []Job) {
+	for _, job := range jobs {
+		job.Resumed = true
+		d.Enqueue(job)
+	}
+}
+
+// Storage returns where downloaded files are stored
+func (d *Downloader) Storage() store.Storage {
+	return d.storage
+}
+
+// Hooks returns the hooks of the downloader, nil if there are none
+func (d *Downloader) Hooks() *Hooks {
+	return d.hooks
+}
+
+// RetryDue re-enqueues failed jobs whose retry time has come, returns their number
+func (d *Downloader) RetryDue() int {
+	if d.failures == nil {
+		return 0
+	}
+	jobs := d.failures.Due(time.Now())
+	for _, job := range jobs {
+		d.Enqueue(job)
+	}
+	return len(jobs)
+}
+
+// Blocked reports whether a job failed before and shouldn't be tried yet
+func (d *Downloader) Blocked(job Job) bool {
+	return d.failures != nil && d.failures.Blocked(job.Key())
+}
+
+// Enqueue schedules a job, returns false if an identical job is already queued or the queue is closed
+func (d *Downloader) Enqueue(job Job) bool {
+	if d.journal == nil {
+		return d.queue.Push(job)
+	}
+	// Only accepted jobs are journaled, before a quick worker can record their completion
+	return d.queue.push(job, d.journal.Add)
+}
+
+// Cancel removes a pending job or aborts a running one
+func (d *Downloader) Cancel(key string) bool {
+	if !d.queue.Cancel(key) {
+		return false
+	}
+	if d.journal != nil {
+		d.journal.Remove(key)
+	}
+	return true
+}
+
+// Len returns the number of pending and running jobs
+func (d *Downloader) Len() (pending, active int) {
+	return d.queue.Len()
+}
+
+// Jobs returns a snapshot of pending and active jobs in priority order
+func (d *Downloader) Jobs() []JobStatus {
+	return d.queue.Snapshot()
+}
+
+// Wait blocks until the queue is drained
+func (d *Downloader) Wait() {
+	d.queue.Wait()
+}
+
+// Stop aborts running downloads, leaving them in the journal, and waits for workers and hooks
+func (d *Downloader) Stop() {
+	d.cancel()
+	d.queue.Close()
+	d.queue.Wait()
+	d.workers.Wait()
+	d.hooks.Wait()
+}
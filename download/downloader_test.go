@@ -0,0 +1,209 @@
+package download
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+var testContent = []byte(strings.Repeat("0123456789abcdef", 4096))
+
+// writePartial creates a .tmp file with the given content
+func writePartial(t *testing.T, content []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "file.bin.tmp")
+	if err := os.WriteFile(path, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func checkFile(t *testing.T, path string, want []byte) {
+	t.Helper()
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("file has %d bytes, want %d matching bytes", len(got), len(want))
+	}
+}
+
+// rangeStart returns the offset requested in a "bytes=N-" Range header
+func rangeStart(t *testing.T, r *http.Request) int64 {
+	spec, ok := strings.CutPrefix(r.Header.Get("Range"), "bytes=")
+	if !ok {
+		return 0
+	}
+	start, err := strconv.ParseInt(strings.TrimSuffix(spec, "-"), 10, 64)
+	if err != nil {
+		t.Errorf("bad Range header %q", r.Header.Get("Range"))
+	}
+	return start
+}
+
+func TestDownloadWithResumeHonoredRange(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := rangeStart(t, r)
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, len(testContent)-1, len(testContent)))
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(testContent[start:])
+	}))
+	defer srv.Close()
+
+	d := New(srv.Client(), WithWorkers(1))
+	defer d.Stop()
+
+	path := writePartial(t, testContent[:1000])
+	if err := d.downloadWithResume(d.ctx, srv.URL, path); err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, path, testContent)
+}
+
+func TestDownloadWithResumeRangeIgnored(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Always answer with the full body
+		w.Header().Set("Content-Length", strconv.Itoa(len(testContent)))
+		w.Write(testContent)
+	}))
+	defer srv.Close()
+
+	d := New(srv.Client(), WithWorkers(1))
+	defer d.Stop()
+
+	path := writePartial(t, testContent[:1000])
+	if err := d.downloadWithResume(d.ctx, srv.URL, path); err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, path, testContent)
+}
+
+func TestDownloadWithResumeWrongContentRange(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := rangeStart(t, r)
+		if start > 0 {
+			// Resume from a different offset than requested
+			start -= 10
+		}
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, len(testContent)-1, len(testContent)))
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(testContent[start:])
+	}))
+	defer srv.Close()
+
+	d := New(srv.Client(), WithWorkers(1))
+	defer d.Stop()
+
+	path := writePartial(t, testContent[:1000])
+	if err := d.downloadWithResume(d.ctx, srv.URL, path); err == nil {
+		t.Fatal("expected an error for mismatched Content-Range")
+	}
+	// The partial must be discarded so the retry starts from scratch
+	if err := d.downloadWithResume(d.ctx, srv.URL, path); err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, path, testContent)
+}
+
+func TestDownloadWithResumeTruncatedBody(t *testing.T) {
+	first := true
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := rangeStart(t, r)
+		body := testContent[start:]
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		if start > 0 {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, len(testContent)-1, len(testContent)))
+			w.WriteHeader(http.StatusPartialContent)
+		}
+		if first {
+			// Promise the whole body but hang up halfway
+			first = false
+			w.Write(body[:len(body)/2])
+			return
+		}
+		w.Write(body)
+	}))
+	defer srv.Close()
+
+	d := New(srv.Client(), WithWorkers(1))
+	defer d.Stop()
+
+	path := filepath.Join(t.TempDir(), "file.bin.tmp")
+	if err := d.downloadWithResume(d.ctx, srv.URL, path); err == nil {
+		t.Fatal("expected an error for truncated body")
+	}
+	info, err := os.Stat(path)
+	if err != nil || info.Size() != int64(len(testContent)/2) {
+		t.Fatalf("partial file should keep the received half: %v", err)
+	}
+	if err := d.downloadWithResume(d.ctx, srv.URL, path); err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, path, testContent)
+}
+
+func TestDownloadWithResumeOversizedPartial(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := rangeStart(t, r)
+		if start >= int64(len(testContent)) {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", len(testContent)))
+			w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		w.Write(testContent)
+	}))
+	defer srv.Close()
+
+	d := New(srv.Client(), WithWorkers(1))
+	defer d.Stop()
+
+	// A partial bigger than the remote file can't be trusted
+	path := writePartial(t, append(bytes.Clone(testContent), "garbage"...))
+	if err := d.downloadWithResume(d.ctx, srv.URL, path); err == nil {
+		t.Fatal("expected an error for unsatisfiable range")
+	}
+	if err := d.downloadWithResume(d.ctx, srv.URL, path); err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, path, testContent)
+
+	// A partial that is already complete is accepted as is
+	path = writePartial(t, testContent)
+	if err := d.downloadWithResume(d.ctx, srv.URL, path); err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, path, testContent)
+}
+
+func TestParseContentRange(t *testing.T) {
+	tests := []struct {
+		header            string
+		start, end, total int64
+		wantErr           bool
+	}{
+		{"bytes 0-99/100", 0, 99, 100, false},
+		{"bytes 10-99/*", 10, 99, -1, false},
+		{"bytes */100", 0, 0, 100, false},
+		{"bytes 99-10/100", 0, 0, 0, true},
+		{"items 0-1/2", 0, 0, 0, true},
+		{"bytes 0-99", 0, 0, 0, true},
+		{"", 0, 0, 0, true},
+	}
+	for _, tt := range tests {
+		start, end, total, err := parseContentRange(tt.header)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseContentRange(%q) error = %v, wantErr %v", tt.header, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && (start != tt.start || end != tt.end || total != tt.total) {
+			t.Errorf("parseContentRange(%q) = %d, %d, %d", tt.header, start, end, total)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package download
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/alekxeyuk/makaba-downloader/logger"
+)
+
+const (
+	retryBaseDelay = 5 * time.Minute
+	retryMaxDelay  = 6 * time.Hour
+)
+
+// Failure is a download that didn't succeed and is either waiting for another pass or dead
+type Failure struct {
+	Job       Job       `json:"job"`
+	Reason    string    `json:"reason"`
+	Attempts  int       `json:"attempts"`
+	LastTry   time.Time `json:"last_try"`
+	NextRetry time.Time `json:"next_retry,omitzero"`
+	Dead      bool      `json:"dead,omitempty"`
+}
+
+// FailureStore keeps failed downloads between passes and restarts
+type FailureStore struct {
+	mu          sync.Mutex
+	path        string
+	maxAttempts int
+	failures    map[string]*Failure
+}
+
+// LoadFailures reads failed downloads from path, a missing file is an empty store
+func LoadFailures(path string, maxAttempts int) *FailureStore {
+	store := &FailureStore{
+		path:        path,
+		maxAttempts: maxAttempts,
+		failures:    make(map[string]*Failure),
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Log.Error("Error opening %s: %v", path, err)
+		}
+		return store
+	}
+	defer file.Close()
+
+	var failures []*Failure
+	if err := json.NewDecoder(file).Decode(&failures); err != nil {
+		logger.Log.Error("Error decoding %s: %v", path, err)
+		return store
+	}
+	for _, f := range failures {
+		store.failures[f.Job.Key()] = f
+	}
+	return store
+}
+
+// Save writes all failures to disk
+func (s *FailureStore) Save() {
+	s.mu.Lock()
+	failures := make([]*Failure, 0, len(s.failures))
+	for _, f := range s.failures {
+		failures = append(failures, f)
+	}
+	s.mu.Unlock()
+
+	sort.Slice(failures, func(i, j int) bool { return failures[i].LastTry.Before(failures[j].LastTry) })
+
+	file, err := os.Create(s.path)
+	if err != nil {
+		logger.Log.Error("Error creating %s: %v", s.path, err)
+		return
+	}
+	defer file.Close()
+
+	encoder := json.NewEncoder(file)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(failures); err != nil {
+		logger.Log.Error("Error encoding %s: %v", s.path, err)
+	}
+}
+
+// Record registers a failed attempt and schedules the next one, returns the updated failure
+func (s *FailureStore) Record(job Job, err error) Failure {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, ok := s.failures[job.Key()]
+	if !ok {
+		f = &Failure{}
+		s.failures[job.Key()] = f
+	}
+
+	reason, permanent := classifyError(err)
+	f.Job = job
+	f.Job.Resumed = false
+	f.Reason = reason
+	f.Attempts++
+	f.LastTry = time.Now()
+	f.Dead = permanent || f.Attempts >= s.maxAttempts
+	if f.Dead {
+		f.NextRetry = time.Time{}
+	} else {
+		f.NextRetry = f.LastTry.Add(retryDelay(f.Attempts))
+	}
+	return *f
+}
+
+// Clear forgets a failure once the file has been downloaded
+func (s *FailureStore) Clear(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.failures, key)
+}
+
+// Blocked reports whether a job is dead or still waiting for its next retry
+func (s *FailureStore) Blocked(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, ok := s.failures[key]
+	if !ok {
+		return false
+	}
+	return f.Dead || time.Now().Before(f.NextRetry)
+}
+
+// Due returns jobs whose retry time has come
+func (s *FailureStore) Due(now time.Time) []Job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var jobs []Job
+	for _, f := range s.failures {
+		if !f.Dead && !now.Before(f.NextRetry) {
+			jobs = append(jobs, f.Job)
+		}
+	}
+	return jobs
+}
+
+// retryDelay doubles the delay with every attempt up to retryMaxDelay
+func retryDelay(attempts int) time.Duration {
+	delay := retryBaseDelay
+	for i := 1; i < attempts && delay < retryMaxDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, retryMaxDelay)
+}
+
+// classifyError returns a short reason and whether retrying is pointless
+func classifyError(err error) (reason string, permanent bool) {
+	var de *downloaderError
+	if errors.As(err, &de) {
+		return de.err.Error(), de.permanent
+	}
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) && netErr.Timeout() {
+		return "timeout: " + err.Error(), false
+	}
+	return err.Error(), false
+}
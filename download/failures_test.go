@@ -0,0 +1,152 @@
+package download
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alekxeyuk/makaba-downloader/dvach"
+	"github.com/alekxeyuk/makaba-downloader/store"
+)
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		name          string
+		err           error
+		wantPermanent bool
+	}{
+		{"not found", statusError(http.StatusNotFound), true},
+		{"gone", statusError(http.StatusGone), true},
+		{"unsupported media type", statusError(http.StatusUnsupportedMediaType), true},
+		{"unsupported content type", fmt.Errorf("wrapped: %w", &downloaderError{err: errUnsupportedType, permanent: true}), true},
+		{"forbidden", statusError(http.StatusForbidden), false},
+		{"unauthorized", statusError(http.StatusUnauthorized), false},
+		{"too many requests", statusError(http.StatusTooManyRequests), false},
+		{"server error", statusError(http.StatusBadGateway), false},
+		{"challenge", &downloaderError{err: &dvach.ChallengeError{Provider: "Cloudflare", Code: 403}}, false},
+		{"deadline", fmt.Errorf("copying: %w", context.DeadlineExceeded), false},
+		{"network timeout", &net.OpError{Op: "read", Err: os.ErrDeadlineExceeded}, false},
+		{"connection reset", errors.New("connection reset by peer"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reason, permanent := classifyError(tt.err)
+			if permanent != tt.wantPermanent {
+				t.Errorf("classifyError(%v) permanent = %v, want %v", tt.err, permanent, tt.wantPermanent)
+			}
+			if reason == "" {
+				t.Error("empty reason")
+			}
+		})
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	want := []time.Duration{
+		5 * time.Minute,
+		10 * time.Minute,
+		20 * time.Minute,
+		40 * time.Minute,
+		80 * time.Minute,
+		160 * time.Minute,
+		320 * time.Minute,
+		6 * time.Hour,
+		6 * time.Hour,
+	}
+	for i, w := range want {
+		if got := retryDelay(i + 1); got != w {
+			t.Errorf("retryDelay(%d) = %v, want %v", i+1, got, w)
+		}
+	}
+}
+
+func TestFailureStore(t *testing.T) {
+	failures := LoadFailures(filepath.Join(t.TempDir(), "failures.json"), 2)
+	transient := Job{URL: "a"}
+	dead := Job{URL: "b"}
+
+	if failures.Blocked(transient.Key()) {
+		t.Error("unknown job is blocked")
+	}
+
+	f := failures.Record(transient, statusError(http.StatusBadGateway))
+	if f.Dead || f.Attempts != 1 || f.NextRetry.Sub(f.LastTry) != retryBaseDelay {
+		t.Errorf("first transient failure = %+v, want a retry after %v", f, retryBaseDelay)
+	}
+	if !failures.Blocked(transient.Key()) {
+		t.Error("job waiting for its retry is not blocked")
+	}
+	if due := failures.Due(time.Now()); len(due) != 0 {
+		t.Errorf("Due now = %d jobs, want none", len(due))
+	}
+	if due := failures.Due(f.NextRetry); len(due) != 1 || due[0].URL != "a" {
+		t.Errorf("Due at the retry time = %v, want job a", due)
+	}
+
+	// The attempt budget runs out
+	if f := failures.Record(transient, statusError(http.StatusBadGateway)); !f.Dead || !f.NextRetry.IsZero() {
+		t.Errorf("failure past the attempt budget = %+v, want dead", f)
+	}
+
+	if f := failures.Record(dead, statusError(http.StatusNotFound)); !f.Dead || f.Attempts != 1 {
+		t.Errorf("permanent failure = %+v, want dead after one attempt", f)
+	}
+	for _, job := range []Job{transient, dead} {
+		if !failures.Blocked(job.Key()) {
+			t.Errorf("dead job %s is not blocked", job.URL)
+		}
+	}
+	if due := failures.Due(time.Now().Add(24 * time.Hour)); len(due) != 0 {
+		t.Errorf("Due returned %d dead jobs", len(due))
+	}
+
+	failures.Clear(dead.Key())
+	if failures.Blocked(dead.Key()) {
+		t.Error("cleared job is still blocked")
+	}
+}
+
+func TestFailureStoreSaveLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "failures.json")
+	failures := LoadFailures(path, 5)
+	failures.Record(Job{URL: "a", Resumed: true}, statusError(http.StatusBadGateway))
+	failures.Save()
+
+	loaded := LoadFailures(path, 5)
+	if !loaded.Blocked(Job{URL: "a"}.Key()) {
+		t.Error("loaded failure is not blocked")
+	}
+	if due := loaded.Due(time.Now().Add(time.Hour)); len(due) != 1 || due[0].Resumed {
+		t.Errorf("Due after load = %+v, want job a not marked resumed", due)
+	}
+}
+
+func TestDownloadFileUnsupportedType(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte("<html><body>File removed</body></html>"))
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	d := New(srv.Client(), WithWorkers(1), WithStorage(store.NewDisk(dir)))
+	defer d.Stop()
+
+	err := d.downloadFile(d.ctx, srv.URL, "file.webm")
+	if !errors.Is(err, errUnsupportedType) {
+		t.Fatalf("downloadFile = %v, want an unsupported file type", err)
+	}
+	if _, permanent := classifyError(err); !permanent {
+		t.Error("unsupported file type is not permanent")
+	}
+	if _, err := os.Stat(d.storage.TempPath("file.webm")); !os.IsNotExist(err) {
+		t.Errorf("partial file kept: %v", err)
+	}
+}
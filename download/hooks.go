@@ -0,0 +1,245 @@
+package download
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alekxeyuk/makaba-downloader/internal/webhook"
+	"github.com/alekxeyuk/makaba-downloader/logger"
+	"github.com/alekxeyuk/makaba-downloader/store"
+)
+
+// Events hooks can be run for
+const (
+	HookEventFile   = "file"   // a file was downloaded and stored
+	HookEventThread = "thread" // a thread pass finished queuing its files
+)
+
+// HookEvent describes what happened to a hook
+type HookEvent struct {
+	Type      string          `json:"type"` // HookEventFile or HookEventThread
+	Board     string          `json:"board,omitempty"`
+	Thread    int64           `json:"thread,omitempty"`
+	Path      string          `json:"path,omitempty"`       // storage name of the file
+	LocalPath string          `json:"local_path,omitempty"` // path on disk, empty for remote storage
+	URL       string          `json:"url,omitempty"`
+	MD5       string          `json:"md5,omitempty"`
+	Thumbnail bool            `json:"thumbnail,omitempty"`
+	Queued    int             `json:"queued,omitempty"` // files queued by a thread pass
+	Meta      *store.FileMeta `json:"meta,omitempty"`
+	Time      time.Time       `json:"time"`
+}
+
+// Hook is run for events, implement it to embed the downloader
+type Hook interface {
+	Name() string
+	Run(ctx context.Context, event HookEvent) error
+}
+
+// HookConfig configures a command or webhook hook
+type HookConfig struct {
+	Name           string            `json:"name,omitempty"`
+	Events         []string          `json:"events,omitempty"` // default is all events
+	Boards         []string          `json:"boards,omitempty"` // default is all boards
+	Command        []string          `json:"command,omitempty"`
+	Webhook        string            `json:"webhook,omitempty"`
+	Headers        map[string]string `json:"headers,omitempty"` // extra webhook headers
+	TimeoutSeconds int               `json:"timeout_seconds,omitempty"`
+}
+
+// registeredHook is a hook with the events and boards it is run for
+type registeredHook struct {
+	hook    Hook
+	events  []string
+	boards  []string
+	timeout time.Duration
+}
+
+func (r *registeredHook) wants(event HookEvent) bool {
+	if len(r.events) > 0 && !slices.Contains(r.events, event.Type) {
+		return false
+	}
+	return len(r.boards) == 0 || slices.Contains(r.boards, event.Board)
+}
+
+// Hooks runs hooks in the background with a limit on how many run at once
+type Hooks struct {
+	hooks []*registeredHook
+	sem   chan struct{}
+	wg    sync.WaitGroup
+}
+
+// NewHooks creates hooks from their configuration, maxConcurrent limits hooks running at once
+func NewHooks(configs []HookConfig, maxConcurrent int) (*Hooks, error) {
+	if maxConcurrent <= 0 {
+		maxConcurrent = 2
+	}
+	h := &Hooks{sem: make(chan struct{}, maxConcurrent)}
+	for i, config := range configs {
+		var hook Hook
+		name := config.Name
+		switch {
+		case len(config.Command) > 0 && config.Webhook != "":
+			return nil, fmt.Errorf("hook %d: set either command or webhook", i+1)
+		case len(config.Command) > 0:
+			if name == "" {
+				name = config.Command[0]
+			}
+			hook = &CommandHook{name: name, args: config.Command}
+		case config.Webhook != "":
+			if name == "" {
+				name = config.Webhook
+			}
+			hook = &WebhookHook{name: name, url: config.Webhook, headers: config.Headers, client: &http.Client{}}
+		default:
+			return nil, fmt.Errorf("hook %d: command or webhook is missing", i+1)
+		}
+		for _, event := range config.Events {
+			if event != HookEventFile && event != HookEventThread {
+				return nil, fmt.Errorf("hook %s: unknown event %q", name, event)
+			}
+		}
+		h.Register(hook, config.Events, config.Boards, time.Duration(config.TimeoutSeconds)*time.Second)
+	}
+	return h, nil
+}
+
+// Register adds a hook run for the given events and boards, empty lists mean all of them.
+// A zero timeout defaults to one minute.
+func (h *Hooks) Register(hook Hook, events, boards []string, timeout time.Duration) {
+	if timeout <= 0 {
+		timeout = time.Minute
+	}
+	h.hooks = append(h.hooks, &registeredHook{hook: hook, events: events, boards: boards, timeout: timeout})
+}
+
+// Fire runs all hooks wanting the event in the background, failures are logged.
+// It blocks while the maximum number of hooks is running, so slow hooks hold back
+// their callers instead of piling up.
+func (h *Hooks) Fire(event HookEvent) {
+	if h == nil {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	for _, r := range h.hooks {
+		if !r.wants(event) {
+			continue
+		}
+		h.sem <- struct{}{}
+		h.wg.Go(func() {
+			defer func() { <-h.sem }()
+
+			ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+			defer cancel()
+			start := time.Now()
+			if err := r.hook.Run(ctx, event); err != nil {
+				logger.Log.Error("Hook %s failed for %s event %s: %v", r.hook.Name(), event.Type, event.describe(), err)
+				return
+			}
+			logger.Log.Trace("Hook %s done for %s in %v", r.hook.Name(), event.describe(), time.Since(start).Round(time.Millisecond))
+		})
+	}
+}
+
+// Wait blocks until all running hooks are done
+func (h *Hooks) Wait() {
+	if h != nil {
+		h.wg.Wait()
+	}
+}
+
+func (e HookEvent) describe() string {
+	if e.Path != "" {
+		return e.Path
+	}
+	return fmt.Sprintf("%s/%d", e.Board, e.Thread)
+}
+
+// fields returns the values available to command arguments as {name}
+func (e HookEvent) fields() map[string]string {
+	return map[string]string{
+		"event":      e.Type,
+		"board":      e.Board,
+		"thread":     strconv.FormatInt(e.Thread, 10),
+		"path":       e.Path,
+		"local_path": e.LocalPath,
+		"url":        e.URL,
+		"md5":        e.MD5,
+		"queued":     strconv.Itoa(e.Queued),
+	}
+}
+
+// CommandHook runs a program, arguments may contain {event}, {board}, {thread}, {path},
+// {local_path}, {url}, {md5} and {queued}. No shell is involved, the values are also
+// passed as MAKABA_* environment variables.
+type CommandHook struct {
+	name string
+	args []string
+}
+
+func (c *CommandHook) Name() string {
+	return c.name
+}
+
+func (c *CommandHook) Run(ctx context.Context, event HookEvent) error {
+	fields := event.fields()
+	var pairs []string
+	for k, v := range fields {
+		pairs = append(pairs, "{"+k+"}", v)
+	}
+	replacer := strings.NewReplacer(pairs...)
+	args := make([]string, len(c.args))
+	for i, arg := range c.args {
+		args[i] = replacer.Replace(arg)
+	}
+
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Env = os.Environ()
+	for k, v := range fields {
+		cmd.Env = append(cmd.Env, "MAKABA_"+strings.ToUpper(k)+"="+v)
+	}
+	// Kill the process if it doesn't react to the timeout
+	cmd.WaitDelay = 5 * time.Second
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		if out := strings.TrimSpace(string(output)); out != "" {
+			return fmt.Errorf("%w: %s", err, store.TruncateUTF8(out, 512))
+		}
+		return err
+	}
+	return nil
+}
+
+// WebhookHook posts events as JSON
+type WebhookHook struct {
+	name    string
+	url     string
+	headers map[string]string
+	client  *http.Client
+}
+
+func (w *WebhookHook) Name() string {
+	return w.name
+}
+
+func (w *WebhookHook) Run(ctx context.Context, event HookEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return webhook.PostJSON(ctx, w.client, w.url, body, w.headers)
+}
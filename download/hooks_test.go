@@ -0,0 +1,153 @@
+package download
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHooksFire(t *testing.T) {
+	events := make(chan HookEvent, 2)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event HookEvent
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+			t.Errorf("decoding webhook body: %v", err)
+		}
+		if r.Header.Get("X-Token") != "secret" {
+			t.Errorf("X-Token = %q", r.Header.Get("X-Token"))
+		}
+		events <- event
+	}))
+	defer srv.Close()
+
+	hooks, err := NewHooks([]HookConfig{{
+		Webhook: srv.URL,
+		Headers: map[string]string{"X-Token": "secret"},
+		Events:  []string{HookEventFile},
+		Boards:  []string{"b"},
+	}}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hooks.Fire(HookEvent{Type: HookEventThread, Board: "b", Thread: 1})
+	hooks.Fire(HookEvent{Type: HookEventFile, Board: "vg", Path: "vg/1/a.jpg"})
+	hooks.Fire(HookEvent{Type: HookEventFile, Board: "b", Path: "b/1/a.jpg"})
+	hooks.Wait()
+
+	close(events)
+	var got []string
+	for event := range events {
+		got = append(got, event.Path)
+	}
+	if len(got) != 1 || got[0] != "b/1/a.jpg" {
+		t.Errorf("webhook got %q, want only the b file event", got)
+	}
+}
+
+// slowHook counts how many runs overlap
+type slowHook struct {
+	running, peak atomic.Int32
+}
+
+func (h *slowHook) Name() string { return "slow" }
+
+func (h *slowHook) Run(ctx context.Context, event HookEvent) error {
+	n := h.running.Add(1)
+	defer h.running.Add(-1)
+	for {
+		peak := h.peak.Load()
+		if n <= peak || h.peak.CompareAndSwap(peak, n) {
+			break
+		}
+	}
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestHooksConcurrencyAndTimeout(t *testing.T) {
+	hooks, err := NewHooks(nil, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hook := &slowHook{}
+	hooks.Register(hook, nil, nil, 20*time.Millisecond)
+	for range 5 {
+		hooks.Fire(HookEvent{Type: HookEventFile})
+	}
+	hooks.Wait()
+	if peak := hook.peak.Load(); peak != 2 {
+		t.Errorf("peak concurrency = %d, want 2", peak)
+	}
+}
+
+// blockingHook runs until release is closed
+type blockingHook struct {
+	release chan struct{}
+}
+
+func (h *blockingHook) Name() string { return "blocking" }
+
+func (h *blockingHook) Run(ctx context.Context, event HookEvent) error {
+	<-h.release
+	return nil
+}
+
+func TestHooksFireBlocksWhenFull(t *testing.T) {
+	hooks, err := NewHooks(nil, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hook := &blockingHook{release: make(chan struct{})}
+	hooks.Register(hook, nil, nil, time.Minute)
+	hooks.Fire(HookEvent{Type: HookEventFile})
+
+	fired := make(chan struct{})
+	go func() {
+		hooks.Fire(HookEvent{Type: HookEventFile})
+		close(fired)
+	}()
+	select {
+	case <-fired:
+		t.Fatal("Fire returned while all hooks were running")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(hook.release)
+	select {
+	case <-fired:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Fire still blocked after a hook finished")
+	}
+	hooks.Wait()
+}
+
+func TestCommandHook(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("no sh")
+	}
+	out := filepath.Join(t.TempDir(), "out")
+	hook := &CommandHook{name: "sh", args: []string{"sh", "-c", `printf '%s %s' "$1" "$MAKABA_BOARD" > "$2"`, "sh", "{path}", out}}
+	err := hook.Run(context.Background(), HookEvent{Type: HookEventFile, Board: "b", Path: "b/1/it's a file.jpg"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := os.ReadFile(out)
+	if string(data) != "b/1/it's a file.jpg b" {
+		t.Errorf("command wrote %q", data)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	hook = &CommandHook{name: "sleep", args: []string{"sleep", "5"}}
+	if err := hook.Run(ctx, HookEvent{}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Run of a slow command = %v, want deadline exceeded", err)
+	}
+}
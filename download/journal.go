@@ -0,0 +1,155 @@
+package download
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"sync"
+
+	"github.com/alekxeyuk/makaba-downloader/logger"
+)
+
+// journalEntry is a single line of the queue journal
+type journalEntry struct {
+	Op  string `json:"op"` // "add" or "done"
+	Job *Job   `json:"job,omitempty"`
+	Key string `json:"key,omitempty"`
+}
+
+// Journal is an append-only log of queued downloads that survives restarts
+type Journal struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+	enc  *json.Encoder
+}
+
+// OpenJournal replays the journal at path, compacts it and returns the jobs that were still pending
+func OpenJournal(path string) (*Journal, []Job, error) {
+	pending, err := replayJournal(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	file, err := rewriteJournal(path, pending)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &Journal{path: path, file: file, enc: json.NewEncoder(file)}, pending, nil
+}
+
+// Compact rewrites the journal with the jobs that are still pending, so it doesn't grow
+// forever in a long running process
+func (j *Journal) Compact() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	pending, err := replayJournal(j.path)
+	if err != nil {
+		return err
+	}
+	file, err := rewriteJournal(j.path, pending)
+	if err != nil {
+		return err
+	}
+	j.file.Close()
+	j.file = file
+	j.enc = json.NewEncoder(file)
+	return nil
+}
+
+// rewriteJournal replaces the journal at path with pending jobs only and opens it for appending
+func rewriteJournal(path string, pending []Job) (*os.File, error) {
+	tmpPath := path + ".tmp"
+	tmp, err := os.Create(tmpPath)
+	if err != nil {
+		return nil, err
+	}
+	enc := json.NewEncoder(tmp)
+	for i := range pending {
+		if err := enc.Encode(journalEntry{Op: "add", Job: &pending[i]}); err != nil {
+			tmp.Close()
+			return nil, err
+		}
+	}
+	if err := tmp.Close(); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return nil, err
+	}
+	return os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+}
+
+func replayJournal(path string) ([]Job, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var order []string
+	jobs := make(map[string]Job)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var entry journalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			// A torn last line after a crash is expected, skip it
+			logger.Log.Warning("Skipping malformed journal entry in %s: %v", path, err)
+			continue
+		}
+		switch entry.Op {
+		case "add":
+			if entry.Job == nil {
+				continue
+			}
+			key := entry.Job.Key()
+			if _, ok := jobs[key]; !ok {
+				order = append(order, key)
+			}
+			jobs[key] = *entry.Job
+		case "done":
+			delete(jobs, entry.Key)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	var pending []Job
+	for _, key := range order {
+		if job, ok := jobs[key]; ok {
+			pending = append(pending, job)
+		}
+	}
+	return pending, nil
+}
+
+// Add records a queued job
+func (j *Journal) Add(job Job) {
+	j.write(journalEntry{Op: "add", Job: &job})
+}
+
+// Remove records that the job with the given key no longer needs to be resumed
+func (j *Journal) Remove(key string) {
+	j.write(journalEntry{Op: "done", Key: key})
+}
+
+func (j *Journal) write(entry journalEntry) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if err := j.enc.Encode(entry); err != nil {
+		logger.Log.Error("Error writing %s: %v", j.path, err)
+	}
+}
+
+// Close closes the journal file
+func (j *Journal) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.file.Close()
+}
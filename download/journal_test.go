@@ -0,0 +1,202 @@
+package download
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/alekxeyuk/makaba-downloader/store"
+)
+
+func writeJournal(t *testing.T, lines ...string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "queue.json")
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func jobURLs(jobs []Job) []string {
+	var urls []string
+	for _, job := range jobs {
+		urls = append(urls, job.URL)
+	}
+	return urls
+}
+
+func TestOpenJournalReplay(t *testing.T) {
+	path := writeJournal(t,
+		`{"op":"add","job":{"url":"a","path":"1"}}`,
+		`{"op":"add","job":{"url":"b","path":"2"}}`,
+		`{"op":"add","job":{"url":"c","path":"3","md5":"x"}}`,
+		`{"op":"done","key":"b\u00002"}`,
+		`{"op":"add","job":{"url":"c","path":"3","md5":"y"}}`,
+		`{"op":"add","job":{"url":"d","pa`, // torn by a crash
+	)
+	journal, pending, err := OpenJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer journal.Close()
+
+	if got := jobURLs(pending); !slices.Equal(got, []string{"a", "c"}) {
+		t.Fatalf("pending = %v, want [a c]", got)
+	}
+	if pending[1].MD5 != "y" {
+		t.Errorf("re-added job has md5 %q, want the latest y", pending[1].MD5)
+	}
+}
+
+func TestOpenJournalCompacts(t *testing.T) {
+	path := writeJournal(t,
+		`{"op":"add","job":{"url":"a","path":"1"}}`,
+		`{"op":"add","job":{"url":"b","path":"2"}}`,
+		`{"op":"done","key":"a\u00001"}`,
+		`garbage`,
+	)
+	journal, _, err := OpenJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	journal.Remove("b\x002")
+	journal.Close()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[0], `"url":"b"`) || !strings.Contains(lines[1], `"done"`) {
+		t.Errorf("compacted journal:\n%s\nwant the pending add of b followed by its removal", data)
+	}
+
+	_, pending, err := OpenJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 0 {
+		t.Errorf("pending after removal = %v, want none", jobURLs(pending))
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temporary journal left behind: %v", err)
+	}
+}
+
+func TestJournalCompact(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue.json")
+	journal, _, err := OpenJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer journal.Close()
+	for _, url := range []string{"a", "b", "c"} {
+		journal.Add(Job{URL: url, Path: url})
+	}
+	journal.Remove("a\x00a")
+	journal.Remove("c\x00c")
+	if err := journal.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	// Entries written after the rewrite go to the new file
+	journal.Add(Job{URL: "d", Path: "d"})
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(strings.TrimSpace(string(data)), "\n") + 1; n != 2 {
+		t.Errorf("compacted journal has %d lines, want 2:\n%s", n, data)
+	}
+	pending, err := replayJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := jobURLs(pending); !slices.Equal(got, []string{"b", "d"}) {
+		t.Errorf("pending = %v, want [b d]", got)
+	}
+}
+
+func TestOpenJournalMissing(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue.json")
+	journal, pending, err := OpenJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer journal.Close()
+	if len(pending) != 0 {
+		t.Errorf("pending = %v, want none", jobURLs(pending))
+	}
+}
+
+func TestEnqueueJournalsAcceptedJobsOnly(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue.json")
+	journal, _, err := OpenJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer journal.Close()
+
+	// No workers, jobs stay pending
+	d := New(nil, WithWorkers(0), WithJournal(journal))
+	job := Job{URL: "a", Path: "1"}
+	if !d.Enqueue(job) {
+		t.Fatal("Enqueue = false")
+	}
+	if d.Enqueue(job) {
+		t.Error("Enqueue of a duplicate = true")
+	}
+	d.Stop()
+	if d.Enqueue(Job{URL: "b", Path: "2"}) {
+		t.Error("Enqueue after Stop = true")
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(data), `"op":"add"`); n != 1 {
+		t.Errorf("journal has %d adds, want 1:\n%s", n, data)
+	}
+}
+
+func TestVerifyResumed(t *testing.T) {
+	sum := md5.Sum(testContent)
+	md5sum := hex.EncodeToString(sum[:])
+	tests := []struct {
+		name    string
+		job     Job
+		wantErr bool
+	}{
+		{"matches", Job{MD5: md5sum, Size: int64(len(testContent))}, false},
+		{"nothing recorded", Job{}, false},
+		{"size rounded to KB", Job{Size: int64(len(testContent)) + 512}, false},
+		{"size off", Job{MD5: md5sum, Size: int64(len(testContent)) * 2}, true},
+		{"md5 off", Job{MD5: strings.Repeat("0", 32)}, true},
+		{"thumbnail with the md5 of its full file", Job{MD5: strings.Repeat("0", 32), Thumbnail: true}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			d := New(nil, WithWorkers(0), WithStorage(store.NewDisk(dir)))
+			defer d.Stop()
+
+			tt.job.Path = "file.bin"
+			tempFile := d.storage.TempPath(tt.job.Path)
+			if err := os.WriteFile(tempFile, testContent, 0644); err != nil {
+				t.Fatal(err)
+			}
+			err := d.verifyResumed(tt.job)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("verifyResumed = %v, want error %v", err, tt.wantErr)
+			}
+			if _, statErr := os.Stat(tempFile); tt.wantErr != os.IsNotExist(statErr) {
+				t.Errorf("partial file kept = %v after a mismatch = %v", statErr == nil, tt.wantErr)
+			}
+		})
+	}
+}
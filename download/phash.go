@@ -0,0 +1,369 @@
+package download
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"io/fs"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/alekxeyuk/makaba-downloader/logger"
+	"github.com/alekxeyuk/makaba-downloader/store"
+	_ "golang.org/x/image/webp"
+)
+
+// Actions taken on near-duplicates
+const (
+	PHashActionFlag = "flag" // keep the file and report it
+	PHashActionLink = "link" // replace the file with a hard link to the original
+	// PHashActionDelete deletes the file once it is downloaded and hashed, a near-duplicate
+	// can only be recognized from its content so the download itself isn't avoided
+	PHashActionDelete = "delete"
+	// PHashActionSkip is the former name of PHashActionDelete, still accepted in configs
+	PHashActionSkip = "skip"
+)
+
+// PHashConfig enables near-duplicate detection of downloaded images
+type PHashConfig struct {
+	Enabled     bool   `json:"enabled"`
+	MaxDistance int    `json:"max_distance,omitempty"` // max Hamming distance between hashes of duplicates, default 6
+	Action      string `json:"action,omitempty"`       // PHashActionFlag (default), PHashActionLink or PHashActionDelete
+}
+
+// phashExtensions are the formats with a registered decoder, webp is decoded in pure Go by x/image
+var phashExtensions = map[string]bool{".jpg": true, ".jpeg": true, ".png": true, ".gif": true, ".webp": true}
+
+// PHashEntry is an image seen by the near-duplicate detector
+type PHashEntry struct {
+	Hash        string `json:"hash"` // 64-bit dHash as hex
+	Path        string `json:"path"`
+	MD5         string `json:"md5,omitempty"`
+	DuplicateOf string `json:"duplicate_of,omitempty"` // path of the original for near-duplicates
+	Action      string `json:"action,omitempty"`       // what was done to the duplicate
+
+	hash uint64
+}
+
+// PHashStore keeps the hashes of downloaded images between passes and restarts
+type PHashStore struct {
+	mu      sync.Mutex
+	path    string
+	config  PHashConfig
+	entries []*PHashEntry
+}
+
+// LoadPHashes reads image hashes from path, a missing file is an empty store
+func LoadPHashes(path string, config PHashConfig) *PHashStore {
+	if config.MaxDistance <= 0 {
+		config.MaxDistance = 6
+	}
+	switch config.Action {
+	case "":
+		config.Action = PHashActionFlag
+	case PHashActionSkip:
+		config.Action = PHashActionDelete
+	}
+	store := &PHashStore{path: path, config: config}
+
+	file, err := os.Open(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Log.Error("Error opening %s: %v", path, err)
+		}
+		return store
+	}
+	defer file.Close()
+
+	if err := json.NewDecoder(file).Decode(&store.entries); err != nil {
+		logger.Log.Error("Error decoding %s: %v", path, err)
+		store.entries = nil
+		return store
+	}
+	for _, e := range store.entries {
+		e.hash, _ = strconv.ParseUint(e.Hash, 16, 64)
+	}
+	return store
+}
+
+// Save writes all hashes to disk
+func (s *PHashStore) Save() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	file, err := os.Create(s.path)
+	if err != nil {
+		logger.Log.Error("Error creating %s: %v", s.path, err)
+		return
+	}
+	defer file.Close()
+
+	if err := json.NewEncoder(file).Encode(s.entries); err != nil {
+		logger.Log.Error("Error encoding %s: %v", s.path, err)
+	}
+}
+
+// Process hashes a freshly downloaded image in file before it is committed to storage as path,
+// and handles it if it is a near-duplicate.
+// It returns the path the md5 index should point to and whether the file should still be stored.
+func (s *PHashStore) Process(storage store.Storage, file, path, md5 string) (string, bool) {
+	if !phashExtensions[strings.ToLower(filepath.Ext(path))] {
+		return path, true
+	}
+
+	hash, err := dHashFile(file)
+	if err != nil {
+		logger.Log.Trace("Not hashing %s: %v", path, err)
+		return path, true
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry := &PHashEntry{Hash: fmt.Sprintf("%016x", hash), Path: path, MD5: md5, hash: hash}
+	original := s.nearestStored(storage, hash)
+	s.entries = append(s.entries, entry)
+	if original == nil {
+		return path, true
+	}
+
+	entry.DuplicateOf = original.Path
+	entry.Action = s.config.Action
+	distance := bits.OnesCount64(hash ^ original.hash)
+	switch s.config.Action {
+	case PHashActionDelete:
+		logger.Log.Info("Removing %s, near-duplicate of %s (distance %d)", path, original.Path, distance)
+		if err := os.Remove(file); err != nil {
+			logger.Log.Error("Error removing %s: %v", path, err)
+			return path, true
+		}
+		// Point the index at the original so the file isn't downloaded again
+		return original.Path, false
+	case PHashActionLink:
+		local, ok := storage.(store.LocalPather)
+		if !ok {
+			logger.Log.Warning("%s looks like a near-duplicate of %s (distance %d), links need local storage", path, original.Path, distance)
+			return path, true
+		}
+		logger.Log.Info("Linking %s to near-duplicate %s (distance %d)", path, original.Path, distance)
+		if err := replaceWithLink(local.LocalPath(original.Path), file); err != nil {
+			logger.Log.Error("Error linking %s: %v", path, err)
+		}
+		return path, true
+	default:
+		logger.Log.Warning("%s looks like a near-duplicate of %s (distance %d)", path, original.Path, distance)
+		return path, true
+	}
+}
+
+// nearest returns the closest original within the max distance, nil if there is none
+func (s *PHashStore) nearest(hash uint64) *PHashEntry {
+	var best *PHashEntry
+	bestDistance := s.config.MaxDistance + 1
+	for _, e := range s.entries {
+		if e.DuplicateOf != "" {
+			continue
+		}
+		if d := bits.OnesCount64(hash ^ e.hash); d < bestDistance {
+			best, bestDistance = e, d
+		}
+	}
+	return best
+}
+
+// nearestStored is nearest for originals still in storage, the ones deleted since,
+// e.g. by retention, are forgotten so their duplicates are no longer measured against them
+func (s *PHashStore) nearestStored(storage store.Storage, hash uint64) *PHashEntry {
+	for {
+		original := s.nearest(hash)
+		if original == nil {
+			return nil
+		}
+		_, err := storage.Stat(original.Path)
+		switch {
+		case err == nil:
+			return original
+		case errors.Is(err, fs.ErrNotExist):
+			s.forget(original)
+		default:
+			logger.Log.Error("Error checking near-duplicate original %s: %v", original.Path, err)
+			return nil
+		}
+	}
+}
+
+// forget drops the entry of an original that is gone. Its deleted duplicates go with it,
+// the ones still stored become originals themselves.
+func (s *PHashStore) forget(gone *PHashEntry) {
+	kept := s.entries[:0]
+	for _, e := range s.entries {
+		switch {
+		case e == gone:
+			continue
+		case e.DuplicateOf != gone.Path:
+		case e.Action == PHashActionDelete:
+			continue
+		default:
+			e.DuplicateOf, e.Action = "", ""
+		}
+		kept = append(kept, e)
+	}
+	clear(s.entries[len(kept):])
+	s.entries = kept
+}
+
+// Clusters groups all known images into sets of near-duplicates, biggest first
+func (s *PHashStore) Clusters() [][]*PHashEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Union-find over all pairs within the max distance
+	parent := make([]int, len(s.entries))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(int) int
+	find = func(i int) int {
+		for parent[i] != i {
+			parent[i] = parent[parent[i]]
+			i = parent[i]
+		}
+		return i
+	}
+	for i := range s.entries {
+		for j := i + 1; j < len(s.entries); j++ {
+			if bits.OnesCount64(s.entries[i].hash^s.entries[j].hash) <= s.config.MaxDistance {
+				parent[find(i)] = find(j)
+			}
+		}
+	}
+
+	groups := make(map[int][]*PHashEntry)
+	for i, e := range s.entries {
+		root := find(i)
+		groups[root] = append(groups[root], e)
+	}
+	var clusters [][]*PHashEntry
+	for _, group := range groups {
+		if len(group) > 1 {
+			clusters = append(clusters, group)
+		}
+	}
+	sort.Slice(clusters, func(i, j int) bool {
+		if len(clusters[i]) != len(clusters[j]) {
+			return len(clusters[i]) > len(clusters[j])
+		}
+		return clusters[i][0].Path < clusters[j][0].Path
+	})
+	return clusters
+}
+
+// WriteReport lists near-duplicate clusters
+func (s *PHashStore) WriteReport(w io.Writer) {
+	clusters := s.Clusters()
+	if len(clusters) == 0 {
+		fmt.Fprintln(w, "No near-duplicates found")
+		return
+	}
+	for i, cluster := range clusters {
+		fmt.Fprintf(w, "Cluster %d (%d files):\n", i+1, len(cluster))
+		for _, e := range cluster {
+			note := ""
+			if e.DuplicateOf != "" {
+				note = fmt.Sprintf(" [%s, duplicate of %s]", e.Action, e.DuplicateOf)
+			}
+			fmt.Fprintf(w, "  %s %s%s\n", e.Hash, e.Path, note)
+		}
+	}
+}
+
+// dHashFile computes the 64-bit difference hash of an image file
+func dHashFile(path string) (uint64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	img, _, err := image.Decode(file)
+	if err != nil {
+		return 0, err
+	}
+	return dHash(img), nil
+}
+
+// dHash shrinks the image to 9x8 grayscale and compares horizontally adjacent pixels
+func dHash(img image.Image) uint64 {
+	const w, h = 9, 8
+	var gray [h][w]float64
+
+	bounds := img.Bounds()
+	for y := range h {
+		y0 := bounds.Min.Y + y*bounds.Dy()/h
+		y1 := max(bounds.Min.Y+(y+1)*bounds.Dy()/h, y0+1)
+		for x := range w {
+			x0 := bounds.Min.X + x*bounds.Dx()/w
+			x1 := max(bounds.Min.X+(x+1)*bounds.Dx()/w, x0+1)
+			gray[y][x] = averageLuma(img, x0, y0, x1, y1)
+		}
+	}
+
+	var hash uint64
+	for y := range h {
+		for x := range w - 1 {
+			hash <<= 1
+			if gray[y][x] < gray[y][x+1] {
+				hash |= 1
+			}
+		}
+	}
+	return hash
+}
+
+// averageLuma returns the mean luma of a rectangle, sampling at most 16x16 pixels
+func averageLuma(img image.Image, x0, y0, x1, y1 int) float64 {
+	stepX := max((x1-x0)/16, 1)
+	stepY := max((y1-y0)/16, 1)
+	var sum float64
+	var n int
+	for y := y0; y < y1; y += stepY {
+		for x := x0; x < x1; x += stepX {
+			r, g, b, _ := img.At(x, y).RGBA()
+			sum += 0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)
+			n++
+		}
+	}
+	if n == 0 {
+		return 0
+	}
+	return sum / float64(n)
+}
+
+// replaceWithLink replaces path with a hard link to original, falling back to a symlink across filesystems
+func replaceWithLink(original, path string) error {
+	tmp := path + ".link"
+	if err := os.Link(original, tmp); err != nil {
+		abs, aerr := filepath.Abs(original)
+		if aerr != nil {
+			return err
+		}
+		if err := os.Symlink(abs, tmp); err != nil {
+			return err
+		}
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
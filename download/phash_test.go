@@ -0,0 +1,233 @@
+package download
+
+import (
+	"image"
+	"image/color"
+	"image/png"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/alekxeyuk/makaba-downloader/store"
+)
+
+// gradientImage draws a diagonal pattern that survives resizing
+func gradientImage(w, h int, invert bool) image.Image {
+	img := image.NewGray(image.Rect(0, 0, w, h))
+	for y := range h {
+		for x := range w {
+			v := uint8((x*255/w + y*128/h) % 256)
+			if x*4/w%2 == 1 {
+				v = 255 - v
+			}
+			if invert {
+				v = 255 - v
+			}
+			img.SetGray(x, y, color.Gray{Y: v})
+		}
+	}
+	return img
+}
+
+func TestDHashNearDuplicates(t *testing.T) {
+	original := dHash(gradientImage(640, 480, false))
+	resized := dHash(gradientImage(320, 240, false))
+	different := dHash(gradientImage(640, 480, true))
+
+	if d := bits.OnesCount64(original ^ resized); d > 6 {
+		t.Errorf("resized copy has distance %d", d)
+	}
+	if d := bits.OnesCount64(original ^ different); d <= 6 {
+		t.Errorf("different image has distance %d", d)
+	}
+}
+
+// writePNG encodes img to a file in dir and returns its path
+func writePNG(t *testing.T, dir, name string, img image.Image) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if err := png.Encode(file, img); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// processImages feeds an original, its resized copy and a different image to a new store,
+// as freshly downloaded temp files of a disk storage in dir
+func processImages(t *testing.T, dir, action string) (*PHashStore, []string, []bool) {
+	t.Helper()
+	storage := store.NewDisk(dir)
+	phashes := LoadPHashes(filepath.Join(dir, "phash.json"), PHashConfig{Enabled: true, Action: action})
+	images := []struct {
+		name string
+		img  image.Image
+	}{
+		{"b/1/original.png", gradientImage(640, 480, false)},
+		{"b/1/resized.png", gradientImage(320, 240, false)},
+		{"b/1/different.png", gradientImage(640, 480, true)},
+	}
+	var indexPaths []string
+	var kept []bool
+	for _, im := range images {
+		temp := writePNG(t, dir, im.name+".tmp", im.img)
+		indexPath, keep := phashes.Process(storage, temp, im.name, "md5-"+filepath.Base(im.name))
+		if keep {
+			if err := storage.Commit(temp, im.name); err != nil {
+				t.Fatal(err)
+			}
+		}
+		indexPaths = append(indexPaths, indexPath)
+		kept = append(kept, keep)
+	}
+	return phashes, indexPaths, kept
+}
+
+func TestPHashProcessFlag(t *testing.T) {
+	dir := t.TempDir()
+	phashes, indexPaths, kept := processImages(t, dir, "")
+	if !slices.Equal(kept, []bool{true, true, true}) {
+		t.Errorf("kept = %v, want every file", kept)
+	}
+	if indexPaths[1] != "b/1/resized.png" {
+		t.Errorf("flagged duplicate indexed as %s", indexPaths[1])
+	}
+	if e := phashes.entries[1]; e.DuplicateOf != "b/1/original.png" || e.Action != PHashActionFlag {
+		t.Errorf("resized entry = %+v, want a flagged duplicate of the original", e)
+	}
+	if e := phashes.entries[2]; e.DuplicateOf != "" {
+		t.Errorf("different image is a duplicate of %s", e.DuplicateOf)
+	}
+}
+
+func TestPHashProcessDelete(t *testing.T) {
+	for _, action := range []string{PHashActionDelete, PHashActionSkip} {
+		dir := t.TempDir()
+		_, indexPaths, kept := processImages(t, dir, action)
+		if !slices.Equal(kept, []bool{true, false, true}) {
+			t.Errorf("%s: kept = %v, want all but the resized copy", action, kept)
+		}
+		// The index points at the original so the copy isn't downloaded again
+		if indexPaths[1] != "b/1/original.png" {
+			t.Errorf("%s: deleted duplicate indexed as %s", action, indexPaths[1])
+		}
+		for _, name := range []string{"resized.png", "resized.png.tmp"} {
+			if _, err := os.Stat(filepath.Join(dir, "b", "1", name)); !os.IsNotExist(err) {
+				t.Errorf("%s: %s kept: %v", action, name, err)
+			}
+		}
+	}
+}
+
+func TestPHashProcessLink(t *testing.T) {
+	dir := t.TempDir()
+	_, _, kept := processImages(t, dir, PHashActionLink)
+	if !slices.Equal(kept, []bool{true, true, true}) {
+		t.Errorf("kept = %v, want every file", kept)
+	}
+	original, err := os.Stat(filepath.Join(dir, "b", "1", "original.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	linked, err := os.Stat(filepath.Join(dir, "b", "1", "resized.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(original, linked) {
+		t.Error("resized copy is not a link to the original")
+	}
+}
+
+func TestPHashProcessSkipsOtherFormats(t *testing.T) {
+	dir := t.TempDir()
+	phashes := LoadPHashes(filepath.Join(dir, "phash.json"), PHashConfig{Enabled: true})
+	temp := writePNG(t, dir, "b/1/image.bmp.tmp", gradientImage(64, 64, false))
+	if path, keep := phashes.Process(store.NewDisk(dir), temp, "b/1/image.bmp", ""); path != "b/1/image.bmp" || !keep {
+		t.Errorf("Process = %s, %v, want the file kept as is", path, keep)
+	}
+	if len(phashes.entries) != 0 {
+		t.Errorf("bmp was hashed: %+v", phashes.entries)
+	}
+}
+
+func TestPHashProcessWebP(t *testing.T) {
+	dir := t.TempDir()
+	phashes := LoadPHashes(filepath.Join(dir, "phash.json"), PHashConfig{Enabled: true})
+	phashes.Process(store.NewDisk(dir), filepath.Join("testdata", "blue-purple-pink.webp"), "b/1/image.webp", "")
+	if len(phashes.entries) != 1 || phashes.entries[0].hash == 0 {
+		t.Errorf("entries = %+v, want the webp hashed", phashes.entries)
+	}
+}
+
+func TestPHashProcessOriginalGone(t *testing.T) {
+	dir := t.TempDir()
+	storage := store.NewDisk(dir)
+	phashes := LoadPHashes(filepath.Join(dir, "phash.json"), PHashConfig{Enabled: true, Action: PHashActionDelete})
+	temp := writePNG(t, dir, "b/1/original.png", gradientImage(640, 480, false))
+	phashes.Process(storage, temp, "b/1/original.png", "")
+	temp = writePNG(t, dir, "b/1/resized.png.tmp", gradientImage(320, 240, false))
+	phashes.Process(storage, temp, "b/1/resized.png", "")
+
+	// Retention deleted the thread, a copy downloaded later takes the place of the original
+	if err := storage.RemoveAll("b/1"); err != nil {
+		t.Fatal(err)
+	}
+	temp = writePNG(t, dir, "b/2/copy.png.tmp", gradientImage(320, 240, false))
+	if path, keep := phashes.Process(storage, temp, "b/2/copy.png", ""); path != "b/2/copy.png" || !keep {
+		t.Errorf("Process = %s, %v, want the copy kept since the original is gone", path, keep)
+	}
+	if len(phashes.entries) != 1 || phashes.entries[0].Path != "b/2/copy.png" {
+		t.Errorf("entries = %+v, want only the copy", phashes.entries)
+	}
+}
+
+func TestPHashClustersAndReport(t *testing.T) {
+	dir := t.TempDir()
+	phashes, _, _ := processImages(t, dir, "")
+
+	clusters := phashes.Clusters()
+	if len(clusters) != 1 || len(clusters[0]) != 2 {
+		t.Fatalf("Clusters = %v, want the original with its resized copy", clusters)
+	}
+	var report strings.Builder
+	phashes.WriteReport(&report)
+	if !strings.Contains(report.String(), "b/1/resized.png [flag, duplicate of b/1/original.png]") || strings.Contains(report.String(), "different") {
+		t.Errorf("report:\n%s", report.String())
+	}
+}
+
+func TestPHashSaveLoad(t *testing.T) {
+	dir := t.TempDir()
+	phashes, _, _ := processImages(t, dir, "")
+	phashes.Save()
+
+	loaded := LoadPHashes(filepath.Join(dir, "phash.json"), PHashConfig{Enabled: true})
+	if len(loaded.entries) != 3 {
+		t.Fatalf("loaded %d entries, want 3", len(loaded.entries))
+	}
+	for i, e := range loaded.entries {
+		if e.hash != phashes.entries[i].hash || e.Path != phashes.entries[i].Path || e.DuplicateOf != phashes.entries[i].DuplicateOf {
+			t.Errorf("entry %d = %+v, want %+v", i, e, phashes.entries[i])
+		}
+	}
+	if clusters := loaded.Clusters(); len(clusters) != 1 {
+		t.Errorf("loaded store has %d clusters, want 1", len(clusters))
+	}
+
+	// A new copy is matched against the loaded hashes
+	temp := writePNG(t, dir, "b/2/copy.png.tmp", gradientImage(480, 360, false))
+	loaded.Process(store.NewDisk(dir), temp, "b/2/copy.png", "")
+	if e := loaded.entries[3]; e.DuplicateOf != "b/1/original.png" {
+		t.Errorf("copy after load = %+v, want a duplicate of the original", e)
+	}
+}
@@ -0,0 +1,296 @@
+package download
+
+import (
+	"container/heap"
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/alekxeyuk/makaba-downloader/store"
+)
+
+// Job describes a single file download
+type Job struct {
+	URL  string `json:"url"`
+	Path string `json:"path"`
+	Root string `json:"root,omitempty"` // board directory holding the md5 index
+	MD5  string `json:"md5,omitempty"`
+	// Thumbnail jobs download the preview of the file with the given md5
+	Thumbnail bool   `json:"thumbnail,omitempty"`
+	Size      int64  `json:"size,omitempty"` // expected size in bytes, 0 if unknown
+	Board     string `json:"board,omitempty"`
+	Thread    int64  `json:"thread,omitempty"` // thread number, newer threads have bigger numbers
+	Manual    bool   `json:"manual,omitempty"` // requested by the user, goes before everything else
+	Resumed   bool   `json:"-"`                // left over from a previous run, goes right after manual jobs
+
+	// Next is queued once this job is done, e.g. the full media after its thumbnail
+	Next *Job `json:"next,omitempty"`
+
+	Meta        *store.FileMeta       `json:"meta,omitempty"`
+	MetaOptions store.MetadataOptions `json:"meta_options,omitzero"`
+}
+
+// Key identifies identical jobs for deduplication
+func (j Job) Key() string {
+	return j.URL + "\x00" + j.Path
+}
+
+// indexKey is the key of the job in the md5 index of its board directory
+func (j Job) indexKey() string {
+	if j.Thumbnail {
+		return store.ThumbnailKey(j.MD5)
+	}
+	return j.MD5
+}
+
+// JobState tells whether a job waits in the queue or is being downloaded
+type JobState int
+
+const (
+	JobPending JobState = iota
+	JobActive
+)
+
+func (s JobState) String() string {
+	switch s {
+	case JobPending:
+		return "pending"
+	case JobActive:
+		return "active"
+	default:
+		return "unknown"
+	}
+}
+
+// JobStatus is a snapshot of a queued job used for inspection
+type JobStatus struct {
+	Job
+	State    JobState
+	Queued   time.Time
+	Started  time.Time
+	Priority int
+}
+
+type queuedJob struct {
+	job     Job
+	seq     uint64
+	index   int // position in the heap, -1 once popped
+	state   JobState
+	queued  time.Time
+	started time.Time
+	cancel  context.CancelFunc
+}
+
+// less orders jobs: manual first, then resumed, then newest thread, then smallest file, then FIFO
+func (a *queuedJob) less(b *queuedJob) bool {
+	if a.job.Manual != b.job.Manual {
+		return a.job.Manual
+	}
+	if a.job.Resumed != b.job.Resumed {
+		return a.job.Resumed
+	}
+	if a.job.Thread != b.job.Thread {
+		return a.job.Thread > b.job.Thread
+	}
+	if a.job.Size != b.job.Size {
+		return a.job.Size < b.job.Size
+	}
+	return a.seq < b.seq
+}
+
+type jobHeap []*queuedJob
+
+func (h jobHeap) Len() int           { return len(h) }
+func (h jobHeap) Less(i, j int) bool { return h[i].less(h[j]) }
+func (h jobHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *jobHeap) Push(x any) {
+	item := x.(*queuedJob)
+	item.index = len(*h)
+	*h = append(*h, item)
+}
+
+func (h *jobHeap) Pop() any {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = nil
+	item.index = -1
+	*h = old[:n-1]
+	return item
+}
+
+// DownloadQueue is a priority queue of download jobs shared by the worker pool
+type DownloadQueue struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	heap   jobHeap
+	jobs   map[string]*queuedJob // pending and active jobs by key
+	seq    uint64
+	closed bool
+	wg     sync.WaitGroup // tracks pending and active jobs
+}
+
+// NewDownloadQueue creates an empty queue
+func NewDownloadQueue() *DownloadQueue {
+	q := &DownloadQueue{jobs: make(map[string]*queuedJob)}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+// Push adds a job to the queue, returns false if an identical job is already queued or running
+func (q *DownloadQueue) Push(job Job) bool {
+	return q.push(job, nil)
+}
+
+// push adds a job like Push, accepted is called with the queue locked before any worker can take the job
+func (q *DownloadQueue) push(job Job, accepted func(Job)) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return false
+	}
+	key := job.Key()
+	if _, ok := q.jobs[key]; ok {
+		return false
+	}
+
+	if accepted != nil {
+		accepted(job)
+	}
+	q.seq++
+	item := &queuedJob{job: job, seq: q.seq, queued: time.Now()}
+	q.jobs[key] = item
+	heap.Push(&q.heap, item)
+	q.wg.Add(1)
+	q.cond.Signal()
+	return true
+}
+
+// pop blocks until a job is available, returns nil once the queue is closed
+func (q *DownloadQueue) pop(parent context.Context) (*queuedJob, context.Context) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for len(q.heap) == 0 && !q.closed {
+		q.cond.Wait()
+	}
+	if q.closed {
+		return nil, nil
+	}
+
+	item := heap.Pop(&q.heap).(*queuedJob)
+	ctx, cancel := context.WithCancel(parent)
+	item.state = JobActive
+	item.started = time.Now()
+	item.cancel = cancel
+	return item, ctx
+}
+
+// done removes a finished job from the queue
+func (q *DownloadQueue) done(item *queuedJob) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if item.cancel != nil {
+		item.cancel()
+	}
+	delete(q.jobs, item.job.Key())
+	q.wg.Done()
+}
+
+// Cancel removes a pending job or aborts a running one
+func (q *DownloadQueue) Cancel(key string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	item, ok := q.jobs[key]
+	if !ok {
+		return false
+	}
+	if item.state == JobActive {
+		item.cancel()
+		return true
+	}
+	heap.Remove(&q.heap, item.index)
+	delete(q.jobs, key)
+	q.wg.Done()
+	return true
+}
+
+// Snapshot returns the active jobs in the order they started, then the pending jobs in priority order
+func (q *DownloadQueue) Snapshot() []JobStatus {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var active []*queuedJob
+	for _, item := range q.jobs {
+		if item.state == JobActive {
+			active = append(active, item)
+		}
+	}
+	sort.Slice(active, func(i, j int) bool {
+		if !active[i].started.Equal(active[j].started) {
+			return active[i].started.Before(active[j].started)
+		}
+		return active[i].seq < active[j].seq
+	})
+	statuses := make([]JobStatus, 0, len(q.jobs))
+	for _, item := range active {
+		statuses = append(statuses, item.status(0))
+	}
+
+	// Sort a copy so heap indexes of the real queue stay intact
+	pending := make([]*queuedJob, len(q.heap))
+	copy(pending, q.heap)
+	sort.Slice(pending, func(i, j int) bool { return pending[i].less(pending[j]) })
+	for i, item := range pending {
+		statuses = append(statuses, item.status(i+1))
+	}
+	return statuses
+}
+
+// Len returns the number of pending and active jobs
+func (q *DownloadQueue) Len() (pending, active int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.heap), len(q.jobs) - len(q.heap)
+}
+
+// Close drops all pending jobs and wakes up waiting workers
+func (q *DownloadQueue) Close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return
+	}
+	q.closed = true
+	for _, item := range q.heap {
+		delete(q.jobs, item.job.Key())
+		q.wg.Done()
+	}
+	q.heap = nil
+	q.cond.Broadcast()
+}
+
+// Wait blocks until there are no pending or active jobs
+func (q *DownloadQueue) Wait() {
+	q.wg.Wait()
+}
+
+func (item *queuedJob) status(priority int) JobStatus {
+	return JobStatus{
+		Job:      item.job,
+		State:    item.state,
+		Queued:   item.queued,
+		Started:  item.started,
+		Priority: priority,
+	}
+}
@@ -0,0 +1,226 @@
+package download
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestDownloadQueueOrder(t *testing.T) {
+	tests := []struct {
+		name string
+		jobs []Job
+		want []string // URLs in pop order
+	}{
+		{
+			name: "manual first",
+			jobs: []Job{{URL: "a", Thread: 9}, {URL: "b", Manual: true}, {URL: "c", Resumed: true}},
+			want: []string{"b", "c", "a"},
+		},
+		{
+			name: "newest thread first",
+			jobs: []Job{{URL: "a", Thread: 1}, {URL: "b", Thread: 3}, {URL: "c", Thread: 2}},
+			want: []string{"b", "c", "a"},
+		},
+		{
+			name: "smallest file first",
+			jobs: []Job{{URL: "a", Thread: 1, Size: 30}, {URL: "b", Thread: 1, Size: 10}, {URL: "c", Thread: 1, Size: 20}},
+			want: []string{"b", "c", "a"},
+		},
+		{
+			name: "fifo otherwise",
+			jobs: []Job{{URL: "a"}, {URL: "b"}, {URL: "c"}},
+			want: []string{"a", "b", "c"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := NewDownloadQueue()
+			for _, job := range tt.jobs {
+				if !q.Push(job) {
+					t.Fatalf("Push(%s) = false", job.URL)
+				}
+			}
+
+			var snapshot []string
+			for _, s := range q.Snapshot() {
+				snapshot = append(snapshot, s.URL)
+			}
+			if !slices.Equal(snapshot, tt.want) {
+				t.Errorf("Snapshot = %v, want %v", snapshot, tt.want)
+			}
+
+			var got []string
+			for range tt.jobs {
+				item, _ := q.pop(context.Background())
+				got = append(got, item.job.URL)
+				q.done(item)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("pop order = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDownloadQueueDedup(t *testing.T) {
+	q := NewDownloadQueue()
+	job := Job{URL: "a", Path: "x"}
+	if !q.Push(job) {
+		t.Fatal("first Push = false")
+	}
+	if q.Push(job) {
+		t.Error("Push of a pending duplicate = true")
+	}
+	if !q.Push(Job{URL: "a", Path: "y"}) {
+		t.Error("Push of the same URL to another path = false")
+	}
+
+	item, _ := q.pop(context.Background())
+	if q.Push(item.job) {
+		t.Error("Push of an active duplicate = true")
+	}
+	q.done(item)
+	if !q.Push(item.job) {
+		t.Error("Push after the job finished = false")
+	}
+}
+
+func TestDownloadQueueCancel(t *testing.T) {
+	q := NewDownloadQueue()
+	a, b := Job{URL: "a"}, Job{URL: "b"}
+	q.Push(a)
+	q.Push(b)
+
+	item, ctx := q.pop(context.Background())
+	if item.job.URL != "a" {
+		t.Fatalf("popped %s, want a", item.job.URL)
+	}
+
+	if !q.Cancel(b.Key()) {
+		t.Error("Cancel of a pending job = false")
+	}
+	if pending, active := q.Len(); pending != 0 || active != 1 {
+		t.Errorf("Len = %d, %d, want 0, 1", pending, active)
+	}
+
+	if !q.Cancel(a.Key()) {
+		t.Error("Cancel of an active job = false")
+	}
+	if ctx.Err() == nil {
+		t.Error("context of the cancelled active job is not done")
+	}
+	q.done(item)
+
+	if q.Cancel(a.Key()) {
+		t.Error("Cancel of a finished job = true")
+	}
+	waitOrFail(t, q)
+}
+
+func TestDownloadQueueSnapshotStates(t *testing.T) {
+	q := NewDownloadQueue()
+	q.Push(Job{URL: "a", Thread: 2})
+	q.Push(Job{URL: "b", Thread: 1})
+	item, _ := q.pop(context.Background())
+	defer q.done(item)
+
+	got := q.Snapshot()
+	if len(got) != 2 {
+		t.Fatalf("Snapshot has %d jobs, want 2", len(got))
+	}
+	if got[0].URL != "a" || got[0].State != JobActive || got[0].Started.IsZero() {
+		t.Errorf("first = %s %v, want active a", got[0].URL, got[0].State)
+	}
+	if got[1].URL != "b" || got[1].State != JobPending || got[1].Priority != 1 {
+		t.Errorf("second = %s %v priority %d, want pending b priority 1", got[1].URL, got[1].State, got[1].Priority)
+	}
+}
+
+func TestDownloadQueueSnapshotActiveOrder(t *testing.T) {
+	q := NewDownloadQueue()
+	for _, url := range []string{"a", "b", "c", "d"} {
+		q.Push(Job{URL: url})
+	}
+	for range 4 {
+		item, _ := q.pop(context.Background())
+		defer q.done(item)
+	}
+	for range 10 {
+		var got []string
+		for _, s := range q.Snapshot() {
+			got = append(got, s.URL)
+		}
+		if !slices.Equal(got, []string{"a", "b", "c", "d"}) {
+			t.Fatalf("active jobs = %v, want them in the order they started", got)
+		}
+	}
+}
+
+func TestDownloadQueueClose(t *testing.T) {
+	q := NewDownloadQueue()
+	q.Push(Job{URL: "a"})
+	q.Push(Job{URL: "b"})
+	item, _ := q.pop(context.Background())
+
+	popped := make(chan *queuedJob)
+	go func() {
+		item, _ := q.pop(context.Background())
+		popped <- item
+	}()
+
+	q.Close()
+	if q.Push(Job{URL: "c"}) {
+		t.Error("Push after Close = true")
+	}
+	select {
+	case got := <-popped:
+		if got != nil {
+			t.Errorf("pop after Close = %s, want nil", got.job.URL)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("pop did not return after Close")
+	}
+	if pending, active := q.Len(); pending != 0 || active != 1 {
+		t.Errorf("Len = %d, %d, want 0, 1", pending, active)
+	}
+
+	// The active job still has to finish
+	q.done(item)
+	waitOrFail(t, q)
+}
+
+func TestDownloadQueueWait(t *testing.T) {
+	q := NewDownloadQueue()
+	q.Push(Job{URL: "a"})
+	item, _ := q.pop(context.Background())
+
+	waited := make(chan struct{})
+	go func() {
+		q.Wait()
+		close(waited)
+	}()
+	select {
+	case <-waited:
+		t.Fatal("Wait returned with an active job")
+	case <-time.After(50 * time.Millisecond):
+	}
+	q.done(item)
+	waitOrFail(t, q)
+}
+
+// waitOrFail fails the test if the queue doesn't drain within a second
+func waitOrFail(t *testing.T, q *DownloadQueue) {
+	t.Helper()
+	waited := make(chan struct{})
+	go func() {
+		q.Wait()
+		close(waited)
+	}()
+	select {
+	case <-waited:
+	case <-time.After(time.Second):
+		t.Fatal("Wait did not return")
+	}
+}
@@ -0,0 +1,149 @@
+package dvach
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// usercodeCookie holds the session of a passcode
+const usercodeCookie = "usercode_auth"
+
+// ErrLoginFailed is returned when the passcode is refused
+var ErrLoginFailed = errors.New("passcode login failed")
+
+// ErrAuthExpired is returned once when the server drops usercode_auth and there is no passcode to log in again with
+var ErrAuthExpired = errors.New("usercode_auth expired")
+
+// WithPasscode logs in with a passcode whenever usercode_auth is missing, rejected or expired
+func WithPasscode(passcode string) Option {
+	return func(c *Client) {
+		c.passcode = passcode
+	}
+}
+
+// Usercode returns the current usercode_auth cookie, empty if there is none
+func (c *Client) Usercode() string {
+	u, err := url.Parse(c.baseURL)
+	if err != nil {
+		return ""
+	}
+	for _, cookie := range c.http.Jar.Cookies(u) {
+		if cookie.Name == usercodeCookie {
+			return cookie.Value
+		}
+	}
+	return ""
+}
+
+// loginResponse is the answer of /user/passlogin
+type loginResponse struct {
+	Result      int    `json:"result"`
+	Description string `json:"description"`
+	Hash        string `json:"hash"`
+}
+
+// Login exchanges the passcode for a usercode_auth cookie
+func (c *Client) Login() error {
+	c.authMu.Lock()
+	defer c.authMu.Unlock()
+	return c.login()
+}
+
+// login does the work of Login with authMu held, a refused passcode isn't tried again
+func (c *Client) login() error {
+	if c.passcode == "" {
+		return fmt.Errorf("%w: no passcode", ErrLoginFailed)
+	}
+	if c.refused != nil {
+		return c.refused
+	}
+	err := c.postLogin()
+	if errors.Is(err, ErrLoginFailed) {
+		c.refused = err
+	}
+	return err
+}
+
+// postLogin sends the passcode
+func (c *Client) postLogin() error {
+	resp, err := c.http.PostForm(c.baseURL+"/user/passlogin?json=1", url.Values{"passcode": {c.passcode}})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		serr := &StatusError{Path: "user/passlogin", Code: resp.StatusCode}
+		if IsAuthError(serr) {
+			return fmt.Errorf("%w: %w", ErrLoginFailed, serr)
+		}
+		return serr
+	}
+
+	var result loginResponse
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return fmt.Errorf("%w: %s", ErrLoginFailed, strings.TrimSpace(string(body)))
+	}
+	if result.Result != 1 {
+		return fmt.Errorf("%w: %s", ErrLoginFailed, result.Description)
+	}
+	// The cookie normally comes with the response, older mirrors only send the hash
+	if c.Usercode() == "" && result.Hash != "" {
+		u, _ := url.Parse(c.baseURL)
+		c.http.Jar.SetCookies(u, []*http.Cookie{{Name: usercodeCookie, Value: result.Hash}})
+	}
+	if c.Usercode() == "" {
+		return fmt.Errorf("%w: no %s in the response", ErrLoginFailed, usercodeCookie)
+	}
+	c.authed = true
+	c.authGen++
+	return nil
+}
+
+// authState returns whether the client is logged in and the login generation
+func (c *Client) authState() (bool, int) {
+	c.authMu.Lock()
+	defer c.authMu.Unlock()
+	return c.authed, c.authGen
+}
+
+// reauth logs in again unless another request already did since gen
+func (c *Client) reauth(gen int) error {
+	c.authMu.Lock()
+	defer c.authMu.Unlock()
+	if c.authGen != gen && c.Usercode() != "" {
+		return nil
+	}
+	return c.login()
+}
+
+// expired tells whether the server dropped usercode_auth, without a passcode this is reported once
+func (c *Client) expired() bool {
+	c.authMu.Lock()
+	defer c.authMu.Unlock()
+	if !c.authed || c.Usercode() != "" {
+		return false
+	}
+	if c.passcode == "" {
+		c.authed = false
+	}
+	return true
+}
+
+// CheckAuth validates usercode_auth or the passcode with a request for the catalog of board,
+// logging in first if there is a passcode but no usercode_auth yet
+func (c *Client) CheckAuth(board string) error {
+	if authed, _ := c.authState(); !authed && c.passcode == "" {
+		return fmt.Errorf("%w: neither usercode_auth nor a passcode is set", ErrLoginFailed)
+	}
+	_, err := c.GetJSON(board + "/catalog.json")
+	return err
+}
@@ -0,0 +1,121 @@
+package dvach
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// authServer fakes passcode login: /b/ is public but drops stale sessions, /hidden/ needs a valid one
+type authServer struct {
+	*httptest.Server
+
+	mu      sync.Mutex
+	session string
+	logins  int
+}
+
+func newAuthServer(t *testing.T) *authServer {
+	s := &authServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// expire invalidates the current session
+func (s *authServer) expire() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.session = ""
+}
+
+func (s *authServer) loginCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.logins
+}
+
+func (s *authServer) serve(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if r.URL.Path == "/user/passlogin" {
+		if r.PostFormValue("passcode") != "good" {
+			fmt.Fprint(w, `{"result": 0, "description": "wrong passcode"}`)
+			return
+		}
+		s.logins++
+		s.session = fmt.Sprintf("session-%d", s.logins)
+		http.SetCookie(w, &http.Cookie{Name: "usercode_auth", Value: s.session, Path: "/"})
+		fmt.Fprint(w, `{"result": 1}`)
+		return
+	}
+
+	cookie, err := r.Cookie("usercode_auth")
+	valid := err == nil && cookie.Value == s.session && s.session != ""
+	if err == nil && !valid {
+		http.SetCookie(w, &http.Cookie{Name: "usercode_auth", Path: "/", MaxAge: -1})
+	}
+	if r.URL.Path == "/hidden/catalog.json" && !valid {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	fmt.Fprint(w, `{"board": {"id": "b"}, "threads": []}`)
+}
+
+func TestPasscodeLogin(t *testing.T) {
+	srv := newAuthServer(t)
+	client := NewClient(WithBaseURL(srv.URL), WithPasscode("good"))
+
+	if err := client.CheckAuth("hidden"); err != nil {
+		t.Fatal(err)
+	}
+	if client.Usercode() != "session-1" || srv.loginCount() != 1 {
+		t.Errorf("usercode %q after %d logins", client.Usercode(), srv.loginCount())
+	}
+
+	// A rejected session is renewed and the request repeated
+	srv.expire()
+	if _, err := client.Catalog("hidden"); err != nil {
+		t.Fatal(err)
+	}
+	// So is one the server drops on a public board
+	srv.expire()
+	if _, err := client.Catalog("b"); err != nil {
+		t.Fatal(err)
+	}
+	if client.Usercode() != "session-3" || srv.loginCount() != 3 {
+		t.Errorf("usercode %q after %d logins", client.Usercode(), srv.loginCount())
+	}
+}
+
+func TestPasscodeRefused(t *testing.T) {
+	srv := newAuthServer(t)
+	client := NewClient(WithBaseURL(srv.URL), WithPasscode("bad"))
+
+	for range 2 {
+		_, err := client.Catalog("b")
+		if !errors.Is(err, ErrLoginFailed) || !IsAuthError(err) {
+			t.Errorf("got %v, want a failed login", err)
+		}
+	}
+}
+
+func TestUsercodeExpired(t *testing.T) {
+	srv := newAuthServer(t)
+	client := NewClient(WithBaseURL(srv.URL), WithUsercode("stale"))
+
+	if err := client.CheckAuth("b"); !errors.Is(err, ErrAuthExpired) {
+		t.Fatalf("got %v, want an expired usercode", err)
+	}
+	// Reported once, then the client carries on without it
+	if _, err := client.Catalog("b"); err != nil {
+		t.Errorf("public board after expiry: %v", err)
+	}
+	if _, err := client.Catalog("hidden"); !IsAuthError(err) {
+		t.Errorf("hidden board after expiry: %v", err)
+	}
+}
@@ -0,0 +1,206 @@
+// Package cassette records API traffic to a directory and replays it offline.
+//
+// Every request path, without the query, gets one JSON file in the cassette directory
+// named after the path, with ".json" appended unless the path already ends in it:
+//
+//	b/catalog.json         {"status": 200, "header": {...}, "body": {...the catalog...}}
+//	b/res/100.json         {"status": 404, "text": "Not Found"}
+//	b/src/100/1.webm.json  {"status": 200, "header": {"Content-Length": "5000"}}
+//
+// Bodies are stored decompressed, JSON ones as JSON so they can be edited by hand.
+// Media bodies are never stored, replay fills them with zeros of the recorded length.
+// A path requested several times keeps the last response.
+package cassette
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Entry is a recorded response
+type Entry struct {
+	Status int               `json:"status"`
+	Header map[string]string `json:"header,omitempty"`
+	Body   json.RawMessage   `json:"body,omitempty"` // JSON bodies
+	Text   string            `json:"text,omitempty"` // other bodies, e.g. error pages
+}
+
+// recordedHeaders are kept in entries, the rest is noise or recomputed on replay
+var recordedHeaders = []string{"Content-Type", "Content-Length", "Content-Range", "Accept-Ranges", "Retry-After", "Last-Modified", "Etag"}
+
+// isAPI tells API requests, whose bodies are recorded, from media
+func isAPI(urlPath string) bool {
+	return strings.HasSuffix(urlPath, ".json")
+}
+
+// entryPath returns the file holding the entry of a request
+func entryPath(dir string, req *http.Request) string {
+	name := strings.TrimPrefix(path.Clean("/"+req.URL.Path), "/")
+	if !strings.HasSuffix(name, ".json") {
+		name += ".json"
+	}
+	return filepath.Join(dir, filepath.FromSlash(name))
+}
+
+// Recorder is an http.RoundTripper saving API responses, and optionally media headers, to a cassette
+type Recorder struct {
+	dir       string
+	media     bool
+	transport http.RoundTripper
+}
+
+// NewRecorder records to dir, media also records status and headers of media requests.
+// A nil transport means http.DefaultTransport.
+func NewRecorder(dir string, media bool, transport http.RoundTripper) *Recorder {
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	return &Recorder{dir: dir, media: media, transport: transport}
+}
+
+func (r *Recorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := r.transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	entry := Entry{Status: resp.StatusCode, Header: make(map[string]string)}
+	for _, k := range recordedHeaders {
+		if v := resp.Header.Get(k); v != "" {
+			entry.Header[k] = v
+		}
+	}
+
+	if !isAPI(req.URL.Path) {
+		if r.media {
+			if err := r.save(req, entry); err != nil {
+				resp.Body.Close()
+				return nil, err
+			}
+		}
+		return resp, nil
+	}
+
+	raw, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	// The caller gets the response as it came, the cassette the decoded body
+	resp.Body = io.NopCloser(bytes.NewReader(raw))
+
+	body := raw
+	if resp.Header.Get("Content-Encoding") == "gzip" {
+		zr, err := gzip.NewReader(bytes.NewReader(raw))
+		if err == nil {
+			body, err = io.ReadAll(zr)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("cassette: decoding %s: %w", req.URL.Path, err)
+		}
+	}
+	delete(entry.Header, "Content-Length")
+	var indented bytes.Buffer
+	if json.Indent(&indented, body, "", "  ") == nil {
+		entry.Body = indented.Bytes()
+	} else {
+		entry.Text = string(body)
+	}
+
+	if err := r.save(req, entry); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// save writes an entry, replacing an earlier one atomically
+func (r *Recorder) save(req *http.Request, entry Entry) error {
+	data, err := json.MarshalIndent(entry, "", "  ")
+	if err != nil {
+		return err
+	}
+	name := entryPath(r.dir, req)
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return fmt.Errorf("cassette: %w", err)
+	}
+	tmp := name + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("cassette: %w", err)
+	}
+	return os.Rename(tmp, name)
+}
+
+// Replayer is an http.RoundTripper answering requests from a cassette without touching the network
+type Replayer struct {
+	dir string
+}
+
+// NewReplayer replays the cassette in dir
+func NewReplayer(dir string) *Replayer {
+	return &Replayer{dir: dir}
+}
+
+// ErrNotRecorded is returned for requests missing from the cassette
+var ErrNotRecorded = errors.New("not recorded")
+
+func (p *Replayer) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+	name := entryPath(p.dir, req)
+	data, err := os.ReadFile(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("cassette: %s %s: %w", req.Method, req.URL.Path, ErrNotRecorded)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cassette: %w", err)
+	}
+	var entry Entry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return nil, fmt.Errorf("cassette: %s: %w", name, err)
+	}
+	if entry.Status == 0 {
+		entry.Status = http.StatusOK
+	}
+
+	resp := &http.Response{
+		Status:     strconv.Itoa(entry.Status) + " " + http.StatusText(entry.Status),
+		StatusCode: entry.Status,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+		Request:    req,
+	}
+	for k, v := range entry.Header {
+		resp.Header.Set(k, v)
+	}
+
+	var body []byte
+	switch {
+	case entry.Body != nil:
+		body = entry.Body
+	case entry.Text != "":
+		body = []byte(entry.Text)
+	case !isAPI(req.URL.Path):
+		// Media bodies aren't recorded, stand in with zeros of the recorded length
+		if n, err := strconv.ParseInt(entry.Header["Content-Length"], 10, 64); err == nil && n > 0 {
+			body = make([]byte, n)
+		}
+	}
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	resp.ContentLength = int64(len(body))
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	return resp, nil
+}
@@ -0,0 +1,133 @@
+package cassette
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/alekxeyuk/makaba-downloader/dvach"
+	"github.com/alekxeyuk/makaba-downloader/dvach/dvachtest"
+)
+
+func writeFixtures(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestRecordReplay(t *testing.T) {
+	srv := dvachtest.NewServer(writeFixtures(t, map[string]string{
+		"b/catalog.json":   `{"board": {"id": "b"}, "threads": [{"num": 100, "op": 1, "subject": "webm", "files_count": 1}]}`,
+		"b/res/100.json":   `{"board": {"id": "b"}, "current_thread": 100, "threads": [{"posts": [{"num": 100, "files": [{"path": "/b/src/100/1.webm", "md5": "x"}]}]}]}`,
+		"b/src/100/1.webm": strings.Repeat("w", 300),
+	}))
+	defer srv.Close()
+	srv.Inject(dvachtest.Fault{Path: "/b/res/200.json", Status: http.StatusNotFound})
+	dir := t.TempDir()
+
+	// Record a few requests, gzipped JSON included
+	recording := dvach.NewClient(dvach.WithBaseURL(srv.URL), dvach.WithHTTPClient(&http.Client{Transport: NewRecorder(dir, true, nil)}))
+	wantCatalog, err := recording.Catalog("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantThread, err := recording.Thread("b", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := recording.Thread("b", 200); err == nil {
+		t.Fatal("missing thread didn't fail")
+	}
+	resp, err := recording.HTTPClient().Get(srv.URL + "/b/src/100/1.webm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	media, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if len(media) != 300 {
+		t.Fatalf("recording changed the media body: %d bytes", len(media))
+	}
+
+	// The cassette is plain JSON
+	var entry Entry
+	data, err := os.ReadFile(filepath.Join(dir, "b", "catalog.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, &entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry.Status != 200 || !strings.Contains(string(entry.Body), `"subject": "webm"`) {
+		t.Errorf("catalog entry = %s", data)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "b", "src", "100", "1.webm.json")); err != nil {
+		t.Errorf("media headers not recorded: %v", err)
+	}
+
+	// Replay the same requests with the server gone
+	srv.Close()
+	replaying := dvach.NewClient(dvach.WithBaseURL(srv.URL), dvach.WithHTTPClient(&http.Client{Transport: NewReplayer(dir)}))
+	gotCatalog, err := replaying.Catalog("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(gotCatalog, wantCatalog) {
+		t.Errorf("replayed catalog = %+v, want %+v", gotCatalog, wantCatalog)
+	}
+	gotThread, err := replaying.Thread("b", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(gotThread, wantThread) {
+		t.Errorf("replayed thread = %+v, want %+v", gotThread, wantThread)
+	}
+	_, err = replaying.Thread("b", 200)
+	var serr *dvach.StatusError
+	if !errors.As(err, &serr) || serr.Code != http.StatusNotFound {
+		t.Errorf("replayed missing thread: %v", err)
+	}
+
+	resp, err = replaying.HTTPClient().Get(srv.URL + "/b/src/100/1.webm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	media, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != 200 || len(media) != 300 {
+		t.Errorf("replayed media: %d, %d bytes", resp.StatusCode, len(media))
+	}
+
+	if _, err := replaying.Catalog("a"); !errors.Is(err, ErrNotRecorded) {
+		t.Errorf("unrecorded catalog: %v", err)
+	}
+}
+
+func TestReplayHandEdited(t *testing.T) {
+	dir := writeFixtures(t, map[string]string{
+		// Status defaults to 200
+		"b/catalog.json": `{"body": {"board": {"id": "b"}, "threads": [{"num": 7, "op": 1}]}}`,
+	})
+	client := dvach.NewClient(dvach.WithHTTPClient(&http.Client{Transport: NewReplayer(dir)}))
+	catalog, err := client.Catalog("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(catalog.Threads) != 1 || catalog.Threads[0].Num != 7 {
+		t.Errorf("catalog = %+v", catalog)
+	}
+}
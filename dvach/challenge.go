@@ -0,0 +1,84 @@
+package dvach
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// ChallengeError is an anti-bot page served instead of the API or a file
+type ChallengeError struct {
+	Path     string
+	Provider string // "Cloudflare", "DDoS-Guard" or "unknown"
+	Code     int
+}
+
+func (e *ChallengeError) Error() string {
+	return fmt.Sprintf("%s: anti-bot challenge by %s (status %d), solve it in a browser and import its cookies", e.Path, e.Provider, e.Code)
+}
+
+// IsChallenge reports whether err is an anti-bot page
+func IsChallenge(err error) bool {
+	var cerr *ChallengeError
+	return errors.As(err, &cerr)
+}
+
+// challengeMarkers are lower-case strings found in challenge pages, by provider
+var challengeMarkers = []struct {
+	provider string
+	marker   string
+}{
+	{"Cloudflare", "cf-chl"},
+	{"Cloudflare", "challenge-platform"},
+	{"Cloudflare", "cf_chl_opt"},
+	{"Cloudflare", "<title>just a moment"},
+	{"DDoS-Guard", "ddos-guard"},
+	{"DDoS-Guard", "__ddg"},
+	{"unknown", "g-recaptcha"},
+	{"unknown", "h-captcha"},
+}
+
+// challengePeek is how much of an HTML body is searched for markers
+const challengePeek = 64 << 10
+
+// CheckChallenge returns a *ChallengeError if resp is an anti-bot page rather than what was asked for.
+// Headers are checked first, then the start of HTML bodies, which is put back for the caller.
+func CheckChallenge(resp *http.Response, path string) error {
+	challenge := func(provider string) error {
+		return &ChallengeError{Path: path, Provider: provider, Code: resp.StatusCode}
+	}
+	if resp.Header.Get("Cf-Mitigated") == "challenge" {
+		return challenge("Cloudflare")
+	}
+	if !strings.Contains(resp.Header.Get("Content-Type"), "html") {
+		return nil
+	}
+
+	peek, err := io.ReadAll(io.LimitReader(resp.Body, challengePeek))
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(peek), resp.Body), resp.Body}
+	if err != nil {
+		return nil // the caller runs into the error reading the body
+	}
+	lower := bytes.ToLower(peek)
+	for _, m := range challengeMarkers {
+		if bytes.Contains(lower, []byte(m.marker)) {
+			return challenge(m.provider)
+		}
+	}
+	// A blocking page without markers still says who serves it
+	if resp.StatusCode == http.StatusForbidden || resp.StatusCode == http.StatusServiceUnavailable {
+		switch server := strings.ToLower(resp.Header.Get("Server")); {
+		case strings.Contains(server, "cloudflare"):
+			return challenge("Cloudflare")
+		case strings.Contains(server, "ddos-guard"):
+			return challenge("DDoS-Guard")
+		}
+	}
+	return nil
+}
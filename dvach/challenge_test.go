@@ -0,0 +1,53 @@
+package dvach
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestChallengeDetected(t *testing.T) {
+	pages := map[string]http.HandlerFunc{
+		"/cloudflare/catalog.json": func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/html; charset=UTF-8")
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`<!DOCTYPE html><html><head><title>Just a moment...</title></head><body><script src="/cdn-cgi/challenge-platform/h/g/orchestrate/chl_page/v1"></script></body></html>`))
+		},
+		"/ddg/catalog.json": func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/html")
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(`<html><body>Checking your browser... DDoS-Guard</body></html>`))
+		},
+		"/mitigated/catalog.json": func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Cf-Mitigated", "challenge")
+			w.WriteHeader(http.StatusForbidden)
+		},
+		"/error/catalog.json": func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte(`<html><body>Server is down for maintenance</body></html>`))
+		},
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pages[r.URL.Path](w, r)
+	}))
+	defer srv.Close()
+	client := NewClient(WithBaseURL(srv.URL))
+
+	for board, provider := range map[string]string{"cloudflare": "Cloudflare", "ddg": "DDoS-Guard", "mitigated": "Cloudflare"} {
+		_, err := client.Catalog(board)
+		var cerr *ChallengeError
+		if !errors.As(err, &cerr) || cerr.Provider != provider {
+			t.Errorf("%s: got %v, want a %s challenge", board, err, provider)
+		}
+		if IsAuthError(err) {
+			t.Errorf("%s: challenge taken for an auth error", board)
+		}
+	}
+
+	// HTML without markers is not a challenge, but not JSON either
+	_, err := client.Catalog("error")
+	if err == nil || IsChallenge(err) {
+		t.Errorf("error page: %v", err)
+	}
+}
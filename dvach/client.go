@@ -0,0 +1,243 @@
+// Package dvach is a client for the read-only JSON API of 2ch
+package dvach
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBaseURL is the 2ch mirror used unless WithBaseURL says otherwise
+const DefaultBaseURL = "https://2ch.su"
+
+// Client fetches catalogs and threads
+type Client struct {
+	baseURL string
+	http    *http.Client
+	cookies map[string]string
+
+	passcode string
+	authMu   sync.Mutex
+	authed   bool // usercode_auth was set or obtained and not dropped since
+	authGen  int  // logins so far, keeps concurrent requests from logging in twice
+	refused  error
+}
+
+// Option configures a Client
+type Option func(*Client)
+
+// WithBaseURL sets the mirror or a test server to talk to
+func WithBaseURL(baseURL string) Option {
+	return func(c *Client) {
+		c.baseURL = baseURL
+	}
+}
+
+// WithHTTPClient sets the HTTP client, a cookie jar is added if it has none
+func WithHTTPClient(client *http.Client) Option {
+	return func(c *Client) {
+		c.http = client
+	}
+}
+
+// WithCookie sets a cookie sent with every request
+func WithCookie(name, value string) Option {
+	return func(c *Client) {
+		c.cookies[name] = value
+	}
+}
+
+// WithUsercode sets the usercode_auth cookie of a passcode, empty codes are ignored
+func WithUsercode(code string) Option {
+	return func(c *Client) {
+		if code != "" {
+			c.cookies[usercodeCookie] = code
+			c.authed = true
+		}
+	}
+}
+
+// NewClient creates a client, by default for DefaultBaseURL with age confirmation
+func NewClient(opts ...Option) *Client {
+	c := &Client{
+		baseURL: DefaultBaseURL,
+		cookies: map[string]string{"ageallow": "1"},
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.http == nil {
+		c.http = &http.Client{}
+	}
+	if c.http.Jar == nil {
+		c.http.Jar, _ = cookiejar.New(nil)
+	}
+	if u, err := url.Parse(c.baseURL); err == nil {
+		for k, v := range c.cookies {
+			c.http.Jar.SetCookies(u, []*http.Cookie{{Name: k, Value: v}})
+		}
+	}
+	return c
+}
+
+// BaseURL returns the URL files and threads are relative to
+func (c *Client) BaseURL() string {
+	return c.baseURL
+}
+
+// HTTPClient returns the HTTP client with the cookies of the client, for downloading files
+func (c *Client) HTTPClient() *http.Client {
+	return c.http
+}
+
+// ThreadURL returns the HTML page of a thread
+func (c *Client) ThreadURL(board string, num int64) string {
+	return c.baseURL + "/" + board + "/res/" + strconv.FormatInt(num, 10) + ".html"
+}
+
+// StatusError is a non-200 response of the API
+type StatusError struct {
+	Path string
+	Code int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s: unexpected status code: %d", e.Path, e.Code)
+}
+
+// IsAuthError reports whether the API rejected the request for lack of access,
+// the passcode login failed or usercode_auth expired
+func IsAuthError(err error) bool {
+	if errors.Is(err, ErrLoginFailed) || errors.Is(err, ErrAuthExpired) {
+		return true
+	}
+	var serr *StatusError
+	return errors.As(err, &serr) && (serr.Code == http.StatusUnauthorized || serr.Code == http.StatusForbidden)
+}
+
+// Catalog returns the live threads of a board
+func (c *Client) Catalog(board string) (*Catalog, error) {
+	var catalog Catalog
+	if err := c.getInto(board+"/catalog.json", &catalog); err != nil {
+		return nil, err
+	}
+	return &catalog, nil
+}
+
+// Thread returns a thread with all its posts
+func (c *Client) Thread(board string, num int64) (*Thread, error) {
+	var thread Thread
+	if err := c.getInto(board+"/res/"+strconv.FormatInt(num, 10)+".json", &thread); err != nil {
+		return nil, err
+	}
+	return &thread, nil
+}
+
+// getInto decodes the JSON body of an API path into v
+func (c *Client) getInto(path string, v any) error {
+	body, err := c.GetJSON(path)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+// GetJSON returns the body of an API path relative to the base URL. With a passcode
+// the client logs in before the first request and again when auth is rejected or expires.
+func (c *Client) GetJSON(path string) ([]byte, error) {
+	authed, gen := c.authState()
+	if !authed && c.passcode != "" {
+		if err := c.reauth(gen); err != nil {
+			return nil, err
+		}
+		_, gen = c.authState()
+	}
+
+	body, err := c.get(path)
+	if !IsAuthError(err) && !c.expired() {
+		return body, err
+	}
+	if c.passcode == "" {
+		if err == nil {
+			return nil, fmt.Errorf("%s: %w", path, ErrAuthExpired)
+		}
+		return nil, err
+	}
+	if err := c.reauth(gen); err != nil {
+		return nil, err
+	}
+	return c.get(path)
+}
+
+// get makes a single request for an API path
+func (c *Client) get(path string) ([]byte, error) {
+	req, err := http.NewRequest("GET", c.baseURL+"/"+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	// Accept-Encoding is left to the transport, which asks for gzip and decodes it transparently
+	req.Header.Set("Accept", "application/json")
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if err := CheckChallenge(resp, path); err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != 200 {
+		return nil, &StatusError{Path: path, Code: resp.StatusCode}
+	}
+	// An error page served with 200 would otherwise surface as a confusing decoding error
+	if strings.Contains(resp.Header.Get("Content-Type"), "html") {
+		return nil, fmt.Errorf("%s: got an HTML page instead of JSON", path)
+	}
+
+	reader, err := decodeBody(resp)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	defer reader.Close()
+
+	body, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	return body, nil
+}
+
+// decodeBody undoes a Content-Encoding the transport left in place, e.g. with compression disabled
+// or a server compressing unasked. Brotli and zstd have no decoder in the standard library.
+func decodeBody(resp *http.Response) (io.ReadCloser, error) {
+	switch encoding := strings.ToLower(resp.Header.Get("Content-Encoding")); encoding {
+	case "", "identity":
+		return resp.Body, nil
+	case "gzip", "x-gzip":
+		return gzip.NewReader(resp.Body)
+	case "deflate":
+		// Meant to be zlib, some servers send raw deflate
+		buffered := bufio.NewReader(resp.Body)
+		if header, err := buffered.Peek(2); err == nil && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 && header[0]&0x0f == 8 {
+			return zlib.NewReader(buffered)
+		}
+		return flate.NewReader(buffered), nil
+	default:
+		return nil, fmt.Errorf("unsupported Content-Encoding %q", encoding)
+	}
+}
@@ -0,0 +1,180 @@
+// Package dvachtest is a fake 2ch for offline tests. It serves catalogs, threads and
+// media from a fixture directory laid out like the site, e.g. b/catalog.json,
+// b/res/100.json and b/src/100/1.webm, and can inject failures per path.
+package dvachtest
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Fault changes how requests for matching paths are answered, zero values change nothing
+type Fault struct {
+	Path        string        // path.Match pattern of the request path, e.g. "/b/src/*/*"
+	Status      int           // answer with this status instead of the file, e.g. 404, 429 or 503
+	RetryAfter  int           // seconds sent in Retry-After along with Status
+	Truncate    int64         // announce the full length but close the connection after this many bytes
+	IgnoreRange bool          // answer range requests with the whole file
+	ChunkDelay  time.Duration // sleep between 1 KB chunks of the body, makes a slow stream
+	Times       int           // number of requests the fault applies to, 0 means every request
+}
+
+// fault is an injected Fault with the number of requests it was applied to
+type fault struct {
+	Fault
+	used int
+}
+
+// Server is a fake 2ch backed by a fixture directory
+type Server struct {
+	*httptest.Server
+
+	dir string
+
+	mu       sync.Mutex
+	faults   []*fault
+	requests map[string]int
+	noGzip   bool
+}
+
+// NewServer starts a fake 2ch serving dir, close it with Close
+func NewServer(dir string) *Server {
+	s := &Server{dir: dir, requests: make(map[string]int)}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+// Inject adds a fault, faults are checked in the order they were added
+func (s *Server) Inject(f Fault) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = append(s.faults, &fault{Fault: f})
+}
+
+// ClearFaults removes all faults
+func (s *Server) ClearFaults() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = nil
+}
+
+// SetGzip selects whether JSON is gzipped for clients accepting it, on by default like the real site
+func (s *Server) SetGzip(enabled bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.noGzip = !enabled
+}
+
+// Requests returns how many requests were made for a path
+func (s *Server) Requests(urlPath string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[urlPath]
+}
+
+// match counts a request and returns the first fault applying to it and whether JSON is gzipped
+func (s *Server) match(urlPath string) (Fault, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests[urlPath]++
+	for _, f := range s.faults {
+		if ok, _ := path.Match(f.Path, urlPath); !ok {
+			continue
+		}
+		if f.Times > 0 && f.used >= f.Times {
+			continue
+		}
+		f.used++
+		return f.Fault, !s.noGzip
+	}
+	return Fault{}, !s.noGzip
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	fault, gzipJSON := s.match(r.URL.Path)
+
+	if fault.Status != 0 {
+		if fault.RetryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(fault.RetryAfter))
+		}
+		http.Error(w, http.StatusText(fault.Status), fault.Status)
+		return
+	}
+
+	name := strings.TrimPrefix(path.Clean(r.URL.Path), "/")
+	data, err := fs.ReadFile(os.DirFS(s.dir), name)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	if fault.IgnoreRange {
+		r.Header.Del("Range")
+	}
+
+	var bw http.ResponseWriter = w
+	if fault.Truncate > 0 || fault.ChunkDelay > 0 {
+		bw = &faultyWriter{ResponseWriter: w, limit: fault.Truncate, delay: fault.ChunkDelay, done: r.Context().Done()}
+	}
+
+	if path.Ext(name) == ".json" {
+		w.Header().Set("Content-Type", "application/json")
+		if gzipJSON && strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			var buf bytes.Buffer
+			zw := gzip.NewWriter(&buf)
+			zw.Write(data)
+			zw.Close()
+			data = buf.Bytes()
+			w.Header().Set("Content-Encoding", "gzip")
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		bw.Write(data)
+		return
+	}
+	http.ServeContent(bw, r, name, time.Time{}, bytes.NewReader(data))
+}
+
+// faultyWriter drops the body after limit bytes and writes it in delayed chunks
+type faultyWriter struct {
+	http.ResponseWriter
+	limit   int64 // 0 means no limit
+	delay   time.Duration
+	written int64
+	done    <-chan struct{}
+}
+
+func (w *faultyWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	if w.limit > 0 {
+		p = p[:max(0, min(int64(len(p)), w.limit-w.written))]
+	}
+	for len(p) > 0 {
+		chunk := p[:min(len(p), 1024)]
+		if w.delay > 0 {
+			select {
+			case <-w.done:
+				return 0, io.ErrClosedPipe
+			case <-time.After(w.delay):
+			}
+		}
+		if _, err := w.ResponseWriter.Write(chunk); err != nil {
+			return 0, err
+		}
+		if f, ok := w.ResponseWriter.(http.Flusher); ok && w.delay > 0 {
+			f.Flush()
+		}
+		w.written += int64(len(chunk))
+		p = p[len(chunk):]
+	}
+	// Pretend the rest was written, the server closes the connection on the short body
+	return n, nil
+}
@@ -0,0 +1,153 @@
+package dvachtest
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alekxeyuk/makaba-downloader/dvach"
+)
+
+const testCatalog = `{"board": {"id": "b"}, "threads": [{"num": 100, "op": 1, "subject": "test", "files_count": 1}]}`
+
+func newTestServer(t *testing.T) *Server {
+	t.Helper()
+	dir := t.TempDir()
+	files := map[string]string{
+		"b/catalog.json":   testCatalog,
+		"b/src/100/1.webm": strings.Repeat("0123456789", 500),
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	srv := NewServer(dir)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestServerGzip(t *testing.T) {
+	srv := newTestServer(t)
+	client := dvach.NewClient(dvach.WithBaseURL(srv.URL))
+
+	for _, gzip := range []bool{true, false} {
+		srv.SetGzip(gzip)
+		catalog, err := client.Catalog("b")
+		if err != nil {
+			t.Fatalf("gzip %v: %v", gzip, err)
+		}
+		if len(catalog.Threads) != 1 || catalog.Threads[0].Num != 100 || !catalog.Threads[0].OP {
+			t.Errorf("gzip %v: catalog = %+v", gzip, catalog)
+		}
+	}
+	if n := srv.Requests("/b/catalog.json"); n != 2 {
+		t.Errorf("catalog requested %d times, want 2", n)
+	}
+}
+
+func TestServerStatus(t *testing.T) {
+	srv := newTestServer(t)
+	client := dvach.NewClient(dvach.WithBaseURL(srv.URL))
+
+	srv.Inject(Fault{Path: "/b/catalog.json", Status: http.StatusServiceUnavailable, Times: 1})
+	_, err := client.Catalog("b")
+	var serr *dvach.StatusError
+	if !errors.As(err, &serr) || serr.Code != http.StatusServiceUnavailable {
+		t.Fatalf("first request: %v", err)
+	}
+	if _, err := client.Catalog("b"); err != nil {
+		t.Errorf("fault applied more than once: %v", err)
+	}
+
+	srv.Inject(Fault{Path: "/b/src/*/*", Status: http.StatusTooManyRequests, RetryAfter: 5})
+	resp, err := http.Get(srv.URL + "/b/src/100/1.webm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") != "5" {
+		t.Errorf("got %d with Retry-After %q", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+
+	srv.ClearFaults()
+	resp, err = http.Get(srv.URL + "/b/res/404.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("missing thread: got %d", resp.StatusCode)
+	}
+}
+
+func getRange(t *testing.T, url, rng string) (*http.Response, []byte, error) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rng != "" {
+		req.Header.Set("Range", rng)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	return resp, body, err
+}
+
+func TestServerRange(t *testing.T) {
+	srv := newTestServer(t)
+	url := srv.URL + "/b/src/100/1.webm"
+
+	resp, body, err := getRange(t, url, "bytes=4990-")
+	if err != nil || resp.StatusCode != http.StatusPartialContent || string(body) != "0123456789" {
+		t.Errorf("range: %d %q %v", resp.StatusCode, body, err)
+	}
+
+	srv.Inject(Fault{Path: "/b/src/*/*", IgnoreRange: true})
+	resp, body, err = getRange(t, url, "bytes=4990-")
+	if err != nil || resp.StatusCode != http.StatusOK || len(body) != 5000 {
+		t.Errorf("ignored range: %d, %d bytes, %v", resp.StatusCode, len(body), err)
+	}
+}
+
+func TestServerTruncate(t *testing.T) {
+	srv := newTestServer(t)
+	srv.Inject(Fault{Path: "/b/src/*/*", Truncate: 1000})
+
+	resp, body, err := getRange(t, srv.URL+"/b/src/100/1.webm", "")
+	if resp.ContentLength != 5000 {
+		t.Errorf("announced %d bytes, want 5000", resp.ContentLength)
+	}
+	if !errors.Is(err, io.ErrUnexpectedEOF) || len(body) != 1000 {
+		t.Errorf("got %d bytes, %v", len(body), err)
+	}
+}
+
+func TestServerSlowStream(t *testing.T) {
+	srv := newTestServer(t)
+	srv.Inject(Fault{Path: "/b/src/*/*", ChunkDelay: 20 * time.Millisecond})
+
+	start := time.Now()
+	_, body, err := getRange(t, srv.URL+"/b/src/100/1.webm", "")
+	if err != nil || len(body) != 5000 {
+		t.Fatalf("got %d bytes, %v", len(body), err)
+	}
+	// 5 chunks of 1 KB
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("slow stream took only %v", elapsed)
+	}
+}
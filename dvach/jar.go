@@ -0,0 +1,245 @@
+package dvach
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Jar is a cookie jar that remembers its cookies so they can be saved to a
+// Netscape cookies.txt file and loaded again, e.g. a solved challenge across restarts
+type Jar struct {
+	jar *cookiejar.Jar
+	now func() time.Time
+
+	mu      sync.Mutex
+	cookies map[string]*http.Cookie // by domain, path and name
+}
+
+// NewJar returns an empty jar
+func NewJar() *Jar {
+	jar, _ := cookiejar.New(nil)
+	return &Jar{jar: jar, now: time.Now, cookies: make(map[string]*http.Cookie)}
+}
+
+func (j *Jar) Cookies(u *url.URL) []*http.Cookie {
+	return j.jar.Cookies(u)
+}
+
+func (j *Jar) SetCookies(u *url.URL, cookies []*http.Cookie) {
+	j.jar.SetCookies(u, cookies)
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	now := j.now()
+	for _, c := range cookies {
+		kept := *c
+		if kept.Domain == "" {
+			kept.Domain = u.Hostname()
+		} else if !strings.HasPrefix(kept.Domain, ".") {
+			// An explicit domain covers subdomains, the leading dot marks it in cookies.txt
+			kept.Domain = "." + kept.Domain
+		}
+		if kept.Path == "" {
+			kept.Path = "/"
+		}
+		switch {
+		case kept.MaxAge > 0:
+			kept.Expires = now.Add(time.Duration(kept.MaxAge) * time.Second)
+		case kept.MaxAge < 0:
+			kept.Expires = now.Add(-time.Second)
+		}
+		key := strings.ToLower(kept.Domain) + ";" + kept.Path + ";" + kept.Name
+		if !kept.Expires.IsZero() && !kept.Expires.After(now) {
+			delete(j.cookies, key)
+			continue
+		}
+		j.cookies[key] = &kept
+	}
+}
+
+// Import adds the cookies of a Netscape cookies.txt file or a JSON browser export,
+// as written by common cookie editor extensions, and returns how many were added
+func (j *Jar) Import(r io.Reader) (int, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return 0, err
+	}
+	var cookies []*http.Cookie
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		cookies, err = parseCookieExport(trimmed)
+	} else {
+		cookies, err = parseCookiesTxt(data)
+	}
+	if err != nil {
+		return 0, err
+	}
+	now := j.now()
+	n := 0
+	for _, c := range cookies {
+		if !c.Expires.IsZero() && !c.Expires.After(now) {
+			continue
+		}
+		host := strings.TrimPrefix(c.Domain, ".")
+		if host == "" {
+			continue
+		}
+		if !strings.HasPrefix(c.Domain, ".") {
+			c.Domain = "" // host-only
+		}
+		j.SetCookies(&url.URL{Scheme: "https", Host: host, Path: c.Path}, []*http.Cookie{c})
+		n++
+	}
+	return n, nil
+}
+
+// parseCookiesTxt parses the Netscape format: domain, subdomains flag, path, secure flag, expiry, name and value
+// separated by tabs, with "#HttpOnly_" in front of the domain of HttpOnly cookies
+func parseCookiesTxt(data []byte) ([]*http.Cookie, error) {
+	var cookies []*http.Cookie
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimRight(scanner.Text(), "\r")
+		httpOnly := false
+		if rest, ok := strings.CutPrefix(text, "#HttpOnly_"); ok {
+			text, httpOnly = rest, true
+		}
+		if strings.TrimSpace(text) == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Split(text, "\t")
+		if len(fields) != 7 {
+			return nil, fmt.Errorf("cookies.txt line %d: got %d fields, want 7", line, len(fields))
+		}
+		expires, err := strconv.ParseInt(fields[4], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("cookies.txt line %d: %w", line, err)
+		}
+		domain := fields[0]
+		if strings.EqualFold(fields[1], "TRUE") && !strings.HasPrefix(domain, ".") {
+			domain = "." + domain
+		}
+		c := &http.Cookie{
+			Domain:   domain,
+			Path:     fields[2],
+			Secure:   strings.EqualFold(fields[3], "TRUE"),
+			HttpOnly: httpOnly,
+			Name:     fields[5],
+			Value:    fields[6],
+		}
+		if expires > 0 {
+			c.Expires = time.Unix(expires, 0)
+		}
+		cookies = append(cookies, c)
+	}
+	return cookies, scanner.Err()
+}
+
+// exportedCookie is a cookie in a JSON browser export
+type exportedCookie struct {
+	Domain         string  `json:"domain"`
+	HostOnly       bool    `json:"hostOnly"`
+	Path           string  `json:"path"`
+	Secure         bool    `json:"secure"`
+	HTTPOnly       bool    `json:"httpOnly"`
+	ExpirationDate float64 `json:"expirationDate"`
+	Name           string  `json:"name"`
+	Value          string  `json:"value"`
+}
+
+func parseCookieExport(data []byte) ([]*http.Cookie, error) {
+	var exported []exportedCookie
+	if err := json.Unmarshal(data, &exported); err != nil {
+		return nil, fmt.Errorf("cookie export: %w", err)
+	}
+	cookies := make([]*http.Cookie, 0, len(exported))
+	for _, e := range exported {
+		domain := e.Domain
+		if e.HostOnly {
+			domain = strings.TrimPrefix(domain, ".")
+		} else if !strings.HasPrefix(domain, ".") {
+			domain = "." + domain
+		}
+		c := &http.Cookie{Domain: domain, Path: e.Path, Secure: e.Secure, HttpOnly: e.HTTPOnly, Name: e.Name, Value: e.Value}
+		if e.ExpirationDate > 0 {
+			c.Expires = time.Unix(int64(e.ExpirationDate), 0)
+		}
+		cookies = append(cookies, c)
+	}
+	return cookies, nil
+}
+
+// Load imports a cookies.txt file saved by Save, a missing file is not an error
+func (j *Jar) Load(name string) error {
+	file, err := os.Open(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = j.Import(file)
+	return err
+}
+
+// Save writes the unexpired cookies to a cookies.txt file, replacing it atomically
+func (j *Jar) Save(name string) error {
+	j.mu.Lock()
+	now := j.now()
+	var lines []string
+	for _, c := range j.cookies {
+		if !c.Expires.IsZero() && !c.Expires.After(now) {
+			continue
+		}
+		var expires int64
+		if !c.Expires.IsZero() {
+			expires = c.Expires.Unix()
+		}
+		domain := c.Domain
+		if c.HttpOnly {
+			domain = "#HttpOnly_" + domain
+		}
+		lines = append(lines, strings.Join([]string{
+			domain,
+			strings.ToUpper(strconv.FormatBool(strings.HasPrefix(c.Domain, "."))),
+			c.Path,
+			strings.ToUpper(strconv.FormatBool(c.Secure)),
+			strconv.FormatInt(expires, 10),
+			c.Name,
+			c.Value,
+		}, "\t"))
+	}
+	j.mu.Unlock()
+	sort.Strings(lines)
+
+	var buf bytes.Buffer
+	buf.WriteString("# Netscape HTTP Cookie File\n")
+	for _, line := range lines {
+		buf.WriteString(line + "\n")
+	}
+	tmp := name + ".tmp"
+	if dir := filepath.Dir(name); dir != "." {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+	if err := os.WriteFile(tmp, buf.Bytes(), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, name)
+}
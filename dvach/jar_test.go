@@ -0,0 +1,93 @@
+package dvach
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func cookieValue(jar http.CookieJar, rawURL, name string) string {
+	u, _ := url.Parse(rawURL)
+	for _, c := range jar.Cookies(u) {
+		if c.Name == name {
+			return c.Value
+		}
+	}
+	return ""
+}
+
+func TestJarImport(t *testing.T) {
+	future := time.Now().Add(time.Hour).Unix()
+	cookiesTxt := "# Netscape HTTP Cookie File\n" +
+		".2ch.su\tTRUE\t/\tTRUE\t" + strconv.FormatInt(future, 10) + "\tcf_clearance\tsolved\n" +
+		"#HttpOnly_2ch.su\tFALSE\t/\tFALSE\t0\tusercode_auth\tsecret\n" +
+		"2ch.su\tFALSE\t/\tFALSE\t1\told\texpired\n"
+	export := `[{"domain": ".2ch.su", "hostOnly": false, "path": "/", "secure": true, "name": "__ddg1_", "value": "guard", "expirationDate": ` + strconv.FormatInt(future, 10) + `.5}]`
+
+	jar := NewJar()
+	if n, err := jar.Import(strings.NewReader(cookiesTxt)); err != nil || n != 2 {
+		t.Fatalf("cookies.txt: imported %d, %v", n, err)
+	}
+	if n, err := jar.Import(strings.NewReader(export)); err != nil || n != 1 {
+		t.Fatalf("export: imported %d, %v", n, err)
+	}
+	for name, want := range map[string]string{"cf_clearance": "solved", "usercode_auth": "secret", "__ddg1_": "guard", "old": ""} {
+		if got := cookieValue(jar, "https://2ch.su/b/catalog.json", name); got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+	// Only domain cookies reach subdomains
+	if got := cookieValue(jar, "https://m.2ch.su/", "cf_clearance"); got != "solved" {
+		t.Errorf("domain cookie on a subdomain = %q", got)
+	}
+	if got := cookieValue(jar, "https://m.2ch.su/", "usercode_auth"); got != "" {
+		t.Errorf("host-only cookie on a subdomain = %q", got)
+	}
+
+	if _, err := jar.Import(strings.NewReader("2ch.su\tFALSE\t/\n")); err == nil {
+		t.Error("short line imported")
+	}
+}
+
+func TestJarSaveLoad(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "cf_clearance", Value: "solved", MaxAge: 3600})
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "s"})
+		http.SetCookie(w, &http.Cookie{Name: "gone", MaxAge: -1})
+		w.Write([]byte("{}"))
+	}))
+	defer srv.Close()
+	name := filepath.Join(t.TempDir(), "cookies.txt")
+
+	jar := NewJar()
+	client := NewClient(WithBaseURL(srv.URL), WithHTTPClient(&http.Client{Jar: jar}))
+	if _, err := client.GetJSON("b/catalog.json"); err != nil {
+		t.Fatal(err)
+	}
+	if err := jar.Save(name); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := os.ReadFile(name)
+	if strings.Contains(string(data), "gone") {
+		t.Errorf("deleted cookie saved:\n%s", data)
+	}
+
+	loaded := NewJar()
+	if err := loaded.Load(name); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []string{"cf_clearance", "session", "ageallow"} {
+		if cookieValue(loaded, srv.URL, c) == "" {
+			t.Errorf("%s lost across save and load:\n%s", c, data)
+		}
+	}
+	if err := NewJar().Load(filepath.Join(t.TempDir(), "missing.txt")); err != nil {
+		t.Errorf("missing jar file: %v", err)
+	}
+}
@@ -0,0 +1,135 @@
+package dvach
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+)
+
+// Board identifies the board a catalog or thread belongs to
+type Board struct {
+	ID   string `json:"id"`
+	Name string `json:"name,omitempty"`
+}
+
+// Catalog is the list of live threads of a board, each represented by its opening post
+type Catalog struct {
+	Board   Board  `json:"board"`
+	Threads []Post `json:"threads"`
+}
+
+// Thread is a thread with all its posts, the first one is the opening post
+type Thread struct {
+	Board      Board  `json:"board"`
+	Num        int64  `json:"current_thread"`
+	Title      string `json:"title,omitempty"`
+	FilesCount int64  `json:"files_count"`
+	PostsCount int64  `json:"posts_count"`
+	Posts      []Post `json:"-"`
+}
+
+// UnmarshalJSON flattens the "threads" array of the API into Posts
+func (t *Thread) UnmarshalJSON(data []byte) error {
+	type plain Thread
+	aux := struct {
+		*plain
+		Threads []struct {
+			Posts []Post `json:"posts"`
+		} `json:"threads"`
+	}{plain: (*plain)(t)}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+	t.Posts = nil
+	for _, thread := range aux.Threads {
+		t.Posts = append(t.Posts, thread.Posts...)
+	}
+	return nil
+}
+
+// Subject returns the subject of the opening post
+func (t *Thread) Subject() string {
+	if len(t.Posts) == 0 {
+		return ""
+	}
+	return t.Posts[0].Subject
+}
+
+// Post is a single post, in a catalog it is the opening post with the thread counters
+type Post struct {
+	Num       int64  `json:"num"`
+	Parent    int64  `json:"parent"` // thread number, 0 for the opening post
+	Timestamp int64  `json:"timestamp"`
+	Subject   string `json:"subject,omitempty"`
+	Comment   string `json:"comment"` // HTML
+	Name      string `json:"name,omitempty"`
+	Trip      string `json:"trip,omitempty"`
+	OP        bool   `json:"op"` // posted by the thread author
+	Files     []File `json:"files,omitempty"`
+
+	// Only set in catalogs
+	Tags       string `json:"tags,omitempty"`
+	FilesCount int64  `json:"files_count,omitempty"`
+	PostsCount int64  `json:"posts_count,omitempty"`
+	LastHit    int64  `json:"lasthit,omitempty"`
+}
+
+// UnmarshalJSON accepts the op flag as 0/1 like the API sends it
+func (p *Post) UnmarshalJSON(data []byte) error {
+	type plain Post
+	aux := struct {
+		*plain
+		OP json.RawMessage `json:"op"`
+	}{plain: (*plain)(p)}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+	p.OP = string(aux.OP) == "1" || string(aux.OP) == "true"
+	return nil
+}
+
+// IsOpening reports whether the post opens thread num
+func (p *Post) IsOpening(num int64) bool {
+	return p.Parent == 0 || p.Num == num
+}
+
+// File is an attachment of a post
+type File struct {
+	Name         string `json:"name"`               // server side name
+	FullName     string `json:"fullname,omitempty"` // original name given by the poster
+	Path         string `json:"path"`               // relative to the base URL
+	Thumbnail    string `json:"thumbnail,omitempty"`
+	MD5          string `json:"md5"`
+	Size         int64  `json:"size"` // in KB
+	Width        int64  `json:"width,omitempty"`
+	Height       int64  `json:"height,omitempty"`
+	Duration     string `json:"duration,omitempty"` // HH:MM:SS for videos
+	DurationSecs int64  `json:"duration_secs,omitempty"`
+}
+
+// OriginalName returns the name given by the poster, or the server side one if it is unknown
+func (f *File) OriginalName() string {
+	if f.FullName != "" {
+		return f.FullName
+	}
+	return f.Name
+}
+
+// Seconds returns the duration of a video, false for files without one
+func (f *File) Seconds() (int64, bool) {
+	if f.DurationSecs > 0 {
+		return f.DurationSecs, true
+	}
+	if f.Duration == "" {
+		return 0, false
+	}
+	var total int64
+	for part := range strings.SplitSeq(f.Duration, ":") {
+		n, err := strconv.ParseInt(part, 10, 64)
+		if err != nil {
+			return 0, false
+		}
+		total = total*60 + n
+	}
+	return total, total > 0
+}
@@ -0,0 +1,143 @@
+package dvach
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func loadFixture(t *testing.T, name string, v any) {
+	t.Helper()
+	data, err := os.ReadFile("testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		t.Fatalf("decoding %s: %v", name, err)
+	}
+}
+
+func TestDecodeCatalog(t *testing.T) {
+	var catalog Catalog
+	loadFixture(t, "catalog.json", &catalog)
+
+	if catalog.Board.ID != "b" || catalog.Board.Name != "Бред" {
+		t.Errorf("board = %+v", catalog.Board)
+	}
+	if len(catalog.Threads) != 2 {
+		t.Fatalf("got %d threads, want 2", len(catalog.Threads))
+	}
+	op := catalog.Threads[0]
+	want := Post{
+		Num:       312345678,
+		Timestamp: 1760875201,
+		Subject:   "Webm-тред",
+		Comment:   "Webm-тред<br>Постим <strong>годноту</strong> &amp; не только",
+		Name:      "Аноним",
+		OP:        true,
+		Files: []File{{
+			Name:         "17608752010010.webm",
+			FullName:     "cat.webm",
+			Path:         "/b/src/312345678/17608752010010.webm",
+			Thumbnail:    "/b/thumb/312345678/17608752010010s.jpg",
+			MD5:          "0123456789abcdef0123456789abcdef",
+			Size:         2048,
+			Width:        1280,
+			Height:       720,
+			Duration:     "00:01:05",
+			DurationSecs: 65,
+		}},
+		Tags:       "webm",
+		FilesCount: 42,
+		PostsCount: 120,
+		LastHit:    1760875800,
+	}
+	if !reflect.DeepEqual(op, want) {
+		t.Errorf("thread =\n%+v\nwant\n%+v", op, want)
+	}
+	if catalog.Threads[1].OP || len(catalog.Threads[1].Files) != 0 {
+		t.Errorf("second thread = %+v", catalog.Threads[1])
+	}
+}
+
+func TestDecodeThread(t *testing.T) {
+	var thread Thread
+	loadFixture(t, "thread.json", &thread)
+
+	if thread.Board.ID != "b" || thread.Num != 312345678 || thread.FilesCount != 2 || thread.PostsCount != 2 {
+		t.Errorf("thread = %+v", thread)
+	}
+	if thread.Subject() != "Webm-тред" {
+		t.Errorf("subject = %q", thread.Subject())
+	}
+	if len(thread.Posts) != 2 {
+		t.Fatalf("got %d posts, want 2", len(thread.Posts))
+	}
+
+	op, reply := &thread.Posts[0], &thread.Posts[1]
+	if !op.IsOpening(thread.Num) || !op.OP {
+		t.Errorf("first post is not the opening one: %+v", op)
+	}
+	if reply.IsOpening(thread.Num) || reply.OP || reply.Parent != thread.Num {
+		t.Errorf("reply looks like the opening post: %+v", reply)
+	}
+	if reply.Trip != "!!abcDEF123" || reply.Timestamp != 1760875511 {
+		t.Errorf("reply = %+v", reply)
+	}
+
+	file := reply.Files[0]
+	if file.OriginalName() != "17608755110020.png" {
+		t.Errorf("original name = %q, want the server name when fullname is empty", file.OriginalName())
+	}
+	if _, ok := file.Seconds(); ok {
+		t.Error("image has a duration")
+	}
+	if secs, ok := op.Files[0].Seconds(); !ok || secs != 65 {
+		t.Errorf("duration = %d, %v", secs, ok)
+	}
+}
+
+func TestFileSeconds(t *testing.T) {
+	tests := []struct {
+		file File
+		want int64
+		ok   bool
+	}{
+		{File{DurationSecs: 12}, 12, true},
+		{File{Duration: "01:02:03"}, 3723, true},
+		{File{Duration: "00:00:00"}, 0, false},
+		{File{Duration: "bad"}, 0, false},
+		{File{}, 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := tt.file.Seconds()
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("%+v.Seconds() = %d, %v, want %d, %v", tt.file, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestClientDecodes(t *testing.T) {
+	srv := httptest.NewServer(http.FileServer(http.Dir("testdata")))
+	defer srv.Close()
+
+	// The fixture names stand in for the real API paths
+	client := NewClient(WithBaseURL(srv.URL))
+	var catalog Catalog
+	if err := client.getInto("catalog.json", &catalog); err != nil {
+		t.Fatal(err)
+	}
+	if len(catalog.Threads) != 2 {
+		t.Errorf("got %d threads, want 2", len(catalog.Threads))
+	}
+
+	_, err := client.Catalog("nope")
+	var serr *StatusError
+	if !errors.As(err, &serr) || serr.Code != http.StatusNotFound {
+		t.Errorf("missing catalog: %v", err)
+	}
+}
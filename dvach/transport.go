@@ -0,0 +1,140 @@
+package dvach
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// TransportConfig tunes the HTTP transport of API and media requests, zero values mean the defaults
+type TransportConfig struct {
+	DialTimeoutSeconds           int    `json:"dial_timeout_seconds,omitempty"`            // default 10
+	TLSHandshakeTimeoutSeconds   int    `json:"tls_handshake_timeout_seconds,omitempty"`   // default 10
+	ResponseHeaderTimeoutSeconds int    `json:"response_header_timeout_seconds,omitempty"` // default 30
+	StallTimeoutSeconds          int    `json:"stall_timeout_seconds,omitempty"`           // body reads fail after this long without data, default 60
+	MaxConnsPerHost              int    `json:"max_conns_per_host,omitempty"`              // default unlimited
+	MaxIdleConnsPerHost          int    `json:"max_idle_conns_per_host,omitempty"`         // default 8
+	DisableHTTP2                 bool   `json:"disable_http2,omitempty"`
+	UserAgent                    string `json:"user_agent,omitempty"` // default is Go's
+}
+
+// seconds returns a setting as a duration, or def if it is unset
+func seconds(n, def int) time.Duration {
+	if n <= 0 {
+		n = def
+	}
+	return time.Duration(n) * time.Second
+}
+
+// NewTransport returns an http.Transport with the timeouts and pooling of the config,
+// proxies, the User-Agent and stall detection are layered on top of it
+func (c TransportConfig) NewTransport() *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{
+		Timeout:   seconds(c.DialTimeoutSeconds, 10),
+		KeepAlive: 30 * time.Second,
+	}).DialContext
+	transport.TLSHandshakeTimeout = seconds(c.TLSHandshakeTimeoutSeconds, 10)
+	transport.ResponseHeaderTimeout = seconds(c.ResponseHeaderTimeoutSeconds, 30)
+	transport.MaxConnsPerHost = c.MaxConnsPerHost
+	transport.MaxIdleConnsPerHost = c.MaxIdleConnsPerHost
+	if transport.MaxIdleConnsPerHost <= 0 {
+		transport.MaxIdleConnsPerHost = 8
+	}
+	if c.DisableHTTP2 {
+		transport.ForceAttemptHTTP2 = false
+		transport.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	}
+	return transport
+}
+
+// Wrap adds the User-Agent and stall detection to the requests of next
+func (c TransportConfig) Wrap(next http.RoundTripper) http.RoundTripper {
+	return &transport{next: next, userAgent: c.UserAgent, stall: seconds(c.StallTimeoutSeconds, 60)}
+}
+
+// StallError is returned by body reads that got no data for too long
+type StallError struct {
+	After time.Duration
+}
+
+func (e *StallError) Error() string {
+	return fmt.Sprintf("no data received for %v", e.After)
+}
+
+// Timeout makes a stall count as a timeout, e.g. a retryable failure of a download
+func (e *StallError) Timeout() bool   { return true }
+func (e *StallError) Temporary() bool { return true }
+
+// transport is the RoundTripper returned by Wrap
+type transport struct {
+	next      http.RoundTripper
+	userAgent string
+	stall     time.Duration
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.userAgent != "" {
+		req = req.Clone(req.Context())
+		req.Header.Set("User-Agent", t.userAgent)
+	}
+	ctx, cancel := context.WithCancel(req.Context())
+	resp, err := t.next.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = newStallBody(resp.Body, t.stall, cancel)
+	return resp, nil
+}
+
+// stallBody cancels its request when reads get no data for too long
+type stallBody struct {
+	body   io.ReadCloser
+	after  time.Duration
+	timer  *time.Timer
+	cancel context.CancelFunc
+
+	mu      sync.Mutex
+	stalled bool
+}
+
+func newStallBody(body io.ReadCloser, after time.Duration, cancel context.CancelFunc) *stallBody {
+	b := &stallBody{body: body, after: after, cancel: cancel}
+	b.timer = time.AfterFunc(after, func() {
+		b.mu.Lock()
+		b.stalled = true
+		b.mu.Unlock()
+		cancel()
+	})
+	return b
+}
+
+func (b *stallBody) Read(p []byte) (int, error) {
+	n, err := b.body.Read(p)
+	if n > 0 {
+		b.timer.Reset(b.after)
+	}
+	if err != nil && !errors.Is(err, io.EOF) {
+		b.mu.Lock()
+		stalled := b.stalled
+		b.mu.Unlock()
+		if stalled {
+			return n, &StallError{After: b.after}
+		}
+	}
+	return n, err
+}
+
+func (b *stallBody) Close() error {
+	b.timer.Stop()
+	err := b.body.Close()
+	b.cancel()
+	return err
+}
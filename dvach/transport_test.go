@@ -0,0 +1,97 @@
+package dvach
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/zlib"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTransportStall(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "10")
+		w.Write([]byte("01234"))
+		w.(http.Flusher).Flush()
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	client := &http.Client{Transport: &transport{next: http.DefaultTransport, stall: 50 * time.Millisecond}}
+	resp, err := client.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	var serr *StallError
+	if !errors.As(err, &serr) || string(body) != "01234" {
+		t.Fatalf("got %q, %v, want a stall after 5 bytes", body, err)
+	}
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Errorf("stall is not a timeout: %v", err)
+	}
+}
+
+func TestTransportHeaders(t *testing.T) {
+	var got http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+		w.Write([]byte("{}"))
+	}))
+	defer srv.Close()
+
+	config := TransportConfig{UserAgent: "test-agent/1.0"}
+	client := NewClient(WithBaseURL(srv.URL), WithHTTPClient(&http.Client{Transport: config.Wrap(config.NewTransport())}))
+	if _, err := client.GetJSON("b/catalog.json"); err != nil {
+		t.Fatal(err)
+	}
+	if ua := got.Get("User-Agent"); ua != "test-agent/1.0" {
+		t.Errorf("User-Agent = %q", ua)
+	}
+	if ae := got.Get("Accept-Encoding"); ae != "gzip" {
+		t.Errorf("Accept-Encoding = %q, want only what the transport decodes", ae)
+	}
+	if ct := got.Get("Content-Type"); ct != "" {
+		t.Errorf("GET sent Content-Type %q", ct)
+	}
+}
+
+func TestDecodeBody(t *testing.T) {
+	const want = `{"board": {"id": "b"}}`
+	var zlibbed, deflated bytes.Buffer
+	zw := zlib.NewWriter(&zlibbed)
+	zw.Write([]byte(want))
+	zw.Close()
+	fw, _ := flate.NewWriter(&deflated, flate.DefaultCompression)
+	fw.Write([]byte(want))
+	fw.Close()
+
+	for name, body := range map[string][]byte{"zlib": zlibbed.Bytes(), "raw deflate": deflated.Bytes()} {
+		resp := &http.Response{Header: http.Header{"Content-Encoding": {"deflate"}}, Body: io.NopCloser(bytes.NewReader(body))}
+		reader, err := decodeBody(resp)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		got, err := io.ReadAll(reader)
+		if err != nil || string(got) != want {
+			t.Errorf("%s: got %q, %v", name, got, err)
+		}
+	}
+
+	resp := &http.Response{Header: http.Header{"Content-Encoding": {"br"}}, Body: io.NopCloser(bytes.NewReader(nil))}
+	if _, err := decodeBody(resp); err == nil {
+		t.Error("brotli body decoded")
+	}
+}
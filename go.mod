@@ -1,11 +1,8 @@
-module first
+module github.com/alekxeyuk/makaba-downloader
 
 go 1.25.6
 
-require github.com/tidwall/gjson v1.18.0
-
 require (
-	github.com/tidwall/match v1.2.0 // indirect
-	github.com/tidwall/pretty v1.2.1 // indirect
+	golang.org/x/image v0.25.0
 	golang.org/x/time v0.14.0
 )
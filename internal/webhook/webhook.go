@@ -0,0 +1,30 @@
+// Package webhook posts JSON to user configured URLs, shared by hooks and notifications
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+)
+
+// PostJSON posts body with the extra headers and fails on a non-2xx response
+func PostJSON(ctx context.Context, client *http.Client, url string, body []byte, headers map[string]string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -1,6 +1,8 @@
-package main
+// Package logger is the colored leveled logger shared by all packages of the downloader
+package logger
 
 import (
+	"io"
 	"log"
 	"os"
 )
@@ -16,6 +18,7 @@ const (
 	colorWhite  = "\033[37m"
 )
 
+// Logger writes colored messages with a level prefix
 type Logger struct {
 	info    *log.Logger
 	error   *log.Logger
@@ -26,7 +29,8 @@ type Logger struct {
 	success *log.Logger
 }
 
-func NewLogger() *Logger {
+// New returns a logger writing errors to stderr and everything else to stdout
+func New() *Logger {
 	return &Logger{
 		info:    log.New(os.Stdout, colorGreen+"[INFO]"+" ", log.LstdFlags),
 		error:   log.New(os.Stderr, colorRed+"[ERROR]"+" ", log.LstdFlags),
@@ -67,5 +71,12 @@ func (l *Logger) Success(format string, v ...any) {
 	l.success.Printf(format+colorReset, v...)
 }
 
-// Global logger instance for use throughout the package
-var Log = NewLogger()
+// SetOutput redirects all levels to w, e.g. io.Discard when embedding the packages
+func (l *Logger) SetOutput(w io.Writer) {
+	for _, logger := range []*log.Logger{l.info, l.error, l.warning, l.debug, l.trace, l.fatal, l.success} {
+		logger.SetOutput(w)
+	}
+}
+
+// Log is the logger used by all packages
+var Log = New()
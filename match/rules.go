@@ -0,0 +1,182 @@
+// Package match decides which threads, posts and files are downloaded
+package match
+
+import (
+	"fmt"
+	"html"
+	"regexp"
+	"strings"
+
+	"github.com/alekxeyuk/makaba-downloader/dvach"
+)
+
+// FileRules decide which files of a matching thread are downloaded, zero values disable a rule
+type FileRules struct {
+	MinSizeKB          int64    `json:"min_size_kb,omitempty"`
+	MaxSizeKB          int64    `json:"max_size_kb,omitempty"`
+	MinWidth           int64    `json:"min_width,omitempty"`
+	MinHeight          int64    `json:"min_height,omitempty"`
+	MinDurationSeconds int64    `json:"min_duration_seconds,omitempty"` // only checked for files with a duration
+	MaxDurationSeconds int64    `json:"max_duration_seconds,omitempty"`
+	NameInclude        []string `json:"name_include,omitempty"` // regexps, at least one must match the original name
+	NameExclude        []string `json:"name_exclude,omitempty"` // regexps, none may match the original name
+	OPOnly             bool     `json:"op_only,omitempty"`
+	RepliesOnly        bool     `json:"replies_only,omitempty"`
+
+	nameInclude []*regexp.Regexp
+	nameExclude []*regexp.Regexp
+}
+
+// Compile prepares the regexps, must be called before Match
+func (r *FileRules) Compile() error {
+	if r.OPOnly && r.RepliesOnly {
+		return fmt.Errorf("op_only and replies_only can't be used together")
+	}
+	var err error
+	if r.nameInclude, err = compilePatterns(r.NameInclude); err != nil {
+		return fmt.Errorf("name_include: %w", err)
+	}
+	if r.nameExclude, err = compilePatterns(r.NameExclude); err != nil {
+		return fmt.Errorf("name_exclude: %w", err)
+	}
+	return nil
+}
+
+// Match checks a file of a post, returns the reason when the file is rejected
+func (r *FileRules) Match(file *dvach.File, isOP bool) (bool, string) {
+	if r == nil {
+		return true, ""
+	}
+	if r.OPOnly && !isOP {
+		return false, "not in OP post"
+	}
+	if r.RepliesOnly && isOP {
+		return false, "in OP post"
+	}
+
+	size := file.Size // in KB
+	if r.MinSizeKB > 0 && size < r.MinSizeKB {
+		return false, fmt.Sprintf("size %d KB below %d KB", size, r.MinSizeKB)
+	}
+	if r.MaxSizeKB > 0 && size > r.MaxSizeKB {
+		return false, fmt.Sprintf("size %d KB above %d KB", size, r.MaxSizeKB)
+	}
+
+	width, height := file.Width, file.Height
+	if r.MinWidth > 0 && width < r.MinWidth || r.MinHeight > 0 && height < r.MinHeight {
+		return false, fmt.Sprintf("resolution %dx%d below %dx%d", width, height, r.MinWidth, r.MinHeight)
+	}
+
+	if duration, ok := file.Seconds(); ok {
+		if r.MinDurationSeconds > 0 && duration < r.MinDurationSeconds {
+			return false, fmt.Sprintf("duration %ds below %ds", duration, r.MinDurationSeconds)
+		}
+		if r.MaxDurationSeconds > 0 && duration > r.MaxDurationSeconds {
+			return false, fmt.Sprintf("duration %ds above %ds", duration, r.MaxDurationSeconds)
+		}
+	}
+
+	name := file.OriginalName()
+	if len(r.nameInclude) > 0 && !matchAny(name, r.nameInclude) {
+		return false, fmt.Sprintf("name %q not included", name)
+	}
+	if matchAny(name, r.nameExclude) {
+		return false, fmt.Sprintf("name %q excluded", name)
+	}
+	return true, ""
+}
+
+// PostRules decide which posts of a matching thread have their files downloaded.
+// A post is taken if any include rule matches it, or if there are no include rules at all,
+// and no exclude rule matches it.
+type PostRules struct {
+	CommentInclude []string `json:"comment_include,omitempty"` // regexps matched against the comment without HTML
+	CommentExclude []string `json:"comment_exclude,omitempty"`
+	Names          []string `json:"names,omitempty"` // poster names, case-insensitive
+	Trips          []string `json:"trips,omitempty"`
+	IncludeOP      bool     `json:"include_op,omitempty"` // always take posts by the thread author: the opening post and replies with the op flag
+
+	commentInclude []*regexp.Regexp
+	commentExclude []*regexp.Regexp
+}
+
+// Compile prepares the regexps, must be called before Match
+func (r *PostRules) Compile() error {
+	var err error
+	if r.commentInclude, err = compilePatterns(r.CommentInclude); err != nil {
+		return fmt.Errorf("comment_include: %w", err)
+	}
+	if r.commentExclude, err = compilePatterns(r.CommentExclude); err != nil {
+		return fmt.Errorf("comment_exclude: %w", err)
+	}
+	return nil
+}
+
+// Match checks a post, isOpening tells whether it is the opening post of its thread.
+// Returns the reason when the post is rejected.
+func (r *PostRules) Match(post *dvach.Post, isOpening bool) (bool, string) {
+	if r == nil {
+		return true, ""
+	}
+
+	comment := StripHTML(post.Comment)
+	if matchAny(comment, r.commentExclude) {
+		return false, "comment excluded"
+	}
+
+	if len(r.commentInclude) == 0 && len(r.Names) == 0 && len(r.Trips) == 0 && !r.IncludeOP {
+		return true, ""
+	}
+	if r.IncludeOP && (isOpening || post.OP) {
+		return true, ""
+	}
+	if matchAny(comment, r.commentInclude) {
+		return true, ""
+	}
+	name := strings.TrimSpace(StripHTML(post.Name))
+	for _, n := range r.Names {
+		if strings.EqualFold(name, n) {
+			return true, ""
+		}
+	}
+	trip := post.Trip
+	for _, t := range r.Trips {
+		if trip != "" && trip == t {
+			return true, ""
+		}
+	}
+	return false, "no include rule matched"
+}
+
+var (
+	htmlBreakRegexp = regexp.MustCompile(`(?i)<br\s*/?>`)
+	htmlTagRegexp   = regexp.MustCompile(`<[^>]*>`)
+)
+
+// StripHTML turns 2ch comment markup into plain text
+func StripHTML(s string) string {
+	s = htmlBreakRegexp.ReplaceAllString(s, "\n")
+	s = htmlTagRegexp.ReplaceAllString(s, "")
+	return html.UnescapeString(s)
+}
+
+func compilePatterns(patterns []string) ([]*regexp.Regexp, error) {
+	compiled := make([]*regexp.Regexp, 0, len(patterns))
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		compiled = append(compiled, re)
+	}
+	return compiled, nil
+}
+
+func matchAny(s string, patterns []*regexp.Regexp) bool {
+	for _, re := range patterns {
+		if re.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
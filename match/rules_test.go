@@ -0,0 +1,108 @@
+package match
+
+import (
+	"testing"
+
+	"github.com/alekxeyuk/makaba-downloader/dvach"
+)
+
+func TestThread(t *testing.T) {
+	op := &dvach.Post{Subject: "WEBM-тред", Comment: "Постим <b>котов</b>", Tags: "webm"}
+	tests := []struct {
+		include, ignored []string
+		want             bool
+	}{
+		{[]string{"webm"}, nil, true},
+		{[]string{"котов"}, nil, true},
+		{[]string{"music"}, nil, false},
+		{[]string{"webm"}, []string{"КОТОВ"}, false},
+	}
+	for _, tt := range tests {
+		if got := Thread(op, tt.include, tt.ignored); got != tt.want {
+			t.Errorf("Thread(%v, %v) = %v, want %v", tt.include, tt.ignored, got, tt.want)
+		}
+	}
+}
+
+func TestExplainThread(t *testing.T) {
+	op := &dvach.Post{Subject: "WEBM-тред", Comment: "Постим <b>котов</b>", Tags: "webm"}
+	tests := []struct {
+		include, ignored []string
+		want             bool
+		reason           string
+	}{
+		{[]string{"котов", "webm"}, nil, true, `"webm" in subject`},
+		{[]string{"котов"}, nil, true, `"котов" in comment`},
+		{[]string{"music"}, nil, false, "no tag in subject, tags or comment"},
+		{[]string{"webm"}, []string{"КОТОВ"}, false, `ignored "КОТОВ" in comment`},
+	}
+	for _, tt := range tests {
+		if got, reason := ExplainThread(op, tt.include, tt.ignored); got != tt.want || reason != tt.reason {
+			t.Errorf("ExplainThread(%v, %v) = %v, %q, want %v, %q", tt.include, tt.ignored, got, reason, tt.want, tt.reason)
+		}
+	}
+}
+
+func TestFileRules(t *testing.T) {
+	rules := &FileRules{MinSizeKB: 100, MaxDurationSeconds: 60, NameExclude: []string{`(?i)\.gif$`}}
+	if err := rules.Compile(); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		file dvach.File
+		want bool
+	}{
+		{dvach.File{Name: "1.webm", FullName: "cat.webm", Size: 2048, DurationSecs: 30}, true},
+		{dvach.File{Name: "1.webm", Size: 50}, false},
+		{dvach.File{Name: "1.webm", Size: 2048, Duration: "00:01:05"}, false},
+		{dvach.File{Name: "1.gif", FullName: "", Size: 2048}, false},
+	}
+	for _, tt := range tests {
+		if got, reason := rules.Match(&tt.file, false); got != tt.want {
+			t.Errorf("Match(%+v) = %v (%s), want %v", tt.file, got, reason, tt.want)
+		}
+	}
+}
+
+func TestPostRules(t *testing.T) {
+	rules := &PostRules{Trips: []string{"!!abc"}, CommentExclude: []string{"спам"}}
+	if err := rules.Compile(); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		post dvach.Post
+		want bool
+	}{
+		{dvach.Post{Trip: "!!abc", Comment: "держи"}, true},
+		{dvach.Post{Trip: "!!abc", Comment: "<b>спам</b>"}, false},
+		{dvach.Post{Comment: "держи"}, false},
+	}
+	for _, tt := range tests {
+		if got, reason := rules.Match(&tt.post, false); got != tt.want {
+			t.Errorf("Match(%+v) = %v (%s), want %v", tt.post, got, reason, tt.want)
+		}
+	}
+}
+
+func TestPostRulesIncludeOP(t *testing.T) {
+	rules := &PostRules{IncludeOP: true, CommentExclude: []string{"спам"}}
+	if err := rules.Compile(); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name      string
+		post      dvach.Post
+		isOpening bool
+		want      bool
+	}{
+		{"opening post", dvach.Post{}, true, true},
+		{"reply by the author", dvach.Post{OP: true}, false, true},
+		{"other reply", dvach.Post{}, false, false},
+		{"excluded author reply", dvach.Post{OP: true, Comment: "спам"}, false, false},
+	}
+	for _, tt := range tests {
+		if got, reason := rules.Match(&tt.post, tt.isOpening); got != tt.want {
+			t.Errorf("%s: Match = %v (%s), want %v", tt.name, got, reason, tt.want)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package match
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/alekxeyuk/makaba-downloader/dvach"
+)
+
+// Thread reports whether the opening post of a catalog thread mentions any of the include
+// substrings in its comment, tags or subject and none of the ignored ones, case-insensitively
+func Thread(op *dvach.Post, include, ignored []string) bool {
+	ok, _ := ExplainThread(op, include, ignored)
+	return ok
+}
+
+// ExplainThread is Thread with the reason of the verdict, e.g. `"webm" in subject`
+func ExplainThread(op *dvach.Post, include, ignored []string) (bool, string) {
+	fields := []struct{ name, text string }{
+		{"subject", op.Subject},
+		{"tags", op.Tags},
+		{"comment", op.Comment},
+	}
+	for _, f := range fields {
+		if s, ok := firstContained(f.text, ignored); ok {
+			return false, fmt.Sprintf("ignored %q in %s", s, f.name)
+		}
+	}
+	for _, f := range fields {
+		if s, ok := firstContained(f.text, include); ok {
+			return true, fmt.Sprintf("%q in %s", s, f.name)
+		}
+	}
+	return false, "no tag in subject, tags or comment"
+}
+
+// firstContained returns the first of the substrings s contains, case-insensitively
+func firstContained(s string, substrings []string) (string, bool) {
+	s = strings.ToLower(s)
+	for _, substring := range substrings {
+		if strings.Contains(s, strings.ToLower(substring)) {
+			return substring, true
+		}
+	}
+	return "", false
+}
+
+// ContainsAny reports whether s contains any of the substrings, case-insensitively
+func ContainsAny(s string, substrings []string) bool {
+	for _, substring := range substrings {
+		if strings.Contains(strings.ToLower(s), strings.ToLower(substring)) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,262 @@
+// Package monitor polls board catalogs for threads matching the configured tags
+// and queues their files on a downloader
+package monitor
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/alekxeyuk/makaba-downloader/download"
+	"github.com/alekxeyuk/makaba-downloader/dvach"
+	"github.com/alekxeyuk/makaba-downloader/match"
+	"github.com/alekxeyuk/makaba-downloader/notify"
+	"github.com/alekxeyuk/makaba-downloader/proxy"
+	"github.com/alekxeyuk/makaba-downloader/store"
+)
+
+// Defaults apply to boards that leave a setting unset
+type Defaults struct {
+	ThreadSubjSubstrings []string               `json:"thread_subj_substrings"`
+	FileExtensions       []string               `json:"file_extensions"`
+	IgnoredSubstrings    []string               `json:"ignored_substrings"`
+	FileRules            *match.FileRules       `json:"file_rules,omitempty"`
+	PostRules            *match.PostRules       `json:"post_rules,omitempty"`
+	PathTemplate         string                 `json:"path_template,omitempty"`
+	Metadata             *store.MetadataOptions `json:"metadata,omitempty"`
+	MediaMode            string                 `json:"media_mode,omitempty"`
+	ThumbnailTemplate    string                 `json:"thumbnail_template,omitempty"`
+	PreviewRules         *match.FileRules       `json:"preview_rules,omitempty"`
+	QuotaGB              float64                `json:"quota_gb,omitempty"`
+	Retention            *RetentionRules        `json:"retention,omitempty"`
+}
+
+// What a board downloads for each file
+const (
+	MediaModeFull      = "full"      // download the media files
+	MediaModeThumbnail = "thumbnail" // download only thumbnails
+	MediaModePreview   = "preview"   // download thumbnails, then the media of files passing the preview rules
+)
+
+// BoardConfig configures a watched board
+type BoardConfig struct {
+	Board                string   `json:"board"`
+	DirName              string   `json:"dir_name"`
+	ThreadSubjSubstrings []string `json:"thread_subj_substrings,omitempty"`
+	FileExtensions       []string `json:"file_extensions,omitempty"`
+	IgnoredSubstrings    []string `json:"ignored_substrings,omitempty"`
+	// FileRules filter files before they are queued, replaces the default rules as a whole
+	FileRules *match.FileRules `json:"file_rules,omitempty"`
+	// PostRules filter posts before their files are looked at, replaces the default rules as a whole
+	PostRules *match.PostRules `json:"post_rules,omitempty"`
+	// PathTemplate lays out downloaded files relative to DirName, see PathTemplate for the fields
+	PathTemplate string `json:"path_template,omitempty"`
+	// Metadata controls sidecars, xattrs and mtimes of downloaded files
+	Metadata *store.MetadataOptions `json:"metadata,omitempty"`
+	// MediaMode is one of MediaModeFull, MediaModeThumbnail or MediaModePreview
+	MediaMode string `json:"media_mode,omitempty"`
+	// ThumbnailTemplate lays out thumbnails like PathTemplate does for media
+	ThumbnailTemplate string `json:"thumbnail_template,omitempty"`
+	// PreviewRules select the files whose full media is downloaded in preview mode,
+	// they are checked against the file fields of the API when the thread is read
+	PreviewRules *match.FileRules `json:"preview_rules,omitempty"`
+	// QuotaGB stops queuing new files for the board once its directory grows over it
+	QuotaGB float64 `json:"quota_gb,omitempty"`
+	// Retention deletes old thread directories after every pass
+	Retention *RetentionRules `json:"retention,omitempty"`
+	// Proxy routes the requests of the board ahead of the global proxy routes, host and board are ignored
+	Proxy *proxy.Route `json:"proxy,omitempty"`
+
+	pathTemplate      *PathTemplate
+	thumbnailTemplate *PathTemplate
+}
+
+// Config is the whole config.json
+type Config struct {
+	Defaults    Defaults      `json:"defaults"`
+	Boards      []BoardConfig `json:"boards"`
+	Tags        []string      `json:"tags"`
+	IgnoredTags []string      `json:"ignored_tags"`
+	// UsercodeAuth and Passcode may be given as "env:NAME" or "file:PATH", as may the other secrets
+	UsercodeAuth string `json:"usercode_auth"`
+	// Passcode is exchanged for usercode_auth on startup and whenever it is rejected or expires
+	Passcode string `json:"passcode,omitempty"`
+	// MaxDownloadAttempts is the number of passes a failing file is retried in before it is given up
+	MaxDownloadAttempts int `json:"max_download_attempts,omitempty"`
+	// PHash enables near-duplicate detection of downloaded images
+	PHash *download.PHashConfig `json:"phash,omitempty"`
+	// Disk guards free space, quotas and retention rules run in dry-run mode if set there
+	Disk *download.DiskConfig `json:"disk,omitempty"`
+	// Storage selects where files are saved, the working directory if unset
+	Storage *store.Config `json:"storage,omitempty"`
+	// Hooks run after every downloaded file and thread pass
+	Hooks []download.HookConfig `json:"hooks,omitempty"`
+	// MaxConcurrentHooks limits how many hooks run at once, default 2
+	MaxConcurrentHooks int `json:"max_concurrent_hooks,omitempty"`
+	// Notifications alert about new threads, failing boards and rejected auth
+	Notifications *notify.Config `json:"notifications,omitempty"`
+	// Proxy routes requests through proxies by mirror and board, API and media separately
+	Proxy *proxy.Config `json:"proxy,omitempty"`
+	// Watch lists threads polled every pass whether or not they match the tags
+	Watch []WatchEntry `json:"watch,omitempty"`
+	// Transport sets timeouts, connection limits and the User-Agent of all requests
+	Transport *dvach.TransportConfig `json:"transport,omitempty"`
+}
+
+// LoadConfig reads the configuration, applies defaults to boards and compiles their rules
+func LoadConfig(filename string) (*Config, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var config Config
+	decoder := json.NewDecoder(file)
+	err = decoder.Decode(&config)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := resolveSecrets(&config); err != nil {
+		return nil, err
+	}
+
+	if config.MaxDownloadAttempts <= 0 {
+		config.MaxDownloadAttempts = 5
+	}
+	if config.PHash != nil {
+		switch config.PHash.Action {
+		case "", download.PHashActionFlag, download.PHashActionLink, download.PHashActionDelete, download.PHashActionSkip:
+		default:
+			return nil, fmt.Errorf("phash: unknown action %q", config.PHash.Action)
+		}
+	}
+
+	// Apply defaults to boards that don't have custom settings
+	for i := range config.Boards {
+		if len(config.Boards[i].ThreadSubjSubstrings) == 0 {
+			config.Boards[i].ThreadSubjSubstrings = config.Defaults.ThreadSubjSubstrings
+		}
+		if len(config.Boards[i].FileExtensions) == 0 {
+			config.Boards[i].FileExtensions = config.Defaults.FileExtensions
+		}
+		if len(config.Boards[i].IgnoredSubstrings) == 0 {
+			config.Boards[i].IgnoredSubstrings = config.Defaults.IgnoredSubstrings
+		}
+		if config.Boards[i].FileRules == nil {
+			config.Boards[i].FileRules = config.Defaults.FileRules
+		}
+		if config.Boards[i].PostRules == nil {
+			config.Boards[i].PostRules = config.Defaults.PostRules
+		}
+		if config.Boards[i].Metadata == nil {
+			config.Boards[i].Metadata = config.Defaults.Metadata
+		}
+		if config.Boards[i].PathTemplate == "" {
+			config.Boards[i].PathTemplate = config.Defaults.PathTemplate
+		}
+		config.Boards[i].pathTemplate, err = ParsePathTemplate(config.Boards[i].PathTemplate)
+		if err != nil {
+			return nil, fmt.Errorf("board %s: %w", config.Boards[i].Board, err)
+		}
+		if config.Boards[i].MediaMode == "" {
+			config.Boards[i].MediaMode = config.Defaults.MediaMode
+		}
+		switch config.Boards[i].MediaMode {
+		case "":
+			config.Boards[i].MediaMode = MediaModeFull
+		case MediaModeFull, MediaModeThumbnail, MediaModePreview:
+		default:
+			return nil, fmt.Errorf("board %s: unknown media_mode %q", config.Boards[i].Board, config.Boards[i].MediaMode)
+		}
+		if config.Boards[i].ThumbnailTemplate == "" {
+			config.Boards[i].ThumbnailTemplate = config.Defaults.ThumbnailTemplate
+		}
+		if config.Boards[i].ThumbnailTemplate == "" {
+			config.Boards[i].ThumbnailTemplate = defaultThumbnailTemplate
+		}
+		config.Boards[i].thumbnailTemplate, err = ParsePathTemplate(config.Boards[i].ThumbnailTemplate)
+		if err != nil {
+			return nil, fmt.Errorf("board %s thumbnail_template: %w", config.Boards[i].Board, err)
+		}
+		if config.Boards[i].thumbnailTemplate.namesStartWithMD5() {
+			return nil, fmt.Errorf("board %s: thumbnail_template %q must not start file names with {md5}, thumbnails would count as downloaded media",
+				config.Boards[i].Board, config.Boards[i].ThumbnailTemplate)
+		}
+		if config.Boards[i].PreviewRules == nil {
+			config.Boards[i].PreviewRules = config.Defaults.PreviewRules
+		}
+		if config.Boards[i].QuotaGB == 0 {
+			config.Boards[i].QuotaGB = config.Defaults.QuotaGB
+		}
+		if config.Boards[i].Retention == nil {
+			config.Boards[i].Retention = config.Defaults.Retention
+		}
+	}
+
+	// Compile rules once, boards may share the default ones
+	if config.Defaults.FileRules != nil {
+		if err := config.Defaults.FileRules.Compile(); err != nil {
+			return nil, fmt.Errorf("defaults file_rules: %w", err)
+		}
+	}
+	if config.Defaults.PreviewRules != nil {
+		if err := config.Defaults.PreviewRules.Compile(); err != nil {
+			return nil, fmt.Errorf("defaults preview_rules: %w", err)
+		}
+	}
+	if config.Defaults.PostRules != nil {
+		if err := config.Defaults.PostRules.Compile(); err != nil {
+			return nil, fmt.Errorf("defaults post_rules: %w", err)
+		}
+	}
+	for _, board := range config.Boards {
+		if board.FileRules != nil && board.FileRules != config.Defaults.FileRules {
+			if err := board.FileRules.Compile(); err != nil {
+				return nil, fmt.Errorf("board %s file_rules: %w", board.Board, err)
+			}
+		}
+		if board.PreviewRules != nil && board.PreviewRules != config.Defaults.PreviewRules {
+			if err := board.PreviewRules.Compile(); err != nil {
+				return nil, fmt.Errorf("board %s preview_rules: %w", board.Board, err)
+			}
+		}
+		if board.PostRules != nil && board.PostRules != config.Defaults.PostRules {
+			if err := board.PostRules.Compile(); err != nil {
+				return nil, fmt.Errorf("board %s post_rules: %w", board.Board, err)
+			}
+		}
+	}
+
+	return &config, nil
+}
+
+// ProxyConfig returns the proxy routes of the boards followed by the global ones, nil if there are none
+func (c *Config) ProxyConfig() *proxy.Config {
+	var config proxy.Config
+	if c.Proxy != nil {
+		config = *c.Proxy
+	}
+	var routes []proxy.Route
+	for _, board := range c.Boards {
+		if board.Proxy != nil {
+			routes = append(routes, proxy.Route{Board: board.Board, API: board.Proxy.API, Media: board.Proxy.Media})
+		}
+	}
+	config.Routes = append(routes, config.Routes...)
+	if len(config.Routes) == 0 {
+		return nil
+	}
+	return &config
+}
+
+// Board returns the configuration of a board by its id
+func (c *Config) Board(board string) (BoardConfig, bool) {
+	for _, conf := range c.Boards {
+		if conf.Board == board {
+			return conf, true
+		}
+	}
+	return BoardConfig{}, false
+}
@@ -0,0 +1,42 @@
+package monitor
+
+import (
+	"encoding/json"
+	"os"
+
+	"github.com/alekxeyuk/makaba-downloader/logger"
+)
+
+// LoadLastHits reads the newest seen post of every board
+func LoadLastHits(name string) map[string]int64 {
+	lastHits := make(map[string]int64)
+	file, err := os.Open(name)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Log.Error("Error opening %s: %v", name, err)
+		}
+		return lastHits
+	}
+	defer file.Close()
+
+	err = json.NewDecoder(file).Decode(&lastHits)
+	if err != nil {
+		logger.Log.Error("Error decoding %s: %v", name, err)
+	}
+	return lastHits
+}
+
+// SaveLastHits stores the newest seen post of every board
+func SaveLastHits(name string, lastHits map[string]int64) {
+	file, err := os.Create(name)
+	if err != nil {
+		logger.Log.Error("Error creating %s: %v", name, err)
+		return
+	}
+	defer file.Close()
+
+	err = json.NewEncoder(file).Encode(lastHits)
+	if err != nil {
+		logger.Log.Error("Error encoding %s: %v", name, err)
+	}
+}
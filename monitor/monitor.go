@@ -0,0 +1,474 @@
+package monitor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alekxeyuk/makaba-downloader/download"
+	"github.com/alekxeyuk/makaba-downloader/dvach"
+	"github.com/alekxeyuk/makaba-downloader/logger"
+	"github.com/alekxeyuk/makaba-downloader/match"
+	"github.com/alekxeyuk/makaba-downloader/notify"
+	"github.com/alekxeyuk/makaba-downloader/store"
+)
+
+// Monitor watches the configured boards and queues the files of matching threads
+type Monitor struct {
+	config     *Config
+	api        *dvach.Client
+	downloader *download.Downloader
+	notifier   *notify.Notifier
+	watchlist  *Watchlist
+
+	// quotaLeft is how many more bytes boards with a quota may queue in the current pass, by directory
+	quotaLeft map[string]int64
+}
+
+// Option configures a Monitor
+type Option func(*Monitor)
+
+// WithNotifier sends alerts about new threads, failing boards and rejected auth
+func WithNotifier(notifier *notify.Notifier) Option {
+	return func(m *Monitor) {
+		m.notifier = notifier
+	}
+}
+
+// WithWatchlist polls the threads of a watchlist every pass along with the watch entries of the config
+func WithWatchlist(watchlist *Watchlist) Option {
+	return func(m *Monitor) {
+		m.watchlist = watchlist
+	}
+}
+
+// New creates a monitor queuing files on downloader, config should come from LoadConfig
+func New(config *Config, api *dvach.Client, downloader *download.Downloader, opts ...Option) *Monitor {
+	m := &Monitor{config: config, api: api, downloader: downloader, quotaLeft: make(map[string]int64)}
+	for _, opt := range opts {
+		opt(m)
+	}
+	if m.watchlist == nil {
+		m.watchlist = &Watchlist{}
+	}
+	return m
+}
+
+// RunPass checks every board once and queues new files, it returns early once ctx is cancelled.
+// lastHits maps board_thread keys to the file count seen last time and is updated in place.
+func (m *Monitor) RunPass(ctx context.Context, lastHits map[string]int64) {
+	// Quotas are measured again in the next pass, when the queued files are on disk
+	defer clear(m.quotaLeft)
+	for _, conf := range m.config.Boards {
+		if ctx.Err() != nil {
+			return
+		}
+		err := m.processBoard(ctx, conf, lastHits)
+		if err != nil {
+			continue
+		}
+	}
+	m.processWatched(ctx, lastHits)
+}
+
+// processWatched polls the watched threads that have new files, the ones that 404 are no longer watched
+func (m *Monitor) processWatched(ctx context.Context, lastHits map[string]int64) {
+	knownFiles := make(map[string]map[string]struct{}) // by board directory
+	for _, entry := range m.watchlist.active(m.config.Watch, time.Now()) {
+		if ctx.Err() != nil {
+			return
+		}
+		board, num, _ := parseThreadRef(entry.Thread)
+		conf, ok := m.config.Board(board)
+		if !ok {
+			logger.Log.Error("Board %s of watched thread %s is not configured", board, entry.Thread)
+			continue
+		}
+		if m.outOfQuota(conf) && (m.config.Disk == nil || !m.config.Disk.DryRun) {
+			continue
+		}
+
+		thread, err := m.api.Thread(board, num)
+		var serr *dvach.StatusError
+		if errors.As(err, &serr) && serr.Code == http.StatusNotFound {
+			logger.Log.Info("Watched thread %s is gone, no longer watching it", entry.Thread)
+			m.watchlist.remove(entry.Thread)
+			continue
+		}
+		if err != nil {
+			logger.Log.Error("Error getting watched thread %s: %v", entry.Thread, err)
+			continue
+		}
+
+		// Nothing new since the board pass or an earlier pass over the watchlist
+		key := board + "_" + strconv.FormatInt(thread.Num, 10)
+		if stored, ok := lastHits[key]; ok && thread.FilesCount <= stored {
+			continue
+		}
+		if knownFiles[conf.DirName] == nil {
+			knownFiles[conf.DirName] = store.KnownFiles(m.downloader.Storage(), conf.DirName)
+		}
+		threadInfo := ThreadInfo{Thread: thread, Board: board, Num: thread.Num, LastHit: thread.FilesCount}
+		m.processThread(ctx, conf, threadInfo, board, knownFiles[conf.DirName], lastHits)
+	}
+}
+
+// processBoard processes a single board configuration
+func (m *Monitor) processBoard(ctx context.Context, conf BoardConfig, lastHits map[string]int64) error {
+	catalog, err := m.api.Catalog(conf.Board)
+	if err != nil {
+		logger.Log.Error("Error getting catalog for %s: %v", conf.Board, err)
+		if dvach.IsAuthError(err) && (m.config.UsercodeAuth != "" || m.config.Passcode != "") {
+			m.notifier.Notify(notify.Notification{
+				Kind:  notify.EventAuth,
+				Key:   notify.EventAuth,
+				Title: "2ch auth was rejected",
+				Text:  fmt.Sprintf("Getting the /%s/ catalog failed: %v", conf.Board, err),
+				Board: conf.Board,
+			})
+		}
+		m.notifier.BoardFailed(conf.Board, err)
+		return err
+	}
+	m.notifier.BoardOK(conf.Board)
+
+	dryRun := m.config.Disk != nil && m.config.Disk.DryRun
+	applyRetention(m.downloader.Storage(), conf, liveThreadDirs(conf, catalog), dryRun)
+	if !m.startQuota(conf) {
+		if !dryRun {
+			logger.Log.Warning("%s - Over the %.1f GB quota, not queuing new files", conf.DirName, conf.QuotaGB)
+			return nil
+		}
+		logger.Log.Warning("%s - Dry run: over the %.1f GB quota, new files would not be queued", conf.DirName, conf.QuotaGB)
+	}
+
+	alreadyHaveFiles := store.KnownFiles(m.downloader.Storage(), conf.DirName)
+
+	boardID := catalog.Board.ID
+	// Every thread is new on the first pass over a board, don't announce them all
+	firstPass := !hasBoardHits(lastHits, boardID)
+
+	threads, count := getThreads(m.api, catalog, m.config.Tags, m.config.IgnoredTags, lastHits)
+	if len(threads) == 0 {
+		logger.Log.Warning("%s - No interesting threads found out of %d", conf.DirName, count)
+		return nil
+	}
+
+	for _, threadInfo := range threads {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		if threadInfo.New && !firstPass {
+			m.notifyNewThread(threadInfo)
+		}
+
+		err := m.processThread(ctx, conf, threadInfo, boardID, alreadyHaveFiles, lastHits)
+		if err != nil {
+			continue
+		}
+	}
+
+	return nil
+}
+
+// hasBoardHits reports whether threads of a board were seen in earlier passes
+func hasBoardHits(lastHits map[string]int64, boardID string) bool {
+	for key := range lastHits {
+		if strings.HasPrefix(key, boardID+"_") {
+			return true
+		}
+	}
+	return false
+}
+
+// notifyNewThread announces a new thread matching the tags
+func (m *Monitor) notifyNewThread(threadInfo ThreadInfo) {
+	subject := match.StripHTML(threadInfo.Thread.Subject())
+	m.notifier.Notify(notify.Notification{
+		Kind:   notify.EventNewThread,
+		Key:    fmt.Sprintf("%s:%s/%d", notify.EventNewThread, threadInfo.Board, threadInfo.Num),
+		Title:  fmt.Sprintf("New thread in /%s/: %s", threadInfo.Board, subject),
+		Text:   fmt.Sprintf("%d files", threadInfo.LastHit),
+		Board:  threadInfo.Board,
+		Thread: threadInfo.Num,
+		URL:    m.api.ThreadURL(threadInfo.Board, threadInfo.Num),
+	})
+}
+
+// ProcessThreads downloads threads given as board/number ahead of the catalog,
+// their boards must be configured
+func (m *Monitor) ProcessThreads(ctx context.Context, refs []string, lastHits map[string]int64) {
+	for _, ref := range refs {
+		if ctx.Err() != nil {
+			return
+		}
+
+		board, num, err := parseThreadRef(ref)
+		if err != nil {
+			logger.Log.Error("%v", err)
+			continue
+		}
+		conf, ok := m.config.Board(board)
+		if !ok {
+			logger.Log.Error("Board %s from %q is not configured", board, ref)
+			continue
+		}
+
+		thread, err := m.api.Thread(board, num)
+		if err != nil {
+			logger.Log.Error("Error getting thread %s: %v", ref, err)
+			continue
+		}
+		threadInfo := ThreadInfo{
+			Thread:  thread,
+			Board:   board,
+			Num:     thread.Num,
+			LastHit: thread.FilesCount,
+			Manual:  true,
+		}
+		alreadyHaveFiles := store.KnownFiles(m.downloader.Storage(), conf.DirName)
+		m.processThread(ctx, conf, threadInfo, board, alreadyHaveFiles, lastHits)
+	}
+}
+
+// processThread processes a single thread and downloads its files
+func (m *Monitor) processThread(ctx context.Context, conf BoardConfig, threadInfo ThreadInfo, boardID string, alreadyHaveFiles map[string]struct{}, lastHits map[string]int64) error {
+	queued := m.processThreadFiles(ctx, conf, threadInfo, alreadyHaveFiles)
+	m.downloader.Hooks().Fire(download.HookEvent{Type: download.HookEventThread, Board: threadInfo.Board, Thread: threadInfo.Num, Queued: queued})
+
+	// Update last hit for this thread
+	key := boardID + "_" + strconv.FormatInt(threadInfo.Thread.Num, 10)
+	lastHits[key] = threadInfo.LastHit
+
+	return nil
+}
+
+// processThreadFiles processes all files in a thread, returns the number of queued downloads
+func (m *Monitor) processThreadFiles(ctx context.Context, conf BoardConfig, threadInfo ThreadInfo, alreadyHaveFiles map[string]struct{}) int {
+	queued := 0
+	subject := threadInfo.Thread.Subject()
+	for i := range threadInfo.Thread.Posts {
+		post := &threadInfo.Thread.Posts[i]
+		isOP := post.IsOpening(threadInfo.Num)
+		if ok, reason := conf.PostRules.Match(post, isOP); !ok {
+			logger.Log.Trace("Skipping post %d: %s", post.Num, reason)
+			continue
+		}
+		fields := FileFields{
+			Board:   threadInfo.Board,
+			Thread:  threadInfo.Num,
+			Subject: subject,
+			Post:    post.Num,
+			Date:    time.Unix(post.Timestamp, 0),
+		}
+		for i := range post.Files {
+			if ctx.Err() != nil {
+				return queued
+			}
+
+			fields.Index = i + 1
+			queued += m.processFile(conf, threadInfo, &post.Files[i], isOP, fields, alreadyHaveFiles)
+		}
+	}
+	return queued
+}
+
+// processFile processes a single file from a post, returns the number of queued downloads
+func (m *Monitor) processFile(conf BoardConfig, threadInfo ThreadInfo, postFile *dvach.File, isOP bool, fields FileFields, alreadyHaveFiles map[string]struct{}) int {
+	md5 := postFile.MD5
+
+	// Decide what to download for this file depending on the board media mode
+	wantFull := conf.MediaMode != MediaModeThumbnail
+	wantThumb := conf.MediaMode == MediaModeThumbnail || conf.MediaMode == MediaModePreview
+
+	// Check if we already have this file
+	if _, ok := alreadyHaveFiles[md5]; ok {
+		wantFull = false
+	}
+	if _, ok := alreadyHaveFiles[store.ThumbnailKey(md5)]; ok {
+		wantThumb = false
+	}
+	if !wantFull && !wantThumb {
+		return 0
+	}
+
+	// Check if file extension is valid
+	if !isValidFileExtension(postFile, conf.FileExtensions) {
+		logger.Log.Info("Unknown file format: %s", postFile.Path)
+		return 0
+	}
+
+	fileURL := m.api.BaseURL() + postFile.Path
+
+	// Skip stickers
+	if strings.Contains(fileURL, "stickers") {
+		return 0
+	}
+
+	// Check per-board file rules
+	if ok, reason := conf.FileRules.Match(postFile, isOP); !ok {
+		logger.Log.Trace("Skipping %s: %s", fileURL, reason)
+		return 0
+	}
+
+	// In preview mode only files passing the preview rules get their full media
+	if wantFull && conf.MediaMode == MediaModePreview {
+		if ok, reason := conf.PreviewRules.Match(postFile, isOP); !ok {
+			logger.Log.Trace("Only previewing %s: %s", fileURL, reason)
+			wantFull = false
+		}
+	}
+
+	var full *download.Job
+	if wantFull {
+		job, err := m.newJob(conf, conf.pathTemplate, threadInfo, postFile, fields, md5, postFile.Path, false)
+		if err != nil {
+			logger.Log.Error("Error generating filename for %s: %v", fileURL, err)
+			wantFull = false
+		} else {
+			full = &job
+		}
+	}
+
+	queued := 0
+	if wantThumb {
+		thumbPath := postFile.Thumbnail
+		if thumbPath == "" {
+			logger.Log.Trace("No thumbnail for %s", fileURL)
+		} else if thumb, err := m.newJob(conf, conf.thumbnailTemplate, threadInfo, postFile, fields, md5, thumbPath, true); err != nil {
+			logger.Log.Error("Error generating filename for %s: %v", m.api.BaseURL()+thumbPath, err)
+		} else {
+			// In preview mode the full media is only queued once its thumbnail is done
+			if full != nil && conf.MediaMode == MediaModePreview {
+				thumb.Next, full = full, nil
+			}
+			if m.enqueue(thumb) {
+				queued++
+			}
+			alreadyHaveFiles[store.ThumbnailKey(md5)] = struct{}{}
+		}
+	}
+	if full != nil && m.enqueue(*full) {
+		queued++
+	}
+	if wantFull {
+		alreadyHaveFiles[md5] = struct{}{}
+	}
+	return queued
+}
+
+// newJob builds the download job of a file or its thumbnail from the given server path
+func (m *Monitor) newJob(conf BoardConfig, tmpl *PathTemplate, threadInfo ThreadInfo, postFile *dvach.File, fields FileFields, md5, srcPath string, thumbnail bool) (download.Job, error) {
+	fileURL := m.api.BaseURL() + srcPath
+
+	// Generate filename
+	fileName, err := generateFileName(conf, tmpl, postFile, fields, md5, srcPath)
+	if err != nil {
+		return download.Job{}, err
+	}
+
+	job := download.Job{
+		URL:       fileURL,
+		Path:      fileName,
+		Root:      conf.DirName,
+		MD5:       md5,
+		Thumbnail: thumbnail,
+		Board:     threadInfo.Board,
+		Thread:    threadInfo.Num,
+		Manual:    threadInfo.Manual,
+	}
+	// Thumbnail sizes are unknown, they are tiny and go first anyway
+	if !thumbnail {
+		job.Size = postFile.Size * 1024 // size is in KB
+	}
+	if conf.Metadata != nil {
+		job.MetaOptions = *conf.Metadata
+		job.Meta = &store.FileMeta{
+			Board:        fields.Board,
+			Thread:       fields.Thread,
+			ThreadURL:    m.api.ThreadURL(fields.Board, fields.Thread),
+			Post:         fields.Post,
+			Date:         fields.Date,
+			Subject:      match.StripHTML(fields.Subject),
+			OriginalName: postFile.FullName,
+			MD5:          md5,
+			URL:          fileURL,
+		}
+	}
+	return job, nil
+}
+
+// enqueue queues a job unless it failed before and isn't due or its board is out of quota,
+// returns whether a new job was queued
+func (m *Monitor) enqueue(job download.Job) bool {
+	// Failed files are retried on their own schedule, dead ones never
+	if m.downloader.Blocked(job) {
+		return false
+	}
+	left, limited := m.quotaLeft[job.Root]
+	size := job.Size
+	if job.Next != nil {
+		size += job.Next.Size
+	}
+	if limited && size > left {
+		if m.config.Disk == nil || !m.config.Disk.DryRun {
+			logger.Log.Trace("%s - Not queuing %s, it doesn't fit the quota", job.Root, job.URL)
+			return false
+		}
+		logger.Log.Info("Dry run: %s doesn't fit the quota of %s and would not be queued", job.URL, job.Root)
+	}
+	if !m.downloader.Enqueue(job) {
+		return false
+	}
+	if limited {
+		m.quotaLeft[job.Root] = left - size
+	}
+	return true
+}
+
+// outOfQuota reports whether a board has used up its quota in this pass, measuring it the first time
+func (m *Monitor) outOfQuota(conf BoardConfig) bool {
+	if left, ok := m.quotaLeft[conf.DirName]; ok {
+		return left < 0
+	}
+	return !m.startQuota(conf)
+}
+
+// startQuota measures how much a board with a quota may queue in this pass,
+// returns false if it is already over its quota
+func (m *Monitor) startQuota(conf BoardConfig) bool {
+	left, ok := quotaLeft(m.downloader.Storage(), conf)
+	if !ok {
+		delete(m.quotaLeft, conf.DirName)
+		return true
+	}
+	m.quotaLeft[conf.DirName] = left
+	return left >= 0
+}
+
+// generateFileName generates a filename for a file from a board path template,
+// srcPath is the server path of the file or its thumbnail
+func generateFileName(conf BoardConfig, tmpl *PathTemplate, postFile *dvach.File, fields FileFields, md5, srcPath string) (string, error) {
+	fullname := postFile.FullName
+
+	// The real extension comes from the server path, the original name may have none or a wrong one
+	ext := filepath.Ext(srcPath)
+	fields.MD5 = md5
+	fields.Name = strings.TrimSuffix(fullname, filepath.Ext(fullname))
+	fields.Ext = strings.TrimPrefix(ext, ".")
+
+	// Keep the beginning of long names, leaving room for the md5 and extension
+	const maxNameBytes = 128
+	fields.Name = store.TruncateUTF8(fields.Name, maxNameBytes)
+
+	if tmpl == nil {
+		tmpl, _ = ParsePathTemplate(defaultPathTemplate)
+	}
+	return store.SafeJoin(conf.DirName, tmpl.Render(fields))
+}
@@ -0,0 +1,370 @@
+package monitor
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alekxeyuk/makaba-downloader/download"
+	"github.com/alekxeyuk/makaba-downloader/dvach"
+	"github.com/alekxeyuk/makaba-downloader/dvach/dvachtest"
+)
+
+const (
+	webmPath  = "/b/src/100/1760000001.webm"
+	jpgPath   = "/b/src/100/1760000002.jpg"
+	replyPath = "/b/src/100/1760000003.webm"
+)
+
+// testEnv is a monitor wired to a fake 2ch serving a copy of testdata/2ch
+type testEnv struct {
+	srv        *dvachtest.Server
+	fixtures   string // served directory, may be changed by tests
+	out        string // board directory downloads go to
+	monitor    *Monitor
+	downloader *download.Downloader
+}
+
+func newTestEnv(t *testing.T, opts ...download.Option) *testEnv {
+	t.Helper()
+	return newTestEnvBoard(t, "", opts...)
+}
+
+// newTestEnvBoard is newTestEnv with extra fields for the board config, e.g. `"media_mode": "preview"`
+func newTestEnvBoard(t *testing.T, boardFields string, opts ...download.Option) *testEnv {
+	t.Helper()
+	fixtures := filepath.Join(t.TempDir(), "2ch")
+	if err := os.CopyFS(fixtures, os.DirFS("testdata/2ch")); err != nil {
+		t.Fatal(err)
+	}
+	srv := dvachtest.NewServer(fixtures)
+	t.Cleanup(srv.Close)
+
+	out := filepath.Join(t.TempDir(), "b")
+	configFile := filepath.Join(t.TempDir(), "config.json")
+	config := fmt.Sprintf(`{
+		"defaults": {"file_extensions": ["webm", "jpg"]},
+		"boards": [{"board": "b", "dir_name": %q%s}],
+		"tags": ["webm"]
+	}`, out, boardFields)
+	if err := os.WriteFile(configFile, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	conf, err := LoadConfig(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	api := dvach.NewClient(dvach.WithBaseURL(srv.URL))
+	downloader := download.New(api.HTTPClient(), append([]download.Option{download.WithWorkers(2)}, opts...)...)
+	t.Cleanup(downloader.Stop)
+
+	return &testEnv{
+		srv:        srv,
+		fixtures:   fixtures,
+		out:        out,
+		monitor:    New(conf, api, downloader),
+		downloader: downloader,
+	}
+}
+
+// pass runs a full pass and waits for its downloads
+func (e *testEnv) pass(lastHits map[string]int64) {
+	e.monitor.RunPass(context.Background(), lastHits)
+	e.downloader.Wait()
+}
+
+// checkDownloaded compares a downloaded file with the fixture it came from
+func (e *testEnv) checkDownloaded(t *testing.T, rel, srcPath string) {
+	t.Helper()
+	got, err := os.ReadFile(filepath.Join(e.out, rel))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := os.ReadFile(filepath.Join(e.fixtures, srcPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("%s: got %d bytes, want %d bytes of %s", rel, len(got), len(want), srcPath)
+	}
+}
+
+func checkMissing(t *testing.T, path string) {
+	t.Helper()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("%s exists: %v", path, err)
+	}
+}
+
+func TestRunPass(t *testing.T) {
+	env := newTestEnv(t)
+	lastHits := make(map[string]int64)
+	env.pass(lastHits)
+
+	env.checkDownloaded(t, "100/cae673ad7a5278f7f94150174e8a3121_cat.webm", webmPath)
+	env.checkDownloaded(t, "100/aeefa0738d2bf9c3eeaf17b8c42fd6f8_photo.jpg", jpgPath)
+	if got := lastHits["b_100"]; got != 2 {
+		t.Errorf("lasthit of b_100 = %d, want 2", got)
+	}
+	// The music thread doesn't match the tags
+	if n := env.srv.Requests("/b/res/200.json"); n != 0 {
+		t.Errorf("unmatched thread was fetched %d times", n)
+	}
+	if _, ok := lastHits["b_200"]; ok {
+		t.Error("unmatched thread has a lasthit")
+	}
+}
+
+func TestRunPassDedup(t *testing.T) {
+	env := newTestEnv(t)
+	lastHits := make(map[string]int64)
+	env.pass(lastHits)
+
+	// Nothing new in the catalog, the thread isn't fetched again
+	env.pass(lastHits)
+	if n := env.srv.Requests("/b/res/100.json"); n != 1 {
+		t.Errorf("thread fetched %d times, want 1", n)
+	}
+
+	// Forgotten lasthits make the thread look new, but its files are known by md5
+	env.pass(make(map[string]int64))
+	if n := env.srv.Requests("/b/res/100.json"); n != 2 {
+		t.Errorf("thread fetched %d times, want 2", n)
+	}
+	for _, p := range []string{webmPath, jpgPath} {
+		if n := env.srv.Requests(p); n != 1 {
+			t.Errorf("%s downloaded %d times, want 1", p, n)
+		}
+	}
+}
+
+func TestRunPassLastHitsUpdate(t *testing.T) {
+	env := newTestEnv(t)
+	lastHits := make(map[string]int64)
+	env.pass(lastHits)
+
+	// A new reply with a file bumps files_count in the catalog
+	addReply(t, env.fixtures)
+	env.pass(lastHits)
+
+	if n := env.srv.Requests("/b/res/100.json"); n != 2 {
+		t.Errorf("thread fetched %d times, want 2", n)
+	}
+	env.checkDownloaded(t, "100/4ac47b5c15fdfdebf21194088ea2b11f_more.webm", replyPath)
+	if n := env.srv.Requests(webmPath); n != 1 {
+		t.Errorf("%s downloaded %d times, want 1", webmPath, n)
+	}
+	if got := lastHits["b_100"]; got != 3 {
+		t.Errorf("lasthit of b_100 = %d, want 3", got)
+	}
+}
+
+// addReply appends testdata/reply.json to thread 100 and updates the counters
+func addReply(t *testing.T, fixtures string) {
+	t.Helper()
+	reply, err := os.ReadFile("testdata/reply.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	threadFile := filepath.Join(fixtures, "b/res/100.json")
+	var thread map[string]any
+	readJSON(t, threadFile, &thread)
+	posts := thread["threads"].([]any)[0].(map[string]any)
+	posts["posts"] = append(posts["posts"].([]any), json.RawMessage(reply))
+	thread["files_count"], thread["posts_count"] = 3, 3
+	writeJSON(t, threadFile, thread)
+
+	catalogFile := filepath.Join(fixtures, "b/catalog.json")
+	var catalog map[string]any
+	readJSON(t, catalogFile, &catalog)
+	op := catalog["threads"].([]any)[0].(map[string]any)
+	op["files_count"], op["posts_count"] = 3, 3
+	writeJSON(t, catalogFile, catalog)
+}
+
+func readJSON(t *testing.T, name string, v any) {
+	t.Helper()
+	data, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func writeJSON(t *testing.T, name string, v any) {
+	t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(name, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRunPassResume(t *testing.T) {
+	env := newTestEnv(t)
+	// The first response breaks off, the retry must continue from the partial file
+	env.srv.Inject(dvachtest.Fault{Path: webmPath, Truncate: 2000, Times: 1})
+	env.pass(make(map[string]int64))
+
+	env.checkDownloaded(t, "100/cae673ad7a5278f7f94150174e8a3121_cat.webm", webmPath)
+	if n := env.srv.Requests(webmPath); n != 2 {
+		t.Errorf("%s requested %d times, want 2", webmPath, n)
+	}
+}
+
+func TestRunPassResumeRangeIgnored(t *testing.T) {
+	env := newTestEnv(t)
+	env.srv.Inject(dvachtest.Fault{Path: webmPath, Truncate: 2000, Times: 1})
+	env.srv.Inject(dvachtest.Fault{Path: webmPath, IgnoreRange: true})
+	env.pass(make(map[string]int64))
+
+	env.checkDownloaded(t, "100/cae673ad7a5278f7f94150174e8a3121_cat.webm", webmPath)
+}
+
+func TestRunPassFailures(t *testing.T) {
+	failures := download.LoadFailures(filepath.Join(t.TempDir(), "failures.json"), 3)
+	env := newTestEnv(t, download.WithFailures(failures))
+
+	// A failing catalog queues nothing and remembers nothing
+	env.srv.Inject(dvachtest.Fault{Path: "/b/catalog.json", Status: 503, Times: 1})
+	lastHits := make(map[string]int64)
+	env.pass(lastHits)
+	if len(lastHits) != 0 {
+		t.Errorf("lasthits after a failed catalog: %v", lastHits)
+	}
+
+	// A rate limited thread is skipped and picked up by the next pass
+	env.srv.Inject(dvachtest.Fault{Path: "/b/res/100.json", Status: 429, RetryAfter: 1, Times: 1})
+	env.pass(lastHits)
+	if _, ok := lastHits["b_100"]; ok {
+		t.Error("rate limited thread has a lasthit")
+	}
+
+	// A deleted file is given up, the rest of the thread is still downloaded
+	env.srv.Inject(dvachtest.Fault{Path: jpgPath, Status: 404})
+	env.pass(lastHits)
+	env.checkDownloaded(t, "100/cae673ad7a5278f7f94150174e8a3121_cat.webm", webmPath)
+	checkMissing(t, filepath.Join(env.out, "100/aeefa0738d2bf9c3eeaf17b8c42fd6f8_photo.jpg"))
+	if got := lastHits["b_100"]; got != 2 {
+		t.Errorf("lasthit of b_100 = %d, want 2", got)
+	}
+
+	// Dead files are not queued again even when the thread is
+	env.pass(make(map[string]int64))
+	if n := env.srv.Requests(jpgPath); n != 1 {
+		t.Errorf("%s requested %d times, want 1", jpgPath, n)
+	}
+}
+
+// addWatchedThread serves thread 200, which doesn't match the tags, with the file of testdata/reply.json
+func addWatchedThread(t *testing.T, fixtures string) {
+	t.Helper()
+	var reply map[string]any
+	readJSON(t, "testdata/reply.json", &reply)
+	reply["num"], reply["parent"], reply["op"] = 200, 0, 1
+	thread := map[string]any{
+		"board":          map[string]any{"id": "b"},
+		"current_thread": 200,
+		"files_count":    1,
+		"posts_count":    1,
+		"threads":        []any{map[string]any{"posts": []any{reply}}},
+	}
+	writeJSON(t, filepath.Join(fixtures, "b/res/200.json"), thread)
+}
+
+func TestRunPassWatch(t *testing.T) {
+	env := newTestEnv(t)
+	addWatchedThread(t, env.fixtures)
+	watchlist := LoadWatchlist(filepath.Join(t.TempDir(), "watchlist.json"))
+	if err := watchlist.Add(WatchEntry{Thread: "/b/200/"}); err != nil {
+		t.Fatal(err)
+	}
+	// An expired entry from the config is skipped
+	env.monitor.config.Watch = []WatchEntry{{Thread: "b/300", Until: time.Now().Add(-time.Hour)}}
+	env.monitor.watchlist = watchlist
+
+	lastHits := make(map[string]int64)
+	env.pass(lastHits)
+	env.checkDownloaded(t, "200/4ac47b5c15fdfdebf21194088ea2b11f_more.webm", replyPath)
+	if got := lastHits["b_200"]; got != 1 {
+		t.Errorf("lasthit of b_200 = %d, want 1", got)
+	}
+	if n := env.srv.Requests("/b/res/300.json"); n != 0 {
+		t.Errorf("expired thread fetched %d times", n)
+	}
+
+	// Polled every pass, nothing is queued again
+	env.pass(lastHits)
+	if n := env.srv.Requests("/b/res/200.json"); n != 2 {
+		t.Errorf("watched thread fetched %d times, want 2", n)
+	}
+	if n := env.srv.Requests(replyPath); n != 1 {
+		t.Errorf("%s downloaded %d times, want 1", replyPath, n)
+	}
+
+	// A 404 ends the watch, also for the same thread listed in the config
+	env.monitor.config.Watch = append(env.monitor.config.Watch, WatchEntry{Thread: "b/200"})
+	os.Remove(filepath.Join(env.fixtures, "b/res/200.json"))
+	env.pass(lastHits)
+	env.pass(lastHits)
+	if n := env.srv.Requests("/b/res/200.json"); n != 3 {
+		t.Errorf("gone thread fetched %d times, want 3", n)
+	}
+	watchlist.Save()
+	reloaded := LoadWatchlist(watchlist.name)
+	if len(reloaded.Entries) != 0 || len(reloaded.Gone) != 1 || reloaded.Gone[0] != "b/200" {
+		t.Errorf("watchlist after 404 = %+v", reloaded)
+	}
+}
+
+func TestRunPassPreview(t *testing.T) {
+	const preview = `, "media_mode": "preview", "preview_rules": {"min_width": 1000}`
+	const webmThumb = "/b/thumb/100/1760000001s.jpg"
+
+	env := newTestEnvBoard(t, preview)
+	env.pass(make(map[string]int64))
+	env.checkDownloaded(t, "100/thumbs/thumb_cae673ad7a5278f7f94150174e8a3121.jpg", webmThumb)
+	env.checkDownloaded(t, "100/thumbs/thumb_aeefa0738d2bf9c3eeaf17b8c42fd6f8.jpg", "/b/thumb/100/1760000002s.jpg")
+	env.checkDownloaded(t, "100/cae673ad7a5278f7f94150174e8a3121_cat.webm", webmPath)
+	// Narrower than the preview rules allow
+	checkMissing(t, filepath.Join(env.out, "100", "aeefa0738d2bf9c3eeaf17b8c42fd6f8_photo.jpg"))
+
+	// The full media waits for its thumbnail
+	env = newTestEnvBoard(t, preview)
+	env.srv.Inject(dvachtest.Fault{Path: webmThumb, Status: 404})
+	env.pass(make(map[string]int64))
+	if n := env.srv.Requests(webmPath); n != 0 {
+		t.Errorf("media requested %d times although its thumbnail failed", n)
+	}
+}
+
+func TestLoadConfigThumbnailTemplate(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config.json")
+	config := `{"boards": [{"board": "b", "thumbnail_template": "{thread}/thumbs/{md5}.{ext}"}]}`
+	if err := os.WriteFile(configFile, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadConfig(configFile); err == nil || !strings.Contains(err.Error(), "must not start file names with {md5}") {
+		t.Errorf("LoadConfig = %v, want a thumbnail template starting names with {md5} rejected", err)
+	}
+}
+
+func TestRunPassQuota(t *testing.T) {
+	// Room for the 5 KB webm of the OP but not for the 3 KB jpg after it
+	env := newTestEnvBoard(t, fmt.Sprintf(`, "quota_gb": %g`, 6144.0/bytesPerGB))
+	env.pass(make(map[string]int64))
+	env.checkDownloaded(t, "100/cae673ad7a5278f7f94150174e8a3121_cat.webm", webmPath)
+	checkMissing(t, filepath.Join(env.out, "100", "aeefa0738d2bf9c3eeaf17b8c42fd6f8_photo.jpg"))
+}
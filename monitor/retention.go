@@ -0,0 +1,211 @@
+package monitor
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/alekxeyuk/makaba-downloader/dvach"
+	"github.com/alekxeyuk/makaba-downloader/logger"
+	"github.com/alekxeyuk/makaba-downloader/store"
+)
+
+// bytesPerGB converts quota_gb to bytes
+const bytesPerGB = 1 << 30
+
+// RetentionRules remove old thread directories of a board, zero values disable a rule
+type RetentionRules struct {
+	MaxAgeDays  int  `json:"max_age_days,omitempty"` // delete threads that got no new file for this many days
+	KeepThreads int  `json:"keep_threads,omitempty"` // keep only this many threads with the most recent downloads
+	EvictLRU    bool `json:"evict_lru,omitempty"`    // delete threads with the oldest downloads while the board is over quota_gb
+}
+
+// threadDir is a directory holding the files of one thread
+type threadDir struct {
+	path    string
+	size    int64
+	modTime time.Time // of the most recently downloaded or modified file
+}
+
+// applyRetention deletes thread directories of a board according to its retention rules.
+// Directories in live belong to threads still in the catalog and are kept, deleting them
+// would only have their files downloaded again with the next post.
+func applyRetention(storage store.Storage, conf BoardConfig, live map[string]bool, dryRun bool) {
+	rules := conf.Retention
+	if rules == nil || rules.MaxAgeDays <= 0 && rules.KeepThreads <= 0 && !rules.EvictLRU {
+		return
+	}
+	depth := conf.pathTemplate.threadDepth()
+	if depth < 0 {
+		logger.Log.Warning("%s - Retention needs {thread} or {subject} in a directory of path_template", conf.DirName)
+		return
+	}
+
+	all, err := listThreadDirs(storage, conf.DirName, depth)
+	if err != nil {
+		logger.Log.Error("Error listing threads in %s: %v", conf.DirName, err)
+		return
+	}
+	// Live threads count towards the quota but are never deleted
+	var dirs []threadDir
+	for _, dir := range all {
+		if !live[dir.path] {
+			dirs = append(dirs, dir)
+		}
+	}
+	// Newest first
+	sort.Slice(dirs, func(i, j int) bool { return dirs[i].modTime.After(dirs[j].modTime) })
+
+	remove := make(map[string]string) // path -> reason
+	if rules.MaxAgeDays > 0 {
+		cutoff := time.Now().AddDate(0, 0, -rules.MaxAgeDays)
+		for _, dir := range dirs {
+			if dir.modTime.Before(cutoff) {
+				remove[dir.path] = fmt.Sprintf("older than %d days", rules.MaxAgeDays)
+			}
+		}
+	}
+	// Live threads take up places of the threads to keep
+	if keep := max(rules.KeepThreads-(len(all)-len(dirs)), 0); rules.KeepThreads > 0 && len(dirs) > keep {
+		for _, dir := range dirs[keep:] {
+			if _, ok := remove[dir.path]; !ok {
+				remove[dir.path] = fmt.Sprintf("beyond the last %d threads", rules.KeepThreads)
+			}
+		}
+	}
+	if rules.EvictLRU && conf.QuotaGB > 0 {
+		usage, err := dirUsage(storage, conf.DirName)
+		if err != nil {
+			logger.Log.Error("Error checking usage of %s: %v", conf.DirName, err)
+			return
+		}
+		for _, dir := range dirs {
+			if _, ok := remove[dir.path]; ok {
+				usage -= dir.size
+			}
+		}
+		quota := int64(conf.QuotaGB * bytesPerGB)
+		for i := len(dirs) - 1; i >= 0 && usage > quota; i-- {
+			if _, ok := remove[dirs[i].path]; ok {
+				continue
+			}
+			remove[dirs[i].path] = "evicted to fit the quota"
+			usage -= dirs[i].size
+		}
+	}
+
+	for _, dir := range dirs {
+		reason, ok := remove[dir.path]
+		if !ok {
+			continue
+		}
+		if dryRun {
+			logger.Log.Info("Dry run: would delete %s (%.1f MB, %s)", dir.path, float64(dir.size)/(1<<20), reason)
+			continue
+		}
+		logger.Log.Info("Deleting %s (%.1f MB, %s)", dir.path, float64(dir.size)/(1<<20), reason)
+		if err := storage.RemoveAll(dir.path); err != nil {
+			logger.Log.Error("Error deleting %s: %v", dir.path, err)
+		}
+	}
+}
+
+// liveThreadDirs returns the thread directories of the threads in a catalog, as rendered by the path template
+func liveThreadDirs(conf BoardConfig, catalog *dvach.Catalog) map[string]bool {
+	live := make(map[string]bool)
+	depth := conf.pathTemplate.threadDepth()
+	if depth < 0 {
+		return live
+	}
+	for _, op := range catalog.Threads {
+		fields := FileFields{Board: catalog.Board.ID, Thread: op.Num, Subject: op.Subject, Post: op.Num, Date: time.Unix(op.Timestamp, 0)}
+		name, err := store.SafeJoin(conf.DirName, conf.pathTemplate.Render(fields))
+		if err != nil {
+			continue
+		}
+		rel, err := filepath.Rel(conf.DirName, name)
+		if err != nil {
+			continue
+		}
+		components := strings.Split(filepath.ToSlash(rel), "/")
+		if len(components) <= depth+1 {
+			continue
+		}
+		live[path.Join(filepath.ToSlash(conf.DirName), strings.Join(components[:depth+1], "/"))] = true
+	}
+	return live
+}
+
+// quotaLeft returns how many bytes a board directory may still grow, ok is false without a quota
+func quotaLeft(storage store.Storage, conf BoardConfig) (left int64, ok bool) {
+	if conf.QuotaGB <= 0 {
+		return 0, false
+	}
+	quota := int64(conf.QuotaGB * bytesPerGB)
+	usage, err := dirUsage(storage, conf.DirName)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			logger.Log.Error("Error checking usage of %s: %v", conf.DirName, err)
+			return 0, false
+		}
+		return quota, true
+	}
+	return quota - usage, true
+}
+
+// listThreadDirs returns the directories depth levels below root. Their files were modified when the
+// md5 index says they were downloaded, modification times may be post dates set by set_mtime.
+func listThreadDirs(storage store.Storage, root string, depth int) ([]threadDir, error) {
+	prefix := path.Clean(filepath.ToSlash(root)) + "/"
+	if prefix == "./" {
+		prefix = ""
+	}
+	downloaded := store.DownloadTimes(storage, root)
+	byPath := make(map[string]*threadDir)
+	err := storage.Walk(root, func(file store.FileInfo) error {
+		// Files directly in the directories above the thread directories don't belong to a thread
+		components := strings.Split(strings.TrimPrefix(file.Name, prefix), "/")
+		if len(components) <= depth+1 {
+			return nil
+		}
+		dirPath := prefix + strings.Join(components[:depth+1], "/")
+		dir, ok := byPath[dirPath]
+		if !ok {
+			dir = &threadDir{path: dirPath}
+			byPath[dirPath] = dir
+		}
+		dir.size += file.Size
+		modTime := file.ModTime
+		if t, ok := downloaded[file.Name]; ok {
+			modTime = t
+		}
+		if modTime.After(dir.modTime) {
+			dir.modTime = modTime
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	dirs := make([]threadDir, 0, len(byPath))
+	for _, dir := range byPath {
+		dirs = append(dirs, *dir)
+	}
+	return dirs, nil
+}
+
+// dirUsage returns the total size of all files under root
+func dirUsage(storage store.Storage, root string) (int64, error) {
+	var total int64
+	err := storage.Walk(root, func(file store.FileInfo) error {
+		total += file.Size
+		return nil
+	})
+	return total, err
+}
@@ -0,0 +1,246 @@
+package monitor
+
+import (
+	"io/fs"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alekxeyuk/makaba-downloader/dvach"
+	"github.com/alekxeyuk/makaba-downloader/store"
+)
+
+// memStorage is an in-memory store.Storage that records what was removed
+type memStorage struct {
+	mu      sync.Mutex
+	files   map[string]store.FileInfo
+	data    map[string][]byte
+	removed []string
+}
+
+func newMemStorage() *memStorage {
+	return &memStorage{files: make(map[string]store.FileInfo), data: make(map[string][]byte)}
+}
+
+// add stores a file of the given size modified at modTime
+func (s *memStorage) add(name string, size int64, modTime time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.files[name] = store.FileInfo{Name: name, Size: size, ModTime: modTime}
+}
+
+func (s *memStorage) TempPath(name string) string        { return path.Join("/nonexistent", name+".tmp") }
+func (s *memStorage) Commit(tempPath, name string) error { return fs.ErrPermission }
+
+func (s *memStorage) Stat(name string) (store.FileInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	info, ok := s.files[name]
+	if !ok {
+		return store.FileInfo{}, fs.ErrNotExist
+	}
+	return info, nil
+}
+
+func (s *memStorage) Remove(name string) error {
+	return s.RemoveAll(name)
+}
+
+func (s *memStorage) RemoveAll(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.removed = append(s.removed, name)
+	for file := range s.files {
+		if file == name || strings.HasPrefix(file, name+"/") {
+			delete(s.files, file)
+			delete(s.data, file)
+		}
+	}
+	return nil
+}
+
+func (s *memStorage) ReadFile(name string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.data[name]
+	if !ok {
+		return nil, fs.ErrNotExist
+	}
+	return data, nil
+}
+
+func (s *memStorage) WriteFile(name string, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data[name] = data
+	s.files[name] = store.FileInfo{Name: name, Size: int64(len(data)), ModTime: time.Now()}
+	return nil
+}
+
+func (s *memStorage) AppendFile(name string, data []byte) error {
+	s.mu.Lock()
+	existing := s.data[name]
+	s.mu.Unlock()
+	return s.WriteFile(name, append(slices.Clip(existing), data...))
+}
+
+func (s *memStorage) Walk(root string, fn func(file store.FileInfo) error) error {
+	s.mu.Lock()
+	var files []store.FileInfo
+	for name, info := range s.files {
+		if strings.HasPrefix(name, root+"/") {
+			files = append(files, info)
+		}
+	}
+	s.mu.Unlock()
+	if len(files) == 0 {
+		return fs.ErrNotExist
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+	for _, file := range files {
+		if err := fn(file); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// retentionBoard returns a board config using the default path template
+func retentionBoard(t *testing.T, rules RetentionRules, quotaBytes int64) BoardConfig {
+	t.Helper()
+	tmpl, err := ParsePathTemplate("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return BoardConfig{
+		DirName:      "b",
+		Retention:    &rules,
+		QuotaGB:      float64(quotaBytes) / bytesPerGB,
+		pathTemplate: tmpl,
+	}
+}
+
+// threadsStorage holds threads 1 to 3, downloaded 30, 5 and 1 days ago, 1000 bytes each
+func threadsStorage() *memStorage {
+	s := newMemStorage()
+	now := time.Now()
+	for i, age := range []int{30, 5, 1} {
+		modTime := now.AddDate(0, 0, -age)
+		dir := "b/" + string(rune('1'+i))
+		s.add(dir+"/a.webm", 600, modTime)
+		s.add(dir+"/thumbs/a.jpg", 400, modTime.Add(-time.Hour))
+	}
+	s.add("b/loose.webm", 5000, now.AddDate(-1, 0, 0)) // not in a thread directory
+	return s
+}
+
+func TestApplyRetention(t *testing.T) {
+	tests := []struct {
+		name       string
+		rules      RetentionRules
+		quotaBytes int64
+		want       []string
+	}{
+		{"disabled", RetentionRules{}, 0, nil},
+		{"max age", RetentionRules{MaxAgeDays: 7}, 0, []string{"b/1"}},
+		{"keep threads", RetentionRules{KeepThreads: 1}, 0, []string{"b/1", "b/2"}},
+		{"max age and keep threads", RetentionRules{MaxAgeDays: 2, KeepThreads: 2}, 0, []string{"b/1", "b/2"}},
+		// 8000 bytes in total, loose files count towards the quota but are never deleted
+		{"evict lru", RetentionRules{EvictLRU: true}, 6500, []string{"b/1", "b/2"}},
+		{"evict lru under quota", RetentionRules{EvictLRU: true}, 8000, nil},
+		{"evict lru without quota", RetentionRules{EvictLRU: true}, 0, nil},
+		{"evict lru after max age", RetentionRules{EvictLRU: true, MaxAgeDays: 7}, 7000, []string{"b/1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := threadsStorage()
+			applyRetention(s, retentionBoard(t, tt.rules, tt.quotaBytes), nil, false)
+			sort.Strings(s.removed)
+			if !slices.Equal(s.removed, tt.want) {
+				t.Errorf("removed %v, want %v", s.removed, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplyRetentionDryRun(t *testing.T) {
+	s := threadsStorage()
+	applyRetention(s, retentionBoard(t, RetentionRules{MaxAgeDays: 2, KeepThreads: 1, EvictLRU: true}, 1), nil, true)
+	if len(s.removed) != 0 {
+		t.Errorf("dry run removed %v", s.removed)
+	}
+	if len(s.files) != 7 {
+		t.Errorf("dry run left %d of 7 files", len(s.files))
+	}
+}
+
+func TestApplyRetentionUsesDownloadTimes(t *testing.T) {
+	s := threadsStorage()
+	// set_mtime gave a thread downloaded just now the date of a year old post
+	postDate := time.Now().AddDate(-1, 0, 0)
+	s.add("b/4/0123456789abcdef0123456789abcdef_old.webm", 100, postDate)
+	store.AppendMD5Index(s, "b", "0123456789abcdef0123456789abcdef", "b/4/0123456789abcdef0123456789abcdef_old.webm")
+
+	applyRetention(s, retentionBoard(t, RetentionRules{MaxAgeDays: 7}, 0), nil, false)
+	if !slices.Equal(s.removed, []string{"b/1"}) {
+		t.Errorf("removed %v, want only b/1", s.removed)
+	}
+}
+
+func TestApplyRetentionKeepsLiveThreads(t *testing.T) {
+	// Thread 1 is the oldest but still in the catalog
+	catalog := &dvach.Catalog{Board: dvach.Board{ID: "b"}, Threads: []dvach.Post{{Num: 1, Timestamp: time.Now().Unix()}}}
+	tests := []struct {
+		name       string
+		rules      RetentionRules
+		quotaBytes int64
+		want       []string
+	}{
+		{"max age", RetentionRules{MaxAgeDays: 2}, 0, []string{"b/2"}},
+		// The live thread takes one of the two places
+		{"keep threads", RetentionRules{KeepThreads: 2}, 0, []string{"b/2"}},
+		{"evict lru", RetentionRules{EvictLRU: true}, 6500, []string{"b/2", "b/3"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := threadsStorage()
+			conf := retentionBoard(t, tt.rules, tt.quotaBytes)
+			live := liveThreadDirs(conf, catalog)
+			if !live["b/1"] || len(live) != 1 {
+				t.Fatalf("liveThreadDirs = %v, want b/1", live)
+			}
+			applyRetention(s, conf, live, false)
+			sort.Strings(s.removed)
+			if !slices.Equal(s.removed, tt.want) {
+				t.Errorf("removed %v, want %v", s.removed, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplyRetentionNeedsThreadDirectory(t *testing.T) {
+	s := threadsStorage()
+	conf := retentionBoard(t, RetentionRules{MaxAgeDays: 1}, 0)
+	conf.pathTemplate, _ = ParsePathTemplate("{post}_{name}.{ext}")
+	applyRetention(s, conf, nil, false)
+	if len(s.removed) != 0 {
+		t.Errorf("removed %v without thread directories", s.removed)
+	}
+}
+
+func TestQuotaLeft(t *testing.T) {
+	s := threadsStorage()
+	if _, ok := quotaLeft(s, retentionBoard(t, RetentionRules{}, 0)); ok {
+		t.Error("board without a quota has one")
+	}
+	if left, ok := quotaLeft(s, retentionBoard(t, RetentionRules{}, 10000)); !ok || left != 2000 {
+		t.Errorf("quotaLeft = %d, %v, want 2000", left, ok)
+	}
+	if left, _ := quotaLeft(newMemStorage(), retentionBoard(t, RetentionRules{}, 10000)); left != 10000 {
+		t.Errorf("quotaLeft of a missing directory = %d, want the whole quota", left)
+	}
+}
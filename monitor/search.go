@@ -0,0 +1,104 @@
+package monitor
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/alekxeyuk/makaba-downloader/dvach"
+	"github.com/alekxeyuk/makaba-downloader/match"
+)
+
+// CatalogQuery filters catalog threads, zero values keep every thread
+type CatalogQuery struct {
+	Text         string // case-insensitive substring of the subject, tags or comment
+	MinFiles     int64
+	MinPosts     int64
+	OnlyMatching bool // only threads the tags of the config match
+}
+
+// CatalogEntry is a catalog thread with what the tags of the config make of it
+type CatalogEntry struct {
+	Num     int64  `json:"num"`
+	Subject string `json:"subject"`
+	Posts   int64  `json:"posts"`
+	Files   int64  `json:"files"`
+	Matches bool   `json:"matches"`
+	Reason  string `json:"reason"`
+	URL     string `json:"url"`
+}
+
+// SearchCatalog lists the threads of a catalog passing the query in catalog order,
+// matched against the tags and ignored tags of config like a pass would
+func SearchCatalog(api *dvach.Client, catalog *dvach.Catalog, config *Config, query CatalogQuery) []CatalogEntry {
+	var entries []CatalogEntry
+	for i := range catalog.Threads {
+		// The listing is about the text as it is shown, markup is stripped for the query and the explanation
+		op := catalog.Threads[i]
+		op.Subject = match.StripHTML(op.Subject)
+		op.Comment = match.StripHTML(op.Comment)
+		if query.Text != "" && !match.ContainsAny(op.Subject+"\n"+op.Tags+"\n"+op.Comment, []string{query.Text}) {
+			continue
+		}
+		if op.FilesCount < query.MinFiles || op.PostsCount < query.MinPosts {
+			continue
+		}
+		matches, reason := match.ExplainThread(&op, config.Tags, config.IgnoredTags)
+		if query.OnlyMatching && !matches {
+			continue
+		}
+
+		subject := op.Subject
+		if subject == "" {
+			subject = op.Comment
+		}
+		entries = append(entries, CatalogEntry{
+			Num:     op.Num,
+			Subject: strings.Join(strings.Fields(subject), " "),
+			Posts:   op.PostsCount,
+			Files:   op.FilesCount,
+			Matches: matches,
+			Reason:  reason,
+			URL:     api.ThreadURL(catalog.Board.ID, op.Num),
+		})
+	}
+	return entries
+}
+
+// maxSubjectRunes keeps table rows on one line
+const maxSubjectRunes = 60
+
+// WriteCatalogTable prints catalog entries as an aligned table
+func WriteCatalogTable(w io.Writer, entries []CatalogEntry) {
+	if len(entries) == 0 {
+		fmt.Fprintln(w, "No threads found")
+		return
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "THREAD\tPOSTS\tFILES\tMATCH\tWHY\tSUBJECT")
+	for _, e := range entries {
+		subject := []rune(e.Subject)
+		if len(subject) > maxSubjectRunes {
+			subject = append(subject[:maxSubjectRunes-1], '…')
+		}
+		verdict := "no"
+		if e.Matches {
+			verdict = "yes"
+		}
+		fmt.Fprintf(tw, "%d\t%d\t%d\t%s\t%s\t%s\n", e.Num, e.Posts, e.Files, verdict, e.Reason, string(subject))
+	}
+	tw.Flush()
+}
+
+// WriteCatalogJSON prints catalog entries as a JSON array
+func WriteCatalogJSON(w io.Writer, entries []CatalogEntry) error {
+	if entries == nil {
+		entries = []CatalogEntry{}
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.SetEscapeHTML(false)
+	return encoder.Encode(entries)
+}
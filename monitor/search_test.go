@@ -0,0 +1,64 @@
+package monitor
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/alekxeyuk/makaba-downloader/dvach"
+)
+
+func TestSearchCatalog(t *testing.T) {
+	env := newTestEnv(t)
+	catalog, err := env.monitor.api.Catalog("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries := SearchCatalog(env.monitor.api, catalog, env.monitor.config, CatalogQuery{})
+	if len(entries) != 2 {
+		t.Fatalf("got %d entries, want 2", len(entries))
+	}
+	webm := entries[0]
+	if webm.Num != 100 || !webm.Matches || webm.Reason != `"webm" in subject` || webm.Files != 2 {
+		t.Errorf("webm thread = %+v", webm)
+	}
+	if music := entries[1]; music.Matches || music.Reason == "" {
+		t.Errorf("music thread = %+v", music)
+	}
+
+	for _, query := range []CatalogQuery{{OnlyMatching: true}, {Text: "КОТОВ"}, {MinFiles: 2}} {
+		if got := SearchCatalog(env.monitor.api, catalog, env.monitor.config, query); len(got) != 1 || got[0].Num != 100 {
+			t.Errorf("query %+v = %+v, want thread 100", query, got)
+		}
+	}
+
+	var table bytes.Buffer
+	WriteCatalogTable(&table, entries)
+	if lines := strings.Split(strings.TrimSpace(table.String()), "\n"); len(lines) != 3 || !strings.HasPrefix(lines[0], "THREAD") {
+		t.Errorf("table:\n%s", table.String())
+	}
+	var out bytes.Buffer
+	if err := WriteCatalogJSON(&out, entries); err != nil {
+		t.Fatal(err)
+	}
+	var decoded []CatalogEntry
+	if err := json.Unmarshal(out.Bytes(), &decoded); err != nil || len(decoded) != 2 {
+		t.Errorf("json: %v\n%s", err, out.String())
+	}
+}
+
+func TestSearchCatalogStripsMarkup(t *testing.T) {
+	env := newTestEnv(t)
+	catalog := &dvach.Catalog{Board: dvach.Board{ID: "b"}, Threads: []dvach.Post{{Num: 1, Comment: "Постим <b>котов</b>"}}}
+	config := &Config{Tags: []string{"постим котов"}, IgnoredTags: []string{"<b>"}}
+
+	entries := SearchCatalog(env.monitor.api, catalog, config, CatalogQuery{Text: "постим котов"})
+	if len(entries) != 1 {
+		t.Fatalf("got %d entries, want the thread found by its text", len(entries))
+	}
+	if e := entries[0]; !e.Matches || e.Reason != `"постим котов" in comment` || e.Subject != "Постим котов" {
+		t.Errorf("entry = %+v, want a match explained by the text as shown", e)
+	}
+}
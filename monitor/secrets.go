@@ -0,0 +1,83 @@
+package monitor
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/alekxeyuk/makaba-downloader/proxy"
+)
+
+// ResolveSecret reads a config value given as "env:NAME" from the environment
+// and one given as "file:PATH" from a file, other values are returned as they are
+func ResolveSecret(value string) (string, error) {
+	switch {
+	case strings.HasPrefix(value, "env:"):
+		name := strings.TrimPrefix(value, "env:")
+		secret, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", name)
+		}
+		return secret, nil
+	case strings.HasPrefix(value, "file:"):
+		data, err := os.ReadFile(strings.TrimPrefix(value, "file:"))
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(data)), nil
+	}
+	return value, nil
+}
+
+// resolveSecrets replaces env: and file: references in every secret of the config
+func resolveSecrets(config *Config) error {
+	secrets := map[string]*string{
+		"usercode_auth": &config.UsercodeAuth,
+		"passcode":      &config.Passcode,
+	}
+	if s := config.Storage; s != nil {
+		if s.S3 != nil {
+			secrets["storage s3 access_key"] = &s.S3.AccessKey
+			secrets["storage s3 secret_key"] = &s.S3.SecretKey
+		}
+		if s.WebDAV != nil {
+			secrets["storage webdav password"] = &s.WebDAV.Password
+		}
+	}
+	if n := config.Notifications; n != nil {
+		for i := range n.Sinks {
+			secrets[fmt.Sprintf("notifications sink %d token", i)] = &n.Sinks[i].Token
+			secrets[fmt.Sprintf("notifications sink %d password", i)] = &n.Sinks[i].Password
+		}
+	}
+
+	// Proxy URLs may carry passwords
+	var routes []*proxy.Route
+	if config.Proxy != nil {
+		for i := range config.Proxy.Routes {
+			routes = append(routes, &config.Proxy.Routes[i])
+		}
+	}
+	for _, board := range config.Boards {
+		if board.Proxy != nil {
+			routes = append(routes, board.Proxy)
+		}
+	}
+	for i, route := range routes {
+		for j := range route.API {
+			secrets[fmt.Sprintf("proxy route %d api %d", i+1, j+1)] = &route.API[j]
+		}
+		for j := range route.Media {
+			secrets[fmt.Sprintf("proxy route %d media %d", i+1, j+1)] = &route.Media[j]
+		}
+	}
+
+	for name, value := range secrets {
+		secret, err := ResolveSecret(*value)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		*value = secret
+	}
+	return nil
+}
@@ -0,0 +1,32 @@
+package monitor
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolveSecret(t *testing.T) {
+	t.Setenv("TEST_PASSCODE", "from-env")
+	file := filepath.Join(t.TempDir(), "passcode")
+	if err := os.WriteFile(file, []byte("from-file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for value, want := range map[string]string{
+		"plain":             "plain",
+		"env:TEST_PASSCODE": "from-env",
+		"file:" + file:      "from-file",
+		"":                  "",
+	} {
+		got, err := ResolveSecret(value)
+		if err != nil || got != want {
+			t.Errorf("ResolveSecret(%q) = %q, %v, want %q", value, got, err, want)
+		}
+	}
+	for _, value := range []string{"env:TEST_UNSET_SECRET", "file:" + file + ".missing"} {
+		if _, err := ResolveSecret(value); err == nil {
+			t.Errorf("ResolveSecret(%q) didn't fail", value)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package monitor
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/alekxeyuk/makaba-downloader/match"
+)
+
+const (
+	// defaultPathTemplate keeps the original <thread>/<md5>_<name> layout
+	defaultPathTemplate = "{thread}/{md5}_{name}.{ext}"
+	// defaultThumbnailTemplate must not start names with the md5, or thumbnails would count as downloaded files
+	defaultThumbnailTemplate = "{thread}/thumbs/thumb_{md5}.{ext}"
+)
+
+// FileFields are the values available to path templates
+type FileFields struct {
+	Board   string
+	Thread  int64
+	Subject string
+	Post    int64
+	Date    time.Time
+	MD5     string
+	Name    string // original filename without extension
+	Ext     string // extension without the dot
+	Index   int    // position of the file in its post, starting at 1
+}
+
+type templatePart struct {
+	literal string
+	field   string // empty for literal parts
+	arg     string // e.g. the layout of {date:2006-01}
+}
+
+// PathTemplate builds file paths relative to the board directory from post and file fields
+type PathTemplate struct {
+	raw   string
+	parts []templatePart
+}
+
+var templateFields = map[string]bool{
+	"board":               true,
+	"thread":              true,
+	"thread_subject_slug": true,
+	"subject":             true, // alias for thread_subject_slug
+	"date":                true,
+	"post":                true,
+	"md5":                 true,
+	"name":                true,
+	"ext":                 true,
+	"index":               true,
+}
+
+// ParsePathTemplate parses a template like "{date:2006-01}/{thread}-{subject}/{post}_{name}.{ext}"
+func ParsePathTemplate(raw string) (*PathTemplate, error) {
+	if raw == "" {
+		raw = defaultPathTemplate
+	}
+	if filepath.IsAbs(raw) || strings.HasPrefix(raw, "/") {
+		return nil, fmt.Errorf("path template %q must be relative to the board directory", raw)
+	}
+	for part := range strings.SplitSeq(filepath.ToSlash(raw), "/") {
+		if part == ".." {
+			return nil, fmt.Errorf("path template %q must not contain ..", raw)
+		}
+	}
+
+	t := &PathTemplate{raw: raw}
+	rest := raw
+	for rest != "" {
+		open := strings.IndexByte(rest, '{')
+		if open < 0 {
+			t.parts = append(t.parts, templatePart{literal: rest})
+			break
+		}
+		if open > 0 {
+			t.parts = append(t.parts, templatePart{literal: rest[:open]})
+		}
+		end := strings.IndexByte(rest[open:], '}')
+		if end < 0 {
+			return nil, fmt.Errorf("path template %q: unclosed {", raw)
+		}
+		field, arg, _ := strings.Cut(rest[open+1:open+end], ":")
+		if !templateFields[field] {
+			return nil, fmt.Errorf("path template %q: unknown field {%s}", raw, field)
+		}
+		if arg != "" && field != "date" {
+			return nil, fmt.Errorf("path template %q: field {%s} takes no argument", raw, field)
+		}
+		t.parts = append(t.parts, templatePart{field: field, arg: arg})
+		rest = rest[open+end+1:]
+	}
+
+	// Files of different posts must not share a name, they would be taken for the same file
+	if !t.has("md5") && !t.has("post") {
+		return nil, fmt.Errorf("path template %q must contain {md5} or {post} to tell files apart", raw)
+	}
+	return t, nil
+}
+
+// has reports whether the template uses field
+func (t *PathTemplate) has(field string) bool {
+	for _, part := range t.parts {
+		if part.field == field {
+			return true
+		}
+	}
+	return false
+}
+
+// threadDepth returns how many directories below the board directory the thread directory is,
+// the first directory named after the thread, or -1 if files of a thread don't share one
+func (t *PathTemplate) threadDepth() int {
+	components := strings.Split(filepath.ToSlash(t.raw), "/")
+	for i, component := range components[:len(components)-1] {
+		if strings.Contains(component, "{thread") || strings.Contains(component, "{subject") {
+			return i
+		}
+	}
+	return -1
+}
+
+// namesStartWithMD5 reports whether rendered file names start with the md5,
+// which is how stored media files are recognized
+func (t *PathTemplate) namesStartWithMD5() bool {
+	raw := filepath.ToSlash(t.raw)
+	return strings.HasPrefix(raw[strings.LastIndexByte(raw, '/')+1:], "{md5}")
+}
+
+// String returns the template as it was written
+func (t *PathTemplate) String() string {
+	return t.raw
+}
+
+// Render returns the relative path for a file, field values never add path components.
+// Without {md5} or {index} the files of a post after the first get their index before the extension.
+func (t *PathTemplate) Render(f FileFields) string {
+	var b strings.Builder
+	for _, part := range t.parts {
+		if part.field == "" {
+			b.WriteString(part.literal)
+			continue
+		}
+		b.WriteString(sanitizeFieldValue(t.value(part, f)))
+	}
+	rendered := b.String()
+	if f.Index > 1 && !t.has("md5") && !t.has("index") {
+		ext := path.Ext(rendered)
+		rendered = strings.TrimSuffix(rendered, ext) + "_" + strconv.Itoa(f.Index) + ext
+	}
+	return rendered
+}
+
+func (t *PathTemplate) value(part templatePart, f FileFields) string {
+	switch part.field {
+	case "board":
+		return f.Board
+	case "thread":
+		return strconv.FormatInt(f.Thread, 10)
+	case "thread_subject_slug", "subject":
+		return slugify(f.Subject)
+	case "date":
+		layout := part.arg
+		if layout == "" {
+			layout = time.DateOnly
+		}
+		return f.Date.Format(layout)
+	case "post":
+		return strconv.FormatInt(f.Post, 10)
+	case "md5":
+		return f.MD5
+	case "name":
+		return f.Name
+	case "ext":
+		return f.Ext
+	case "index":
+		return strconv.Itoa(f.Index)
+	}
+	return ""
+}
+
+// sanitizeFieldValue keeps a field value within a single path component,
+// the component as a whole is sanitized again once the template is rendered
+func sanitizeFieldValue(s string) string {
+	if s == "." || s == ".." {
+		return "_"
+	}
+	return strings.NewReplacer("/", "_", "\\", "_").Replace(s)
+}
+
+// slugify turns a thread subject into a short lowercase dash separated string
+func slugify(s string) string {
+	const maxRunes = 64
+
+	var b strings.Builder
+	dash := false
+	n := 0
+	for _, r := range strings.ToLower(match.StripHTML(s)) {
+		if n >= maxRunes {
+			break
+		}
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			b.WriteRune(r)
+			dash = false
+			n++
+		} else if !dash && b.Len() > 0 {
+			b.WriteByte('-')
+			dash = true
+			n++
+		}
+	}
+	slug := strings.TrimSuffix(b.String(), "-")
+	if slug == "" {
+		return "untitled"
+	}
+	return slug
+}
@@ -0,0 +1,88 @@
+package monitor
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParsePathTemplateErrors(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want string // part of the error
+	}{
+		{"/abs/{md5}.{ext}", "relative"},
+		{"{thread}/../{md5}.{ext}", ".."},
+		{"{thread}/{md5}.{ext", "unclosed"},
+		{"{thread}/{md5}_{nope}.{ext}", "unknown field"},
+		{"{thread:x}/{md5}.{ext}", "no argument"},
+		{"{thread}/{name}.{ext}", "{md5} or {post}"},
+		{"{thread}/{index}_{name}.{ext}", "{md5} or {post}"},
+	}
+	for _, tt := range tests {
+		_, err := ParsePathTemplate(tt.raw)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("ParsePathTemplate(%q) = %v, want an error about %q", tt.raw, err, tt.want)
+		}
+	}
+}
+
+func TestPathTemplateRender(t *testing.T) {
+	fields := FileFields{
+		Board:   "b",
+		Thread:  100,
+		Subject: "<b>WEBM</b> тред &amp; музыка!",
+		Post:    123,
+		Date:    time.Date(2026, 10, 5, 12, 0, 0, 0, time.UTC),
+		MD5:     "0123456789abcdef0123456789abcdef",
+		Name:    "cat/dog",
+		Ext:     "webm",
+		Index:   2,
+	}
+	tests := []struct {
+		raw  string
+		want string
+	}{
+		{"", "100/0123456789abcdef0123456789abcdef_cat_dog.webm"},
+		{"{board}/{date:2006-01}/{thread}-{subject}/{post}_{index}.{ext}", "b/2026-10/100-webm-тред-музыка/123_2.webm"},
+		{"{thread_subject_slug}/{date}/{md5}.{ext}", "webm-тред-музыка/2026-10-05/0123456789abcdef0123456789abcdef.webm"},
+		// Later files of a post are told apart by their index
+		{"{thread}/{post}_{name}.{ext}", "100/123_cat_dog_2.webm"},
+		{"{thread}/{post}", "100/123_2"},
+	}
+	for _, tt := range tests {
+		tmpl, err := ParsePathTemplate(tt.raw)
+		if err != nil {
+			t.Fatalf("ParsePathTemplate(%q): %v", tt.raw, err)
+		}
+		if got := tmpl.Render(fields); got != tt.want {
+			t.Errorf("Render(%q) = %q, want %q", tt.raw, got, tt.want)
+		}
+	}
+
+	tmpl, _ := ParsePathTemplate("{thread}/{post}_{name}.{ext}")
+	fields.Index = 1
+	if got := tmpl.Render(fields); got != "100/123_cat_dog.webm" {
+		t.Errorf("first file of a post = %q, want no index", got)
+	}
+}
+
+func TestPathTemplateThreadDepth(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want int
+	}{
+		{"{thread}/{md5}.{ext}", 0},
+		{"{date:2006-01}/{thread}-{subject}/{post}.{ext}", 1},
+		{"{date:2006-01}/{post}.{ext}", -1},
+	}
+	for _, tt := range tests {
+		tmpl, err := ParsePathTemplate(tt.raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := tmpl.threadDepth(); got != tt.want {
+			t.Errorf("threadDepth(%q) = %d, want %d", tt.raw, got, tt.want)
+		}
+	}
+}
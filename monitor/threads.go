@@ -0,0 +1,69 @@
+package monitor
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/alekxeyuk/makaba-downloader/dvach"
+	"github.com/alekxeyuk/makaba-downloader/logger"
+	"github.com/alekxeyuk/makaba-downloader/match"
+)
+
+// ThreadInfo is a thread picked for downloading
+type ThreadInfo struct {
+	Thread  *dvach.Thread
+	Board   string
+	Num     int64
+	LastHit int64
+	Manual  bool // requested by the user, files are downloaded before everything else
+	New     bool // not seen in earlier passes
+}
+
+func getThreads(api *dvach.Client, catalog *dvach.Catalog, threadSubjSubstrings []string, ignoredSubstrings []string, lastHits map[string]int64) ([]ThreadInfo, int64) {
+	var threads []ThreadInfo
+	boardID := catalog.Board.ID
+
+	for _, op := range catalog.Threads {
+		if match.Thread(&op, threadSubjSubstrings, ignoredSubstrings) {
+			currentLastHit := op.FilesCount
+
+			// Check if lasthit is newer than what we remember
+			key := boardID + "_" + strconv.FormatInt(op.Num, 10)
+			storedLastHit, exists := lastHits[key]
+			if !exists || currentLastHit > storedLastHit {
+				logger.Log.Debug("Found matching thread with new activity: %d (lasthit: %d -> %d)", op.Num, storedLastHit, currentLastHit)
+
+				thread, err := api.Thread(boardID, op.Num)
+				if err != nil {
+					logger.Log.Error("Error getting thread %d: %v", op.Num, err)
+					continue
+				}
+				threads = append(threads, ThreadInfo{Thread: thread, Board: boardID, Num: op.Num, LastHit: currentLastHit, New: !exists})
+			}
+		}
+	}
+	return threads, int64(len(catalog.Threads))
+}
+
+// isValidFileExtension checks a file against the allowed extensions,
+// unknown extensions are appended to unknown.txt
+func isValidFileExtension(file *dvach.File, fileExtensions []string) bool {
+	ext := filepath.Ext(file.Path)
+	if len(ext) == 0 {
+		return false
+	}
+	for _, allowedExt := range fileExtensions {
+		if strings.EqualFold(ext[1:], allowedExt) {
+			return true
+		}
+	}
+	// Log unknown extension to unknown.txt
+	unknownFile, err := os.OpenFile("unknown.txt", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err == nil {
+		defer unknownFile.Close()
+		unknownFile.WriteString(ext[1:] + "\n")
+	}
+	return false
+}
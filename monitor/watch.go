@@ -0,0 +1,133 @@
+package monitor
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alekxeyuk/makaba-downloader/logger"
+)
+
+// WatchEntry is a thread polled every pass whether or not it matches the tags
+type WatchEntry struct {
+	Thread string    `json:"thread"`         // board/number
+	Until  time.Time `json:"until,omitzero"` // stop watching after this time, zero means until it 404s
+}
+
+// parseThreadRef splits a board/number reference
+func parseThreadRef(ref string) (string, int64, error) {
+	board, threadNum, ok := strings.Cut(strings.Trim(ref, "/"), "/")
+	if !ok || board == "" {
+		return "", 0, fmt.Errorf("invalid thread reference %q, expected board/number", ref)
+	}
+	num, err := strconv.ParseInt(threadNum, 10, 64)
+	if err != nil || num <= 0 {
+		return "", 0, fmt.Errorf("invalid thread number in %q", ref)
+	}
+	return board, num, nil
+}
+
+// Watchlist holds the watched threads added at runtime and remembers the ones that are gone,
+// so entries of config.json that 404ed or expired are not polled again
+type Watchlist struct {
+	name string
+
+	mu      sync.Mutex
+	Entries []WatchEntry `json:"entries"`
+	Gone    []string     `json:"gone,omitempty"` // threads removed after a 404
+}
+
+// LoadWatchlist reads the watchlist state file, a missing file is an empty watchlist
+func LoadWatchlist(name string) *Watchlist {
+	w := &Watchlist{name: name}
+	data, err := os.ReadFile(name)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Log.Error("Error opening %s: %v", name, err)
+		}
+		return w
+	}
+	if err := json.Unmarshal(data, w); err != nil {
+		logger.Log.Error("Error decoding %s: %v", name, err)
+	}
+	return w
+}
+
+// Save writes the watchlist state file
+func (w *Watchlist) Save() {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	data, err := json.MarshalIndent(w, "", "  ")
+	w.mu.Unlock()
+	if err != nil {
+		logger.Log.Error("Error encoding %s: %v", w.name, err)
+		return
+	}
+	if err := os.WriteFile(w.name, data, 0644); err != nil {
+		logger.Log.Error("Error writing %s: %v", w.name, err)
+	}
+}
+
+// Add watches a thread, replacing the expiry of an existing entry
+func (w *Watchlist) Add(entry WatchEntry) error {
+	board, num, err := parseThreadRef(entry.Thread)
+	if err != nil {
+		return err
+	}
+	entry.Thread = board + "/" + strconv.FormatInt(num, 10)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.Gone = slices.DeleteFunc(w.Gone, func(ref string) bool { return ref == entry.Thread })
+	for i := range w.Entries {
+		if w.Entries[i].Thread == entry.Thread {
+			w.Entries[i].Until = entry.Until
+			return nil
+		}
+	}
+	w.Entries = append(w.Entries, entry)
+	return nil
+}
+
+// remove stops watching a thread for good, also when it is listed in config.json
+func (w *Watchlist) remove(ref string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.Entries = slices.DeleteFunc(w.Entries, func(e WatchEntry) bool { return e.Thread == ref })
+	if !slices.Contains(w.Gone, ref) {
+		w.Gone = append(w.Gone, ref)
+	}
+}
+
+// active returns the unexpired entries of config and the watchlist that aren't gone,
+// expired watchlist entries are dropped
+func (w *Watchlist) active(config []WatchEntry, now time.Time) []WatchEntry {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	expired := func(e WatchEntry) bool { return !e.Until.IsZero() && now.After(e.Until) }
+	w.Entries = slices.DeleteFunc(w.Entries, expired)
+
+	var entries []WatchEntry
+	seen := make(map[string]bool)
+	for _, e := range slices.Concat(w.Entries, config) {
+		board, num, err := parseThreadRef(e.Thread)
+		if err != nil {
+			logger.Log.Error("Watchlist: %v", err)
+			continue
+		}
+		e.Thread = board + "/" + strconv.FormatInt(num, 10)
+		if expired(e) || seen[e.Thread] || slices.Contains(w.Gone, e.Thread) {
+			continue
+		}
+		seen[e.Thread] = true
+		entries = append(entries, e)
+	}
+	return entries
+}
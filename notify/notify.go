@@ -0,0 +1,364 @@
+// Package notify sends deduplicated and rate limited alerts to webhooks, Telegram and email
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alekxeyuk/makaba-downloader/internal/webhook"
+	"github.com/alekxeyuk/makaba-downloader/logger"
+	"golang.org/x/time/rate"
+)
+
+// Events that can be enabled in Config.Events
+const (
+	EventNewThread    = "new_thread"    // a new thread matching the tags appeared
+	EventBoardFailing = "board_failing" // a board failed several passes in a row, or recovered
+	EventAuth         = "auth"          // usercode_auth or the passcode was rejected
+)
+
+// Notification is an alert sent to every sink
+type Notification struct {
+	Kind   string    `json:"kind"`
+	Key    string    `json:"key"` // identical keys are deduplicated
+	Title  string    `json:"title"`
+	Text   string    `json:"text"`
+	Board  string    `json:"board,omitempty"`
+	Thread int64     `json:"thread,omitempty"`
+	URL    string    `json:"url,omitempty"`
+	Time   time.Time `json:"time"`
+}
+
+// Sink delivers notifications somewhere
+type Sink interface {
+	Name() string
+	Send(ctx context.Context, n Notification) error
+}
+
+// Config configures sinks and what gets sent to them
+type Config struct {
+	Events           []string     `json:"events,omitempty"` // default is all events
+	Sinks            []SinkConfig `json:"sinks"`
+	DedupMinutes     int          `json:"dedup_minutes,omitempty"`     // identical alerts are sent once per this many minutes, default 360
+	MaxPerHour       int          `json:"max_per_hour,omitempty"`      // alerts over this rate are dropped, default 30
+	FailureThreshold int          `json:"failure_threshold,omitempty"` // failed passes in a row before a board alert, default 3
+}
+
+// SinkConfig configures a single sink, Type selects which of the other fields are used
+type SinkConfig struct {
+	Type string `json:"type"` // "webhook", "telegram" or "smtp"
+
+	// webhook
+	URL     string            `json:"url,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+
+	// telegram, APIURL can point to a compatible server
+	APIURL string `json:"api_url,omitempty"`
+	Token  string `json:"token,omitempty"`
+	ChatID string `json:"chat_id,omitempty"`
+
+	// smtp
+	Host     string   `json:"host,omitempty"`
+	Port     int      `json:"port,omitempty"`
+	Username string   `json:"username,omitempty"`
+	Password string   `json:"password,omitempty"`
+	From     string   `json:"from,omitempty"`
+	To       []string `json:"to,omitempty"`
+}
+
+// Notifier deduplicates and throttles alerts and sends them to sinks in the background
+type Notifier struct {
+	config  Config
+	sinks   []Sink
+	limiter *rate.Limiter
+	dedup   time.Duration
+	now     func() time.Time
+
+	mu         sync.Mutex
+	sent       map[string]time.Time // last time a key was sent
+	suppressed int                  // alerts dropped by the rate limit since the last one sent
+	failures   map[string]int       // failed passes in a row by board
+	alerted    map[string]bool      // boards with an open failure alert
+
+	wg sync.WaitGroup
+}
+
+// New creates the configured sinks
+func New(config Config) (*Notifier, error) {
+	if config.DedupMinutes <= 0 {
+		config.DedupMinutes = 360
+	}
+	if config.MaxPerHour <= 0 {
+		config.MaxPerHour = 30
+	}
+	if config.FailureThreshold <= 0 {
+		config.FailureThreshold = 3
+	}
+	for _, event := range config.Events {
+		switch event {
+		case EventNewThread, EventBoardFailing, EventAuth:
+		default:
+			return nil, fmt.Errorf("notifications: unknown event %q", event)
+		}
+	}
+
+	n := &Notifier{
+		config:   config,
+		limiter:  rate.NewLimiter(rate.Every(time.Hour/time.Duration(config.MaxPerHour)), min(config.MaxPerHour, 10)),
+		dedup:    time.Duration(config.DedupMinutes) * time.Minute,
+		now:      time.Now,
+		sent:     make(map[string]time.Time),
+		failures: make(map[string]int),
+		alerted:  make(map[string]bool),
+	}
+	for i, sc := range config.Sinks {
+		sink, err := newSink(sc)
+		if err != nil {
+			return nil, fmt.Errorf("notifications: sink %d: %w", i+1, err)
+		}
+		n.AddSink(sink)
+	}
+	return n, nil
+}
+
+func newSink(sc SinkConfig) (Sink, error) {
+	switch sc.Type {
+	case "webhook":
+		if sc.URL == "" {
+			return nil, fmt.Errorf("webhook url is missing")
+		}
+		return &WebhookSink{url: sc.URL, headers: sc.Headers, client: &http.Client{Timeout: 30 * time.Second}}, nil
+	case "telegram":
+		if sc.Token == "" || sc.ChatID == "" {
+			return nil, fmt.Errorf("telegram token or chat_id is missing")
+		}
+		api := sc.APIURL
+		if api == "" {
+			api = "https://api.telegram.org"
+		}
+		return &TelegramSink{apiURL: strings.TrimSuffix(api, "/"), token: sc.Token, chatID: sc.ChatID, client: &http.Client{Timeout: 30 * time.Second}}, nil
+	case "smtp":
+		if sc.Host == "" || sc.From == "" || len(sc.To) == 0 {
+			return nil, fmt.Errorf("smtp host, from or to is missing")
+		}
+		port := sc.Port
+		if port == 0 {
+			port = 587
+		}
+		return &SMTPSink{addr: net.JoinHostPort(sc.Host, strconv.Itoa(port)), host: sc.Host, username: sc.Username, password: sc.Password, from: sc.From, to: sc.To}, nil
+	default:
+		return nil, fmt.Errorf("unknown type %q", sc.Type)
+	}
+}
+
+// AddSink adds a sink, e.g. one implemented by an embedding program
+func (n *Notifier) AddSink(sink Sink) {
+	n.sinks = append(n.sinks, sink)
+}
+
+// Notify sends a notification unless it was sent recently or the rate limit is exceeded
+func (n *Notifier) Notify(note Notification) {
+	if n == nil || len(n.config.Events) > 0 && !slices.Contains(n.config.Events, note.Kind) {
+		return
+	}
+	if note.Time.IsZero() {
+		note.Time = n.now()
+	}
+	if note.Key == "" {
+		note.Key = note.Kind + ":" + note.Title
+	}
+
+	n.mu.Lock()
+	if last, ok := n.sent[note.Key]; ok && note.Time.Sub(last) < n.dedup {
+		n.mu.Unlock()
+		logger.Log.Trace("Not repeating notification %s", note.Key)
+		return
+	}
+	if !n.limiter.AllowN(note.Time, 1) {
+		n.suppressed++
+		n.mu.Unlock()
+		logger.Log.Warning("Notification rate limit reached, dropping: %s", note.Title)
+		return
+	}
+	n.sent[note.Key] = note.Time
+	if n.suppressed > 0 {
+		note.Text += fmt.Sprintf("\n\n(%d more notifications were dropped by the rate limit)", n.suppressed)
+		n.suppressed = 0
+	}
+	n.mu.Unlock()
+
+	for _, sink := range n.sinks {
+		n.wg.Go(func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			defer cancel()
+			if err := sink.Send(ctx, note); err != nil {
+				logger.Log.Error("Error sending notification to %s: %v", sink.Name(), err)
+			}
+		})
+	}
+}
+
+// BoardFailed records a failed pass of a board and alerts once the threshold is reached
+func (n *Notifier) BoardFailed(board string, err error) {
+	if n == nil {
+		return
+	}
+	n.mu.Lock()
+	n.failures[board]++
+	count := n.failures[board]
+	alert := count >= n.config.FailureThreshold && !n.alerted[board]
+	if alert {
+		n.alerted[board] = true
+	}
+	n.mu.Unlock()
+
+	if alert {
+		n.Notify(Notification{
+			Kind:  EventBoardFailing,
+			Key:   EventBoardFailing + ":" + board,
+			Title: fmt.Sprintf("/%s/ is failing", board),
+			Text:  fmt.Sprintf("/%s/ failed %d passes in a row: %v", board, count, err),
+			Board: board,
+		})
+	}
+}
+
+// BoardOK records a successful pass of a board and reports recovery after an alert
+func (n *Notifier) BoardOK(board string) {
+	if n == nil {
+		return
+	}
+	n.mu.Lock()
+	recovered := n.alerted[board]
+	delete(n.failures, board)
+	delete(n.alerted, board)
+	n.mu.Unlock()
+
+	if recovered {
+		n.Notify(Notification{
+			Kind:  EventBoardFailing,
+			Key:   EventBoardFailing + ":" + board + ":ok",
+			Title: fmt.Sprintf("/%s/ recovered", board),
+			Text:  fmt.Sprintf("/%s/ is working again", board),
+			Board: board,
+		})
+	}
+}
+
+// Wait blocks until all notifications are sent
+func (n *Notifier) Wait() {
+	if n != nil {
+		n.wg.Wait()
+	}
+}
+
+// WebhookSink posts notifications as JSON
+type WebhookSink struct {
+	url     string
+	headers map[string]string
+	client  *http.Client
+}
+
+func (s *WebhookSink) Name() string {
+	return "webhook " + s.url
+}
+
+func (s *WebhookSink) Send(ctx context.Context, n Notification) error {
+	body, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	return webhook.PostJSON(ctx, s.client, s.url, body, s.headers)
+}
+
+// TelegramSink sends messages with the sendMessage method of the Telegram Bot API
+type TelegramSink struct {
+	apiURL string
+	token  string
+	chatID string
+	client *http.Client
+}
+
+func (s *TelegramSink) Name() string {
+	return "telegram " + s.chatID
+}
+
+func (s *TelegramSink) Send(ctx context.Context, n Notification) error {
+	text := n.Title
+	if n.Text != "" {
+		text += "\n" + n.Text
+	}
+	if n.URL != "" {
+		text += "\n" + n.URL
+	}
+	body, err := json.Marshal(map[string]any{
+		"chat_id":                  s.chatID,
+		"text":                     text,
+		"disable_web_page_preview": true,
+	})
+	if err != nil {
+		return err
+	}
+	err = webhook.PostJSON(ctx, s.client, s.apiURL+"/bot"+s.token+"/sendMessage", body, nil)
+	// The URL contains the bot token, keep it out of the logs
+	var uerr *url.Error
+	if errors.As(err, &uerr) {
+		return fmt.Errorf("sendMessage: %w", uerr.Err)
+	}
+	return err
+}
+
+// SMTPSink sends notifications as plain text email
+type SMTPSink struct {
+	addr     string
+	host     string
+	username string
+	password string
+	from     string
+	to       []string
+}
+
+func (s *SMTPSink) Name() string {
+	return "smtp " + s.addr
+}
+
+func (s *SMTPSink) Send(ctx context.Context, n Notification) error {
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", s.from)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(s.to, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.BEncoding.Encode("utf-8", n.Title))
+	fmt.Fprintf(&msg, "Date: %s\r\n", n.Time.Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: 8bit\r\n\r\n")
+	text := n.Text
+	if n.URL != "" {
+		text += "\n\n" + n.URL
+	}
+	msg.WriteString(strings.ReplaceAll(text, "\n", "\r\n") + "\r\n")
+
+	var auth smtp.Auth
+	if s.username != "" {
+		auth = smtp.PlainAuth("", s.username, s.password, s.host)
+	}
+	// smtp.SendMail has no context, run it aside so the timeout still applies
+	done := make(chan error, 1)
+	go func() { done <- smtp.SendMail(s.addr, auth, s.from, s.to, msg.Bytes()) }()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
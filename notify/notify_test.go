@@ -0,0 +1,183 @@
+package notify
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingSink keeps sent notifications
+type recordingSink struct {
+	mu    sync.Mutex
+	notes []Notification
+}
+
+func (s *recordingSink) Name() string { return "recording" }
+
+func (s *recordingSink) Send(ctx context.Context, n Notification) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.notes = append(s.notes, n)
+	return nil
+}
+
+// titles returns the sorted titles of sent notifications, sinks are called concurrently
+func (s *recordingSink) titles() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var titles []string
+	for _, n := range s.notes {
+		titles = append(titles, n.Title)
+	}
+	slices.Sort(titles)
+	return strings.Join(titles, ",")
+}
+
+func TestNotifierDedupAndThrottle(t *testing.T) {
+	n, err := New(Config{DedupMinutes: 10, MaxPerHour: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := &recordingSink{}
+	n.AddSink(sink)
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	n.now = func() time.Time { return now }
+
+	n.Notify(Notification{Kind: EventNewThread, Title: "a"})
+	n.Notify(Notification{Kind: EventNewThread, Title: "a"}) // duplicate
+	n.Notify(Notification{Kind: EventNewThread, Title: "b"})
+	n.Notify(Notification{Kind: EventNewThread, Title: "c"}) // over the rate
+	n.Wait()
+	if got := sink.titles(); got != "a,b" {
+		t.Fatalf("sent %q, want a,b", got)
+	}
+
+	// After the dedup window and with a token back, "a" goes out again and mentions the dropped one
+	now = now.Add(31 * time.Minute)
+	n.Notify(Notification{Kind: EventNewThread, Title: "a"})
+	n.Wait()
+	if got := sink.titles(); got != "a,a,b" {
+		t.Fatalf("sent %q, want a twice and b", got)
+	}
+	if last := sink.notes[2]; !strings.Contains(last.Text, "1 more") {
+		t.Errorf("text %q doesn't mention the dropped notification", last.Text)
+	}
+}
+
+func TestNotifierBoardFailures(t *testing.T) {
+	n, err := New(Config{FailureThreshold: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := &recordingSink{}
+	n.AddSink(sink)
+
+	failure := errors.New("boom")
+	n.BoardFailed("b", failure)
+	n.BoardFailed("b", failure)
+	n.BoardFailed("b", failure)
+	n.BoardOK("b")
+	n.BoardOK("b")
+	n.Wait()
+	if got := sink.titles(); got != "/b/ is failing,/b/ recovered" {
+		t.Errorf("sent %q", got)
+	}
+}
+
+func TestTelegramSink(t *testing.T) {
+	var got map[string]any
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/bot123:abc/sendMessage" {
+			t.Errorf("path = %s", r.URL.Path)
+		}
+		json.NewDecoder(r.Body).Decode(&got)
+		w.Write([]byte(`{"ok":true}`))
+	}))
+	defer srv.Close()
+
+	sink, err := newSink(SinkConfig{Type: "telegram", APIURL: srv.URL, Token: "123:abc", ChatID: "-100"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = sink.Send(context.Background(), Notification{Title: "New thread", Text: "5 files", URL: "https://2ch.su/b/res/1.html"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got["chat_id"] != "-100" || got["text"] != "New thread\n5 files\nhttps://2ch.su/b/res/1.html" {
+		t.Errorf("sendMessage body = %v", got)
+	}
+}
+
+func TestSMTPSink(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	// A minimal SMTP server without extensions
+	message := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		reply := func(s string) { conn.Write([]byte(s + "\r\n")) }
+		reply("220 localhost")
+		var data strings.Builder
+		inData := false
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			if inData {
+				if line == ".\r\n" {
+					inData = false
+					message <- data.String()
+					reply("250 OK")
+				} else {
+					data.WriteString(line)
+				}
+				continue
+			}
+			switch cmd := strings.ToUpper(strings.Fields(line)[0]); cmd {
+			case "DATA":
+				inData = true
+				reply("354 go on")
+			case "QUIT":
+				reply("221 bye")
+				return
+			default:
+				reply("250 OK")
+			}
+		}
+	}()
+
+	host, port, _ := net.SplitHostPort(ln.Addr().String())
+	portNum, _ := strconv.Atoi(port)
+	sink, err := newSink(SinkConfig{Type: "smtp", Host: host, Port: portNum, From: "bot@example.com", To: []string{"me@example.com"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = sink.Send(context.Background(), Notification{Title: "Новый тред", Text: "text", Time: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := <-message
+	if !strings.Contains(msg, "Subject: =?utf-8?b?") || !strings.Contains(msg, "\r\n\r\ntext\r\n") {
+		t.Errorf("message = %q", msg)
+	}
+}
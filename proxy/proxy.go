@@ -0,0 +1,340 @@
+// Package proxy routes requests through pools of HTTP, HTTPS and SOCKS5 proxies,
+// chosen by mirror, board and whether a request is for the API or for media.
+// A pool sticks to one proxy and rotates to the next when it fails or answers 403.
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alekxeyuk/makaba-downloader/logger"
+)
+
+// Direct stands for a direct connection in proxy lists
+const Direct = "direct"
+
+// Route selects the proxies of the requests it matches, empty fields match everything
+type Route struct {
+	Host  string   `json:"host,omitempty"`  // mirror, e.g. "2ch.su"
+	Board string   `json:"board,omitempty"` // board id, e.g. "b"
+	API   []string `json:"api,omitempty"`   // proxies for catalogs and threads, Direct for none
+	Media []string `json:"media,omitempty"` // proxies for files and thumbnails, Direct for none
+}
+
+// Config lists the routes, the first matching one with proxies for the kind of request is used,
+// requests no route has proxies for go direct
+type Config struct {
+	Routes []Route `json:"routes"`
+	// CooldownMinutes is how long a failed proxy is skipped, default 10
+	CooldownMinutes int `json:"cooldown_minutes,omitempty"`
+	// HealthCheckMinutes is how often every proxy is checked, default 10, -1 disables checks
+	HealthCheckMinutes int `json:"health_check_minutes,omitempty"`
+	// HealthCheckURL is requested through every proxy, default is the mirror
+	HealthCheckURL string `json:"health_check_url,omitempty"`
+}
+
+// entry is a proxy shared by every pool listing it
+type entry struct {
+	name      string
+	transport *http.Transport
+
+	mu        sync.Mutex
+	failedAt  time.Time
+	failures  int
+	lastError string
+}
+
+// fail puts the proxy on cooldown
+func (e *entry) fail(now time.Time, reason string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.failedAt = now
+	e.failures++
+	e.lastError = reason
+}
+
+// ok takes the proxy off cooldown
+func (e *entry) ok() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.failedAt = time.Time{}
+	e.failures = 0
+	e.lastError = ""
+}
+
+// cooling tells whether the proxy failed within cooldown
+func (e *entry) cooling(now time.Time, cooldown time.Duration) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return !e.failedAt.IsZero() && now.Sub(e.failedAt) < cooldown
+}
+
+// pool is an ordered list of proxies with the one in use
+type pool struct {
+	entries []*entry
+
+	mu  sync.Mutex
+	cur int
+}
+
+// pick returns the proxy in use, skipping to the next one off cooldown if it is cooling down
+func (p *pool) pick(now time.Time, cooldown time.Duration) *entry {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i := range p.entries {
+		e := p.entries[(p.cur+i)%len(p.entries)]
+		if !e.cooling(now, cooldown) {
+			p.cur = (p.cur + i) % len(p.entries)
+			return e
+		}
+	}
+	// All are cooling down, keep trying the current one rather than failing outright
+	return p.entries[p.cur]
+}
+
+// rotate moves on from e unless another request already did
+func (p *pool) rotate(e *entry) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.entries[p.cur] == e {
+		p.cur = (p.cur + 1) % len(p.entries)
+	}
+}
+
+// route is a Route with its pools
+type route struct {
+	Route
+	api, media *pool
+}
+
+// Router is an http.RoundTripper sending every request through the proxies of its route
+type Router struct {
+	routes   []route
+	entries  []*entry
+	cooldown time.Duration
+	now      func() time.Time
+}
+
+// NewRouter creates the transports of every proxy listed in config as clones of base,
+// nil means http.DefaultTransport
+func NewRouter(config Config, base *http.Transport) (*Router, error) {
+	if base == nil {
+		base = http.DefaultTransport.(*http.Transport)
+	}
+	if config.CooldownMinutes <= 0 {
+		config.CooldownMinutes = 10
+	}
+	r := &Router{cooldown: time.Duration(config.CooldownMinutes) * time.Minute, now: time.Now}
+	byName := make(map[string]*entry)
+
+	newPool := func(names []string) (*pool, error) {
+		if len(names) == 0 {
+			return nil, nil
+		}
+		p := &pool{}
+		for _, name := range names {
+			e, ok := byName[name]
+			if !ok {
+				transport, err := newTransport(name, base)
+				if err != nil {
+					return nil, err
+				}
+				e = &entry{name: name, transport: transport}
+				byName[name] = e
+				r.entries = append(r.entries, e)
+			}
+			p.entries = append(p.entries, e)
+		}
+		return p, nil
+	}
+
+	for i, rt := range config.Routes {
+		api, err := newPool(rt.API)
+		if err != nil {
+			return nil, fmt.Errorf("proxy route %d: %w", i+1, err)
+		}
+		media, err := newPool(rt.Media)
+		if err != nil {
+			return nil, fmt.Errorf("proxy route %d: %w", i+1, err)
+		}
+		r.routes = append(r.routes, route{Route: rt, api: api, media: media})
+	}
+	direct, _ := newPool([]string{Direct})
+	r.routes = append(r.routes, route{api: direct, media: direct})
+	return r, nil
+}
+
+// newTransport returns a transport for a proxy URL or Direct
+func newTransport(name string, base *http.Transport) (*http.Transport, error) {
+	transport := base.Clone()
+	if name == Direct {
+		transport.Proxy = nil
+		return transport, nil
+	}
+	u, err := url.Parse(name)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("%s: unsupported proxy scheme %q", redact(name), u.Scheme)
+	}
+	transport.Proxy = http.ProxyURL(u)
+	return transport, nil
+}
+
+// redact hides the password of a proxy URL in logs
+func redact(name string) string {
+	u, err := url.Parse(name)
+	if err != nil || u.User == nil {
+		return name
+	}
+	return u.Redacted()
+}
+
+// board returns the board a request path belongs to, e.g. "b" for /b/res/100.json
+func board(urlPath string) string {
+	first, _, _ := strings.Cut(strings.TrimPrefix(path.Clean(urlPath), "/"), "/")
+	return first
+}
+
+// poolFor returns the pool of the first route matching a request
+func (r *Router) poolFor(req *http.Request) *pool {
+	b := board(req.URL.Path)
+	for _, rt := range r.routes {
+		if rt.Host != "" && !strings.EqualFold(rt.Host, req.URL.Hostname()) {
+			continue
+		}
+		if rt.Board != "" && rt.Board != b {
+			continue
+		}
+		p := rt.media
+		if strings.HasSuffix(req.URL.Path, ".json") {
+			p = rt.api
+		}
+		if p != nil {
+			return p
+		}
+	}
+	return nil // unreachable, the last route is direct for everything
+}
+
+func (r *Router) RoundTrip(req *http.Request) (*http.Response, error) {
+	p := r.poolFor(req)
+	var lastErr error
+	for attempt := range len(p.entries) {
+		e := p.pick(r.now(), r.cooldown)
+		if attempt > 0 {
+			// The body of the failed attempt is gone, only retry requests that can rewind it
+			if req.Body != nil && req.GetBody == nil {
+				break
+			}
+			req = req.Clone(req.Context())
+			if req.GetBody != nil {
+				body, err := req.GetBody()
+				if err != nil {
+					return nil, err
+				}
+				req.Body = body
+			}
+		}
+
+		resp, err := e.transport.RoundTrip(req)
+		switch {
+		case err != nil:
+			if req.Context().Err() != nil {
+				return nil, err
+			}
+			logger.Log.Warning("Proxy %s failed, rotating: %v", redact(e.name), err)
+			e.fail(r.now(), err.Error())
+			lastErr = err
+		case resp.StatusCode == http.StatusForbidden && len(p.entries) > 1:
+			logger.Log.Warning("Proxy %s got 403 for %s, rotating", redact(e.name), req.URL.Path)
+			e.fail(r.now(), "403 Forbidden")
+			lastErr = fmt.Errorf("proxy %s: %s", redact(e.name), resp.Status)
+			p.rotate(e)
+			if attempt == len(p.entries)-1 {
+				return resp, nil
+			}
+			resp.Body.Close()
+			continue
+		default:
+			return resp, nil
+		}
+		p.rotate(e)
+	}
+	return nil, lastErr
+}
+
+// CheckHealth requests checkURL through every proxy, failing ones are put on cooldown and working ones taken off it
+func (r *Router) CheckHealth(ctx context.Context, checkURL string) {
+	var wg sync.WaitGroup
+	for _, e := range r.entries {
+		wg.Go(func() {
+			ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+			defer cancel()
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, checkURL, nil)
+			if err != nil {
+				return
+			}
+			resp, err := e.transport.RoundTrip(req)
+			if err != nil {
+				if ctx.Err() == nil || ctx.Err() == context.DeadlineExceeded {
+					logger.Log.Warning("Proxy %s is down: %v", redact(e.name), err)
+					e.fail(r.now(), err.Error())
+				}
+				return
+			}
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusForbidden || resp.StatusCode >= 500 {
+				logger.Log.Warning("Proxy %s is unhealthy: %s", redact(e.name), resp.Status)
+				e.fail(r.now(), resp.Status)
+				return
+			}
+			e.ok()
+		})
+	}
+	wg.Wait()
+}
+
+// RunHealthChecks checks every proxy right away and then every interval until ctx is done
+func (r *Router) RunHealthChecks(ctx context.Context, checkURL string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		r.CheckHealth(ctx, checkURL)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Status describes a proxy for logs and reports
+type Status struct {
+	Proxy     string
+	Healthy   bool
+	Failures  int
+	LastError string
+}
+
+// Status returns the state of every proxy, passwords redacted
+func (r *Router) Status() []Status {
+	now := r.now()
+	var statuses []Status
+	for _, e := range r.entries {
+		healthy := !e.cooling(now, r.cooldown)
+		e.mu.Lock()
+		statuses = append(statuses, Status{Proxy: redact(e.name), Healthy: healthy, Failures: e.failures, LastError: e.lastError})
+		e.mu.Unlock()
+	}
+	return statuses
+}
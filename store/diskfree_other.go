@@ -0,0 +1,10 @@
+//go:build !linux && !darwin && !freebsd && !windows
+
+package store
+
+import "errors"
+
+// FreeSpace returns the number of bytes available on the filesystem of path
+func FreeSpace(path string) (uint64, error) {
+	return 0, errors.ErrUnsupported
+}
@@ -0,0 +1,215 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alekxeyuk/makaba-downloader/logger"
+)
+
+// KnownFiles returns the md5 hashes of the files already stored under dirName,
+// read from the file names and the md5 index. The index is compacted once it is
+// mostly made of entries that were superseded or point to files that are gone.
+func KnownFiles(storage Storage, dirName string) map[string]struct{} {
+	alreadyHaveFiles := make(map[string]struct{})
+
+	existing := make(map[string]struct{})
+	err := storage.Walk(dirName, func(file FileInfo) error {
+		if md5, ok := md5FromName(path.Base(file.Name)); ok {
+			alreadyHaveFiles[md5] = struct{}{}
+		}
+		existing[file.Name] = struct{}{}
+		return nil
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		logger.Log.Info("Directory %s does not exist, skipping...", dirName)
+		return alreadyHaveFiles
+	}
+	if err != nil {
+		logger.Log.Error("Error walking directory %s: %v", dirName, err)
+	}
+
+	// Path templates may leave the md5 out of the name, the index remembers it.
+	// Entries may also point to a near-duplicate kept elsewhere.
+	index, lines := readMD5Index(storage, dirName)
+	gone := make(map[string]bool)
+	for md5, e := range index {
+		name := e.path
+		if _, ok := existing[name]; !ok {
+			if _, err := storage.Stat(name); err != nil {
+				gone[name] = true
+				continue
+			}
+		}
+		alreadyHaveFiles[md5] = struct{}{}
+	}
+	if live := len(index) - len(gone); lines-live >= minCompactLines && lines-live > live {
+		compactMD5Index(storage, dirName, gone)
+	}
+	return alreadyHaveFiles
+}
+
+// md5FromName returns the md5 a file name starts with, as in the default
+// "<md5>_<name>" layout. Partial downloads don't count, and neither do sidecars,
+// which outlive their file when it is deleted to have it downloaded again.
+func md5FromName(name string) (string, bool) {
+	if len(name) < 33 || name[32] != '_' && name[32] != '.' {
+		return "", false
+	}
+	if strings.HasSuffix(name, ".tmp") || strings.HasSuffix(name, SidecarSuffix) {
+		return "", false
+	}
+	for _, c := range name[:32] {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F') {
+			return "", false
+		}
+	}
+	return name[:32], true
+}
+
+// ThumbnailKey is the md5 index key of a file thumbnail
+func ThumbnailKey(md5 string) string {
+	return "thumb:" + md5
+}
+
+// MD5IndexName is the file in every board directory mapping md5 hashes to downloaded files.
+// Every line is "<md5> <relative path>\t<unix download time>", older lines have no time.
+const MD5IndexName = ".md5index"
+
+// md5IndexMu serializes appends and compaction, which reads the index and rewrites it
+var md5IndexMu sync.Mutex
+
+// indexEntry is the file an md5 was last stored as
+type indexEntry struct {
+	path       string // slash separated, like the names returned by Storage.Walk
+	downloaded time.Time
+}
+
+// AppendMD5Index records a downloaded file in the md5 index of its board directory
+func AppendMD5Index(storage Storage, root, md5, name string) {
+	md5IndexMu.Lock()
+	defer md5IndexMu.Unlock()
+
+	indexPath := filepath.Join(root, MD5IndexName)
+	rel, err := filepath.Rel(root, name)
+	if err != nil {
+		logger.Log.Error("Error indexing %s: %v", name, err)
+		return
+	}
+	line := indexLine(md5, filepath.ToSlash(rel), time.Now())
+	if err := storage.AppendFile(indexPath, []byte(line)); err != nil {
+		logger.Log.Error("Error writing %s: %v", indexPath, err)
+	}
+}
+
+// indexLine formats a line of the md5 index, file names never contain tabs
+func indexLine(md5, rel string, downloaded time.Time) string {
+	if downloaded.IsZero() {
+		return fmt.Sprintf("%s %s\n", md5, rel)
+	}
+	return fmt.Sprintf("%s %s\t%d\n", md5, rel, downloaded.Unix())
+}
+
+// LoadMD5Index reads the md5 index of a board directory, later entries win.
+// Paths are slash separated like the names returned by Storage.Walk.
+func LoadMD5Index(storage Storage, root string) map[string]string {
+	entries, _ := readMD5Index(storage, root)
+	index := make(map[string]string, len(entries))
+	for md5, e := range entries {
+		index[md5] = e.path
+	}
+	return index
+}
+
+// DownloadTimes returns when the files in the md5 index of a board directory were downloaded,
+// by slash separated path. Unlike modification times they are not changed by set_mtime.
+func DownloadTimes(storage Storage, root string) map[string]time.Time {
+	entries, _ := readMD5Index(storage, root)
+	times := make(map[string]time.Time, len(entries))
+	for _, e := range entries {
+		if e.downloaded.After(times[e.path]) {
+			times[e.path] = e.downloaded
+		}
+	}
+	return times
+}
+
+// readMD5Index reads the md5 index and returns how many lines it has
+func readMD5Index(storage Storage, root string) (map[string]indexEntry, int) {
+	index := make(map[string]indexEntry)
+	indexPath := filepath.Join(root, MD5IndexName)
+	data, err := storage.ReadFile(indexPath)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			logger.Log.Error("Error opening %s: %v", indexPath, err)
+		}
+		return index, 0
+	}
+
+	lines := 0
+	for line := range strings.Lines(string(data)) {
+		lines++
+		md5, rest, ok := strings.Cut(strings.TrimRight(line, "\r\n"), " ")
+		if !ok {
+			continue
+		}
+		rel, unix, _ := strings.Cut(rest, "\t")
+		e := indexEntry{path: path.Join(filepath.ToSlash(root), rel)}
+		if sec, err := strconv.ParseInt(unix, 10, 64); err == nil {
+			e.downloaded = time.Unix(sec, 0)
+		}
+		index[md5] = e
+	}
+	return index, lines
+}
+
+// minCompactLines keeps small indexes from being rewritten over a few stale entries
+const minCompactLines = 100
+
+// compactMD5Index rewrites the md5 index with the latest entry of every md5, except the ones
+// pointing to gone files. It is read again under the lock so concurrent appends are kept.
+func compactMD5Index(storage Storage, root string, gone map[string]bool) {
+	md5IndexMu.Lock()
+	defer md5IndexMu.Unlock()
+
+	indexPath := filepath.Join(root, MD5IndexName)
+	index, lines := readMD5Index(storage, root)
+	var kept []string
+	for md5, e := range index {
+		if gone[e.path] {
+			continue
+		}
+		rel, err := filepath.Rel(root, filepath.FromSlash(e.path))
+		if err != nil {
+			continue
+		}
+		kept = append(kept, indexLine(md5, filepath.ToSlash(rel), e.downloaded))
+	}
+	sort.Strings(kept)
+
+	// Write a local temp file and commit it so a crash can't leave half an index
+	tempPath := storage.TempPath(indexPath)
+	if err := os.MkdirAll(filepath.Dir(tempPath), 0755); err != nil {
+		logger.Log.Error("Error compacting %s: %v", indexPath, err)
+		return
+	}
+	if err := os.WriteFile(tempPath, []byte(strings.Join(kept, "")), 0644); err != nil {
+		logger.Log.Error("Error compacting %s: %v", indexPath, err)
+		return
+	}
+	if err := storage.Commit(tempPath, indexPath); err != nil {
+		os.Remove(tempPath)
+		logger.Log.Error("Error compacting %s: %v", indexPath, err)
+		return
+	}
+	logger.Log.Info("Compacted %s from %d to %d entries", indexPath, lines, len(kept))
+}
@@ -0,0 +1,127 @@
+package store
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMD5FromName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"0123456789abcdef0123456789abcdef_cat.webm", "0123456789abcdef0123456789abcdef"},
+		{"0123456789ABCDEF0123456789ABCDEF.jpg", "0123456789ABCDEF0123456789ABCDEF"},
+		{"0123456789abcdef0123456789abcdef_cat.webm.tmp", ""},
+		{"0123456789abcdef0123456789abcdef_cat.webm.json", ""},
+		{"a_very_long_original_file_name_without_md5.webm", ""},
+		{"0123456789abcdef0123456789abcdefg.webm", ""},
+		{"0123456789abcdef0123456789abcdef", ""},
+		{".md5index", ""},
+	}
+	for _, tt := range tests {
+		got, ok := md5FromName(tt.name)
+		if got != tt.want || ok != (tt.want != "") {
+			t.Errorf("md5FromName(%q) = %q, %v, want %q", tt.name, got, ok, tt.want)
+		}
+	}
+}
+
+func TestKnownFiles(t *testing.T) {
+	dir := t.TempDir()
+	storage := NewDisk(dir)
+	for _, name := range []string{
+		"b/1/0123456789abcdef0123456789abcdef_cat.webm",
+		"b/1/some_custom_long_name_from_a_template.webm",
+		"b/1/fedcba9876543210fedcba9876543210_dog.webm.tmp",
+		"b/2/123_1.webm",
+	} {
+		if err := storage.WriteFile(name, []byte("x")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	AppendMD5Index(storage, "b", "11111111111111111111111111111111", filepath.Join("b", "2", "123_1.webm"))
+	AppendMD5Index(storage, "b", "22222222222222222222222222222222", filepath.Join("b", "2", "deleted.webm"))
+
+	known := KnownFiles(storage, "b")
+	want := []string{"0123456789abcdef0123456789abcdef", "11111111111111111111111111111111"}
+	if len(known) != len(want) {
+		t.Errorf("KnownFiles = %v, want %v", known, want)
+	}
+	for _, md5 := range want {
+		if _, ok := known[md5]; !ok {
+			t.Errorf("KnownFiles is missing %s", md5)
+		}
+	}
+}
+
+func TestKnownFilesCompactsIndex(t *testing.T) {
+	dir := t.TempDir()
+	storage := NewDisk(dir)
+	if err := storage.WriteFile("b/1/kept.webm", []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	// The same md5 indexed over and over plus many deleted files
+	for i := range minCompactLines {
+		AppendMD5Index(storage, "b", "11111111111111111111111111111111", filepath.Join("b", "1", "kept.webm"))
+		AppendMD5Index(storage, "b", fmt.Sprintf("%032d", i), filepath.Join("b", "1", fmt.Sprintf("gone%d.webm", i)))
+	}
+
+	known := KnownFiles(storage, "b")
+	if _, ok := known["11111111111111111111111111111111"]; !ok || len(known) != 1 {
+		t.Errorf("KnownFiles = %v, want only the kept file", known)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "b", MD5IndexName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(data); !strings.HasPrefix(got, "11111111111111111111111111111111 1/kept.webm\t") || strings.Count(got, "\n") != 1 {
+		t.Errorf("compacted index = %q", got)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "b", MD5IndexName+".tmp")); !os.IsNotExist(err) {
+		t.Errorf("temporary index left behind: %v", err)
+	}
+
+	// Appends keep working after the rewrite
+	AppendMD5Index(storage, "b", "33333333333333333333333333333333", filepath.Join("b", "1", "kept.webm"))
+	if index := LoadMD5Index(storage, "b"); len(index) != 2 || !strings.HasSuffix(index["33333333333333333333333333333333"], "kept.webm") {
+		t.Errorf("index after append = %v", index)
+	}
+}
+
+func TestKnownFilesKeepsSmallIndex(t *testing.T) {
+	dir := t.TempDir()
+	storage := NewDisk(dir)
+	AppendMD5Index(storage, "b", "22222222222222222222222222222222", filepath.Join("b", "1", "gone.webm"))
+	KnownFiles(storage, "b")
+	if index := LoadMD5Index(storage, "b"); len(index) != 1 {
+		t.Errorf("small index was compacted: %v", index)
+	}
+}
+
+func TestDownloadTimes(t *testing.T) {
+	dir := t.TempDir()
+	storage := NewDisk(dir)
+	// Lines written before download times were recorded have none
+	if err := storage.WriteFile("b/"+MD5IndexName, []byte("11111111111111111111111111111111 1/old file.webm\n")); err != nil {
+		t.Fatal(err)
+	}
+	before := time.Now().Truncate(time.Second)
+	AppendMD5Index(storage, "b", "22222222222222222222222222222222", filepath.Join("b", "1", "new file.webm"))
+
+	index := LoadMD5Index(storage, "b")
+	if index["11111111111111111111111111111111"] != "b/1/old file.webm" || index["22222222222222222222222222222222"] != "b/1/new file.webm" {
+		t.Errorf("LoadMD5Index = %v", index)
+	}
+	times := DownloadTimes(storage, "b")
+	if _, ok := times["b/1/old file.webm"]; ok {
+		t.Error("old line has a download time")
+	}
+	if got := times["b/1/new file.webm"]; got.Before(before) || got.After(time.Now()) {
+		t.Errorf("download time = %v, want about now", got)
+	}
+}
@@ -0,0 +1,69 @@
+package store
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/alekxeyuk/makaba-downloader/logger"
+)
+
+// SidecarSuffix is appended to the name of a file to get its metadata sidecar
+const SidecarSuffix = ".json"
+
+// MetadataOptions control what is recorded about a downloaded file
+type MetadataOptions struct {
+	Sidecar  bool `json:"sidecar,omitempty"`   // write <file>.json next to the file
+	Xattrs   bool `json:"xattrs,omitempty"`    // set user.xdg.origin.url and friends, Linux only
+	SetMtime bool `json:"set_mtime,omitempty"` // set the file mtime to the post date
+}
+
+// FileMeta is the provenance of a downloaded file
+type FileMeta struct {
+	Board        string    `json:"board"`
+	Thread       int64     `json:"thread"`
+	ThreadURL    string    `json:"thread_url"`
+	Post         int64     `json:"post"`
+	Date         time.Time `json:"date"`
+	Subject      string    `json:"subject,omitempty"`
+	OriginalName string    `json:"original_name,omitempty"`
+	MD5          string    `json:"md5"`
+	URL          string    `json:"url"`
+}
+
+// WriteMetadata records the provenance of a stored file according to the options,
+// xattrs and mtimes are only set on local storage
+func WriteMetadata(storage Storage, name string, meta *FileMeta, opts MetadataOptions) {
+	if opts.Sidecar {
+		if err := writeSidecar(storage, name+SidecarSuffix, meta); err != nil {
+			logger.Log.Error("Error writing metadata sidecar for %s: %v", name, err)
+		}
+	}
+	local, ok := storage.(LocalPather)
+	if !ok {
+		return
+	}
+	path := local.LocalPath(name)
+	if opts.Xattrs {
+		attrs := map[string]string{
+			"user.xdg.origin.url":   meta.URL,
+			"user.xdg.referrer.url": meta.ThreadURL,
+		}
+		if err := setXattrs(path, attrs); err != nil {
+			logger.Log.Warning("Error setting extended attributes on %s: %v", path, err)
+		}
+	}
+	if opts.SetMtime && !meta.Date.IsZero() {
+		if err := os.Chtimes(path, time.Time{}, meta.Date); err != nil {
+			logger.Log.Warning("Error setting modification time of %s: %v", path, err)
+		}
+	}
+}
+
+func writeSidecar(storage Storage, name string, meta *FileMeta) error {
+	data, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return err
+	}
+	return storage.WriteFile(name, append(data, '\n'))
+}
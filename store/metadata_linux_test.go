@@ -0,0 +1,31 @@
+package store
+
+import (
+	"syscall"
+	"testing"
+)
+
+func TestWriteMetadataXattrs(t *testing.T) {
+	storage := NewDisk(t.TempDir())
+	path := writeMediaFile(t, storage, "1.webm")
+	if err := syscall.Setxattr(path, "user.test", []byte("x"), 0); err != nil {
+		t.Skipf("filesystem doesn't support user xattrs: %v", err)
+	}
+
+	WriteMetadata(storage, "1.webm", testMeta, MetadataOptions{Xattrs: true})
+
+	for name, want := range map[string]string{
+		"user.xdg.origin.url":   testMeta.URL,
+		"user.xdg.referrer.url": testMeta.ThreadURL,
+	} {
+		buf := make([]byte, 256)
+		n, err := syscall.Getxattr(path, name, buf)
+		if err != nil {
+			t.Errorf("Getxattr(%s): %v", name, err)
+			continue
+		}
+		if got := string(buf[:n]); got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+}
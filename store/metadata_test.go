@@ -0,0 +1,101 @@
+package store
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+)
+
+var testMeta = &FileMeta{
+	Board:     "b",
+	Thread:    100,
+	ThreadURL: "https://2ch.hk/b/res/100.html",
+	Post:      123,
+	Date:      time.Date(2026, 10, 5, 12, 0, 0, 0, time.UTC),
+	MD5:       "0123456789abcdef0123456789abcdef",
+	URL:       "https://2ch.hk/b/src/100/1.webm",
+}
+
+func writeMediaFile(t *testing.T, storage *Disk, name string) string {
+	t.Helper()
+	if err := storage.WriteFile(name, []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	return storage.LocalPath(name)
+}
+
+func TestWriteMetadataSidecar(t *testing.T) {
+	storage := NewDisk(t.TempDir())
+	name := "b/100/" + testMeta.MD5 + "_1.webm"
+	writeMediaFile(t, storage, name)
+
+	WriteMetadata(storage, name, testMeta, MetadataOptions{Sidecar: true})
+
+	data, err := storage.ReadFile(name + SidecarSuffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got FileMeta
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Post != testMeta.Post || got.URL != testMeta.URL || !got.Date.Equal(testMeta.Date) {
+		t.Errorf("sidecar = %+v, want %+v", got, *testMeta)
+	}
+
+	// A sidecar left behind after the file was deleted doesn't count as the file
+	if err := os.Remove(storage.LocalPath(name)); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := KnownFiles(storage, "b")[testMeta.MD5]; ok {
+		t.Error("sidecar of a deleted file counts as downloaded")
+	}
+}
+
+func TestWriteMetadataMtime(t *testing.T) {
+	storage := NewDisk(t.TempDir())
+	path := writeMediaFile(t, storage, "1.webm")
+
+	WriteMetadata(storage, "1.webm", testMeta, MetadataOptions{SetMtime: true})
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.ModTime().Equal(testMeta.Date) {
+		t.Errorf("mtime = %v, want the post date %v", info.ModTime(), testMeta.Date)
+	}
+	if _, err := os.Stat(path + SidecarSuffix); !os.IsNotExist(err) {
+		t.Errorf("sidecar written without the option: %v", err)
+	}
+}
+
+func TestWriteMetadataRemoteStorage(t *testing.T) {
+	// Only the sidecar is written where there is no local file
+	disk := NewDisk(t.TempDir())
+	storage := sidecarOnly{disk}
+	path := writeMediaFile(t, disk, "1.webm")
+	before, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	WriteMetadata(storage, "1.webm", testMeta, MetadataOptions{Sidecar: true, SetMtime: true})
+
+	if _, err := os.Stat(path + SidecarSuffix); err != nil {
+		t.Errorf("sidecar: %v", err)
+	}
+	after, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !after.ModTime().Equal(before.ModTime()) {
+		t.Error("mtime changed on storage without local paths")
+	}
+}
+
+// sidecarOnly hides the local paths of a disk like remote storages do
+type sidecarOnly struct {
+	Storage
+}
@@ -0,0 +1,96 @@
+package store
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// maxComponentBytes is the filename length limit of common filesystems, less room
+// for the ".tmp" of partial downloads and the ".json" of sidecars added to stored names
+const maxComponentBytes = 255 - len(SidecarSuffix)
+
+// windowsReservedNames can't be used as a filename on Windows, with or without an extension
+var windowsReservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// SanitizeFileName makes a single path component safe on Windows and Unix systems.
+// Separators are replaced, so the result never creates subdirectories or leaves its parent.
+func SanitizeFileName(fileName string) string {
+	fileName = strings.ToValidUTF8(fileName, "_")
+	fileName = strings.Map(func(r rune) rune {
+		switch {
+		case r == '/' || r == '\\':
+			return '_'
+		case strings.ContainsRune(`:*?<>|"`, r):
+			// Characters that are invalid in filenames on Windows
+			return -1
+		case unicode.IsControl(r):
+			return -1
+		}
+		return r
+	}, fileName)
+	fileName = truncateFileName(fileName, maxComponentBytes)
+
+	// Windows drops trailing dots and spaces, which would make names collide
+	fileName = strings.TrimRight(strings.TrimLeft(fileName, " "), ". ")
+	if fileName == "" {
+		return "_"
+	}
+
+	base, _, _ := strings.Cut(fileName, ".")
+	if windowsReservedNames[strings.ToUpper(strings.TrimRight(base, " "))] {
+		// The prefix may push a long name over the limit again
+		fileName = strings.TrimRight(truncateFileName("_"+fileName, maxComponentBytes), ". ")
+	}
+	return fileName
+}
+
+// truncateFileName shortens a name to maxBytes without splitting runes, keeping a short extension
+func truncateFileName(name string, maxBytes int) string {
+	if len(name) <= maxBytes {
+		return name
+	}
+	ext := filepath.Ext(name)
+	if len(ext) > 16 || len(ext) >= maxBytes {
+		ext = ""
+	}
+	return TruncateUTF8(strings.TrimSuffix(name, ext), maxBytes-len(ext)) + ext
+}
+
+// TruncateUTF8 returns the longest prefix of s that fits into maxBytes and ends on a rune boundary
+func TruncateUTF8(s string, maxBytes int) string {
+	if len(s) <= maxBytes {
+		return s
+	}
+	for maxBytes > 0 && !utf8.RuneStart(s[maxBytes]) {
+		maxBytes--
+	}
+	return s[:maxBytes]
+}
+
+// SafeJoin joins a relative path to root, sanitizing every component,
+// and refuses paths that would end up outside of root
+func SafeJoin(root, rel string) (string, error) {
+	parts := strings.FieldsFunc(filepath.ToSlash(rel), func(r rune) bool { return r == '/' })
+	for i, part := range parts {
+		if part == "." || part == ".." {
+			return "", fmt.Errorf("path %q must not contain %q", rel, part)
+		}
+		parts[i] = SanitizeFileName(part)
+	}
+	if len(parts) == 0 {
+		return "", fmt.Errorf("empty path")
+	}
+
+	clean := filepath.Join(parts...)
+	if !filepath.IsLocal(clean) {
+		return "", fmt.Errorf("path %q escapes %s", rel, root)
+	}
+	return filepath.Join(root, clean), nil
+}
@@ -0,0 +1,166 @@
+package store
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"unicode"
+	"unicode/utf8"
+)
+
+func TestSanitizeFileName(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"video.webm", "video.webm"},
+		{"a/b\\c.jpg", "a_b_c.jpg"},
+		{"what?.png", "what.png"},
+		{"bell\a\x00.gif", "bell.gif"},
+		{"trailing. . ", "trailing"},
+		{"CON", "_CON"},
+		{"nul.txt", "_nul.txt"},
+		{"com1 .jpg", "_com1 .jpg"},
+		{"CONSOLE.jpg", "CONSOLE.jpg"},
+		{"..", "_"},
+		{"", "_"},
+		{"\xff\xfe.jpg", "_.jpg"},
+	}
+	for _, tt := range tests {
+		if got := SanitizeFileName(tt.in); got != tt.want {
+			t.Errorf("SanitizeFileName(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestSanitizeFileNameLong(t *testing.T) {
+	name := strings.Repeat("я", 200) + ".webm"
+	got := SanitizeFileName(name)
+	if len(got) > maxComponentBytes {
+		t.Fatalf("sanitized name has %d bytes", len(got))
+	}
+	if !utf8.ValidString(got) {
+		t.Fatalf("sanitized name %q is not valid UTF-8", got)
+	}
+	if !strings.HasSuffix(got, ".webm") {
+		t.Fatalf("sanitized name %q lost its extension", got)
+	}
+}
+
+func TestSanitizeFileNameLeavesRoomForSuffixes(t *testing.T) {
+	// A {subject}_{name}.{ext} name cut right at the limit
+	name := SanitizeFileName(strings.Repeat("тред-про-котиков-", 10) + "_" + strings.Repeat("котик", 20) + ".webm")
+	if len(name) < maxComponentBytes-1 {
+		t.Fatalf("name has %d bytes, want it cut at the limit", len(name))
+	}
+	storage := NewDisk(t.TempDir())
+	temp := storage.TempPath("b/1/" + name)
+	if err := os.MkdirAll(filepath.Dir(temp), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(temp, []byte("x"), 0644); err != nil {
+		t.Fatalf("writing the partial download: %v", err)
+	}
+	if err := storage.Commit(temp, "b/1/"+name); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.WriteFile("b/1/"+name+SidecarSuffix, []byte("{}")); err != nil {
+		t.Fatalf("writing the sidecar: %v", err)
+	}
+}
+
+func TestSanitizeFileNameLongReserved(t *testing.T) {
+	for _, name := range []string{"CON." + strings.Repeat("a", 300), "nul." + strings.Repeat("a", 251), "AUX" + strings.Repeat(".", 300)} {
+		got := SanitizeFileName(name)
+		if len(got) > maxComponentBytes {
+			t.Errorf("SanitizeFileName(%.12q...) has %d bytes", name, len(got))
+		}
+		if !strings.HasPrefix(got, "_") || strings.HasSuffix(got, ".") {
+			t.Errorf("SanitizeFileName(%.12q...) = %.12q..., want a _ prefix and no trailing dot", name, got)
+		}
+	}
+}
+
+func TestTruncateUTF8(t *testing.T) {
+	s := "Привет"
+	for n := 0; n <= len(s); n++ {
+		got := TruncateUTF8(s, n)
+		if len(got) > n || !utf8.ValidString(got) || !strings.HasPrefix(s, got) {
+			t.Errorf("TruncateUTF8(%q, %d) = %q", s, n, got)
+		}
+	}
+}
+
+func TestSafeJoin(t *testing.T) {
+	root := filepath.Join("B")
+	tests := []struct {
+		rel     string
+		want    string
+		wantErr bool
+	}{
+		{"123/abc_file.jpg", filepath.Join("B", "123", "abc_file.jpg"), false},
+		{"123//abc.jpg", filepath.Join("B", "123", "abc.jpg"), false},
+		{"123/CON/x.jpg", filepath.Join("B", "123", "_CON", "x.jpg"), false},
+		{"../etc/passwd", "", true},
+		{"123/../../x", "", true},
+		{"./x", "", true},
+		{"", "", true},
+	}
+	for _, tt := range tests {
+		got, err := SafeJoin(root, tt.rel)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("SafeJoin(%q) error = %v, wantErr %v", tt.rel, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("SafeJoin(%q) = %q, want %q", tt.rel, got, tt.want)
+		}
+	}
+}
+
+func FuzzSanitizeFileName(f *testing.F) {
+	for _, seed := range []string{"video.webm", "../../etc/passwd", "CON.txt", "CON." + strings.Repeat("a", 300), "имя файла.mp4", "a\x00b", " . ", strings.Repeat("ж", 300)} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, name string) {
+		got := SanitizeFileName(name)
+		if got == "" || got == "." || got == ".." {
+			t.Fatalf("SanitizeFileName(%q) = %q", name, got)
+		}
+		if len(got) > maxComponentBytes {
+			t.Fatalf("SanitizeFileName(%q) has %d bytes", name, len(got))
+		}
+		if !utf8.ValidString(got) {
+			t.Fatalf("SanitizeFileName(%q) = %q is not valid UTF-8", name, got)
+		}
+		if strings.ContainsAny(got, `/\:*?<>|"`) || strings.IndexFunc(got, unicode.IsControl) >= 0 {
+			t.Fatalf("SanitizeFileName(%q) = %q contains invalid characters", name, got)
+		}
+		if strings.HasSuffix(got, ".") || strings.HasSuffix(got, " ") {
+			t.Fatalf("SanitizeFileName(%q) = %q has a trailing dot or space", name, got)
+		}
+		base, _, _ := strings.Cut(got, ".")
+		if windowsReservedNames[strings.ToUpper(strings.TrimRight(base, " "))] {
+			t.Fatalf("SanitizeFileName(%q) = %q is a reserved name", name, got)
+		}
+		if !filepath.IsLocal(got) {
+			t.Fatalf("SanitizeFileName(%q) = %q is not a local path", name, got)
+		}
+	})
+}
+
+func FuzzSafeJoin(f *testing.F) {
+	for _, seed := range []string{"123/file.jpg", "../x", "a/../../b", "/abs/path", "C:/x", "a\\..\\..\\b"} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, rel string) {
+		got, err := SafeJoin("root", rel)
+		if err != nil {
+			return
+		}
+		inner, err := filepath.Rel("root", got)
+		if err != nil || !filepath.IsLocal(inner) {
+			t.Fatalf("SafeJoin(%q) = %q escapes root", rel, got)
+		}
+	})
+}
@@ -0,0 +1,161 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alekxeyuk/makaba-downloader/logger"
+)
+
+// Option configures the requests of the remote backends
+type Option func(*remoteOptions)
+
+type remoteOptions struct {
+	client *http.Client
+	ctx    context.Context
+}
+
+// WithHTTPClient sends requests through client, e.g. one with the configured timeouts
+func WithHTTPClient(client *http.Client) Option {
+	return func(o *remoteOptions) {
+		o.client = client
+	}
+}
+
+// WithContext cancels requests in flight once ctx is done, buffered appends are still flushed
+func WithContext(ctx context.Context) Option {
+	return func(o *remoteOptions) {
+		o.ctx = ctx
+	}
+}
+
+func newRemoteOptions(opts []Option) remoteOptions {
+	o := remoteOptions{client: &http.Client{}, ctx: context.Background()}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// Flusher is implemented by backends that buffer writes
+type Flusher interface {
+	// Flush writes out everything buffered so far
+	Flush() error
+}
+
+// Flush writes out the buffered writes of storage, if it has any
+func Flush(storage Storage) error {
+	if f, ok := storage.(Flusher); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+const (
+	// appendFlushBytes and appendFlushInterval bound how much is buffered and for how long
+	appendFlushBytes    = 64 << 10
+	appendFlushInterval = time.Minute
+	// flushTimeout bounds a flush that may run after the context was cancelled
+	flushTimeout = 30 * time.Second
+)
+
+// appendBuffer batches appends for backends that can only append by downloading
+// and uploading the whole file again, so every saved file doesn't cost a rewrite of the md5 index
+type appendBuffer struct {
+	ctx     context.Context
+	rewrite func(ctx context.Context, name string, data []byte) error // appends data by rewriting name
+
+	mu      sync.Mutex // held while flushing, so rewrites never overlap other writes to a file
+	pending map[string][]byte
+	size    int
+	timer   *time.Timer
+}
+
+func newAppendBuffer(ctx context.Context, rewrite func(ctx context.Context, name string, data []byte) error) *appendBuffer {
+	return &appendBuffer{ctx: ctx, rewrite: rewrite, pending: make(map[string][]byte)}
+}
+
+// add buffers data, flushing everything once the buffer is full
+func (b *appendBuffer) add(name string, data []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	name = cleanName(name)
+	b.pending[name] = append(b.pending[name], data...)
+	b.size += len(data)
+	if b.size >= appendFlushBytes {
+		return b.flushLocked(b.ctx)
+	}
+	if b.timer == nil {
+		b.timer = time.AfterFunc(appendFlushInterval, func() {
+			if err := b.flush(); err != nil {
+				logger.Log.Error("Error flushing buffered appends: %v", err)
+			}
+		})
+	}
+	return nil
+}
+
+// flush writes out all pending appends, even after the context was cancelled
+func (b *appendBuffer) flush() error {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(b.ctx), flushTimeout)
+	defer cancel()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.flushLocked(ctx)
+}
+
+// flushLocked writes out all pending appends, failed ones stay buffered
+func (b *appendBuffer) flushLocked(ctx context.Context) error {
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	var errs []error
+	for name, data := range b.pending {
+		if err := b.rewrite(ctx, name, data); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		delete(b.pending, name)
+		b.size -= len(data)
+	}
+	return errors.Join(errs...)
+}
+
+// flushName writes out the pending appends of name, before it is read
+func (b *appendBuffer) flushName(name string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	name = cleanName(name)
+	data, ok := b.pending[name]
+	if !ok {
+		return nil
+	}
+	if err := b.rewrite(b.ctx, name, data); err != nil {
+		return err
+	}
+	delete(b.pending, name)
+	b.size -= len(data)
+	return nil
+}
+
+// drop forgets the pending appends of name and everything below it, before it is overwritten or removed
+func (b *appendBuffer) drop(name string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	name = cleanName(name)
+	for n, data := range b.pending {
+		if n == name || name == "" || strings.HasPrefix(n, name+"/") {
+			delete(b.pending, n)
+			b.size -= len(data)
+		}
+	}
+}
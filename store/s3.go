@@ -0,0 +1,396 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	emptyPayloadHash    = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	unsignedPayloadHash = "UNSIGNED-PAYLOAD"
+)
+
+// S3Config describes an S3-compatible bucket
+type S3Config struct {
+	Endpoint  string `json:"endpoint"` // e.g. https://s3.amazonaws.com or http://localhost:9000
+	Region    string `json:"region,omitempty"`
+	Bucket    string `json:"bucket"`
+	Prefix    string `json:"prefix,omitempty"` // key prefix for everything stored
+	AccessKey string `json:"access_key"`
+	SecretKey string `json:"secret_key"`
+	PathStyle bool   `json:"path_style,omitempty"` // endpoint/bucket/key instead of bucket.endpoint/key, needed for MinIO
+}
+
+// S3 stores files as objects, partial downloads are kept in a local spool directory
+type S3 struct {
+	config   S3Config
+	endpoint *url.URL
+	spool    string
+	client   *http.Client
+	ctx      context.Context
+	appends  *appendBuffer // objects can't be appended to, appends are rewrites
+	now      func() time.Time
+}
+
+// NewS3 stores files in a bucket, spool holds partial downloads
+func NewS3(config S3Config, spool string, opts ...Option) (*S3, error) {
+	endpoint, err := url.Parse(config.Endpoint)
+	if err != nil || endpoint.Host == "" {
+		return nil, fmt.Errorf("storage: invalid s3 endpoint %q", config.Endpoint)
+	}
+	if config.Bucket == "" {
+		return nil, fmt.Errorf("storage: s3 bucket is missing")
+	}
+	if config.Region == "" {
+		config.Region = "us-east-1"
+	}
+	config.Prefix = strings.Trim(config.Prefix, "/")
+	o := newRemoteOptions(opts)
+	s := &S3{
+		config:   config,
+		endpoint: endpoint,
+		spool:    spool,
+		client:   o.client,
+		ctx:      o.ctx,
+		now:      time.Now,
+	}
+	s.appends = newAppendBuffer(o.ctx, s.appendObject)
+	return s, nil
+}
+
+func (s *S3) TempPath(name string) string {
+	return spoolPath(s.spool, name)
+}
+
+func (s *S3) Commit(tempPath, name string) error {
+	file, err := os.Open(tempPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	s.appends.drop(name)
+	resp, err := s.do(s.ctx, http.MethodPut, s.key(name), nil, file, info.Size())
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	file.Close()
+	return os.Remove(tempPath)
+}
+
+func (s *S3) Stat(name string) (FileInfo, error) {
+	resp, err := s.do(s.ctx, http.MethodHead, s.key(name), nil, nil, 0)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	resp.Body.Close()
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return FileInfo{Name: cleanName(name), Size: resp.ContentLength, ModTime: modTime}, nil
+}
+
+func (s *S3) Remove(name string) error {
+	s.appends.drop(name)
+	resp, err := s.do(s.ctx, http.MethodDelete, s.key(name), nil, nil, 0)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *S3) RemoveAll(name string) error {
+	s.appends.drop(name)
+	var names []string
+	err := s.Walk(name, func(file FileInfo) error {
+		names = append(names, file.Name)
+		return nil
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	for _, n := range names {
+		if err := s.Remove(n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *S3) ReadFile(name string) ([]byte, error) {
+	if err := s.appends.flushName(name); err != nil {
+		return nil, err
+	}
+	return s.readFile(s.ctx, name)
+}
+
+func (s *S3) WriteFile(name string, data []byte) error {
+	s.appends.drop(name)
+	return s.writeFile(s.ctx, name, data)
+}
+
+// AppendFile buffers data, it is written by Flush, by reading the file or once enough is buffered
+func (s *S3) AppendFile(name string, data []byte) error {
+	return s.appends.add(name, data)
+}
+
+// Flush writes out the buffered appends
+func (s *S3) Flush() error {
+	return s.appends.flush()
+}
+
+func (s *S3) readFile(ctx context.Context, name string) ([]byte, error) {
+	resp, err := s.do(ctx, http.MethodGet, s.key(name), nil, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return io.ReadAll(resp.Body)
+}
+
+func (s *S3) writeFile(ctx context.Context, name string, data []byte) error {
+	resp, err := s.do(ctx, http.MethodPut, s.key(name), nil, bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// appendObject appends data to an object by uploading it again
+func (s *S3) appendObject(ctx context.Context, name string, data []byte) error {
+	existing, err := s.readFile(ctx, name)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return s.writeFile(ctx, name, append(existing, data...))
+}
+
+type listBucketResult struct {
+	Contents []struct {
+		Key          string    `xml:"Key"`
+		Size         int64     `xml:"Size"`
+		LastModified time.Time `xml:"LastModified"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+func (s *S3) Walk(root string, fn func(file FileInfo) error) error {
+	prefix := s.key(root)
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	found := false
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		resp, err := s.do(s.ctx, http.MethodGet, "", query, nil, 0)
+		if err != nil {
+			return err
+		}
+		var result listBucketResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("s3: decoding object list: %w", err)
+		}
+
+		for _, obj := range result.Contents {
+			found = true
+			name := strings.TrimPrefix(strings.TrimPrefix(obj.Key, s.config.Prefix), "/")
+			if err := fn(FileInfo{Name: name, Size: obj.Size, ModTime: obj.LastModified}); err != nil {
+				return err
+			}
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		token = result.NextContinuationToken
+	}
+	if !found {
+		return &fs.PathError{Op: "walk", Path: root, Err: fs.ErrNotExist}
+	}
+	return nil
+}
+
+// key returns the object key of a storage name
+func (s *S3) key(name string) string {
+	name = cleanName(name)
+	if s.config.Prefix == "" {
+		return name
+	}
+	if name == "" {
+		return s.config.Prefix
+	}
+	return s.config.Prefix + "/" + name
+}
+
+// do sends a signed request for a key, non-2xx responses are returned as errors
+func (s *S3) do(ctx context.Context, method, key string, query url.Values, body io.Reader, size int64) (*http.Response, error) {
+	u := *s.endpoint
+	objectPath := "/" + key
+	if s.config.PathStyle {
+		objectPath = "/" + s.config.Bucket + objectPath
+	} else {
+		u.Host = s.config.Bucket + "." + u.Host
+	}
+	// Set RawPath too, SigV4 escapes more characters than url.URL does by default
+	base := strings.TrimSuffix(u.Path, "/")
+	u.Path = base + objectPath
+	u.RawPath = base + awsEscapePath(objectPath)
+	u.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	payloadHash := emptyPayloadHash
+	if body != nil {
+		req.ContentLength = size
+		payloadHash = unsignedPayloadHash
+	}
+	signV4(req, s.config.AccessKey, s.config.SecretKey, s.config.Region, "s3", payloadHash, s.now())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, &fs.PathError{Op: strings.ToLower(method), Path: key, Err: fs.ErrNotExist}
+		}
+		return nil, fmt.Errorf("s3: %s %s: %s", method, key, resp.Status)
+	}
+	return resp, nil
+}
+
+// signV4 adds AWS Signature Version 4 headers to a request
+func signV4(req *http.Request, accessKey, secretKey, region, service, payloadHash string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	// Canonical headers: host and everything set on the request so far
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		lower := strings.ToLower(name)
+		switch lower {
+		case "authorization", "user-agent", "accept-encoding", "content-length", "connection":
+			continue
+		}
+		headers[lower] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, signedHeaders, signature))
+}
+
+// canonicalQuery sorts and strictly escapes query parameters as SigV4 requires
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		values := query[k]
+		sort.Strings(values)
+		for _, v := range values {
+			parts = append(parts, awsEscape(k)+"="+awsEscape(v))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// awsEscape percent-encodes everything except unreserved characters
+func awsEscape(s string) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			b.WriteString("%" + strings.ToUpper(strconv.FormatInt(int64(c)|0x100, 16)[1:]))
+		}
+	}
+	return b.String()
+}
+
+// awsEscapePath escapes every segment of a slash separated path
+func awsEscapePath(p string) string {
+	segments := strings.Split(p, "/")
+	for i, segment := range segments {
+		segments[i] = awsEscape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,196 @@
+// Package store keeps downloaded files on local disk, S3 or WebDAV and
+// provides the md5 index, sidecar metadata and file name helpers
+package store
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Storage is where downloaded files, md5 indexes and sidecars end up.
+// Names are slash separated paths relative to the storage root, e.g. "B/123/file.jpg".
+type Storage interface {
+	// TempPath returns the local file a download of name is written to before Commit,
+	// it must stay the same across restarts so partial downloads can be resumed
+	TempPath(name string) string
+	// Commit moves a finished temp file to name
+	Commit(tempPath, name string) error
+	// Stat returns an error matching fs.ErrNotExist if name doesn't exist
+	Stat(name string) (FileInfo, error)
+	Remove(name string) error
+	// RemoveAll removes name and everything below it
+	RemoveAll(name string) error
+	ReadFile(name string) ([]byte, error)
+	WriteFile(name string, data []byte) error
+	// AppendFile appends data to name, creating it if needed
+	AppendFile(name string, data []byte) error
+	// Walk calls fn for every file below root, a missing root is an error matching fs.ErrNotExist
+	Walk(root string, fn func(file FileInfo) error) error
+}
+
+// LocalPather is implemented by backends whose files can be accessed with the os package
+type LocalPather interface {
+	LocalPath(name string) string
+}
+
+// FileInfo describes a stored file
+type FileInfo struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+}
+
+// Config selects the storage backend
+type Config struct {
+	Type     string        `json:"type"`                // "local" (default), "s3" or "webdav"
+	Root     string        `json:"root,omitempty"`      // local directory, default is the working directory
+	SpoolDir string        `json:"spool_dir,omitempty"` // local directory for partial downloads of remote backends
+	S3       *S3Config     `json:"s3,omitempty"`
+	WebDAV   *WebDAVConfig `json:"webdav,omitempty"`
+}
+
+// New creates the configured backend, nil config means the working directory.
+// Options only apply to the remote backends.
+func New(config *Config, opts ...Option) (Storage, error) {
+	if config == nil {
+		return NewDisk("."), nil
+	}
+
+	spool := config.SpoolDir
+	if spool == "" {
+		spool = ".spool"
+	}
+	switch config.Type {
+	case "", "local":
+		root := config.Root
+		if root == "" {
+			root = "."
+		}
+		return NewDisk(root), nil
+	case "s3":
+		if config.S3 == nil {
+			return nil, errors.New("storage: s3 settings are missing")
+		}
+		return NewS3(*config.S3, spool, opts...)
+	case "webdav":
+		if config.WebDAV == nil {
+			return nil, errors.New("storage: webdav settings are missing")
+		}
+		return NewWebDAV(*config.WebDAV, spool, opts...)
+	default:
+		return nil, fmt.Errorf("storage: unknown type %q", config.Type)
+	}
+}
+
+// cleanName normalizes a storage name to a slash separated path without leading slash
+func cleanName(name string) string {
+	name = path.Clean("/" + filepath.ToSlash(name))
+	return strings.TrimPrefix(name, "/")
+}
+
+// spoolPath returns a stable local temp path for a remote name
+func spoolPath(spool, name string) string {
+	sum := sha1.Sum([]byte(cleanName(name)))
+	return filepath.Join(spool, hex.EncodeToString(sum[:])+path.Ext(name)+".tmp")
+}
+
+// Disk keeps files on the local filesystem, absolute names are used as they are
+type Disk struct {
+	root string
+}
+
+// NewDisk stores files below root
+func NewDisk(root string) *Disk {
+	return &Disk{root: root}
+}
+
+func (s *Disk) LocalPath(name string) string {
+	if filepath.IsAbs(name) {
+		return filepath.Clean(name)
+	}
+	return filepath.Join(s.root, filepath.FromSlash(cleanName(name)))
+}
+
+func (s *Disk) TempPath(name string) string {
+	return s.LocalPath(name) + ".tmp"
+}
+
+func (s *Disk) Commit(tempPath, name string) error {
+	target := s.LocalPath(name)
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	return os.Rename(tempPath, target)
+}
+
+func (s *Disk) Stat(name string) (FileInfo, error) {
+	info, err := os.Stat(s.LocalPath(name))
+	if err != nil {
+		return FileInfo{}, err
+	}
+	return FileInfo{Name: filepath.ToSlash(name), Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+func (s *Disk) Remove(name string) error {
+	return os.Remove(s.LocalPath(name))
+}
+
+func (s *Disk) RemoveAll(name string) error {
+	return os.RemoveAll(s.LocalPath(name))
+}
+
+func (s *Disk) ReadFile(name string) ([]byte, error) {
+	return os.ReadFile(s.LocalPath(name))
+}
+
+func (s *Disk) WriteFile(name string, data []byte) error {
+	target := s.LocalPath(name)
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(target, data, 0644)
+}
+
+func (s *Disk) AppendFile(name string, data []byte) error {
+	target := s.LocalPath(name)
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(target, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// Walk returns names below root in the same form as root, relative or absolute
+func (s *Disk) Walk(root string, fn func(file FileInfo) error) error {
+	base := s.LocalPath(root)
+	return filepath.WalkDir(base, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(base, p)
+		if err != nil {
+			return err
+		}
+		name := path.Join(filepath.ToSlash(root), filepath.ToSlash(rel))
+		return fn(FileInfo{Name: name, Size: info.Size(), ModTime: info.ModTime()})
+	})
+}
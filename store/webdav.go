@@ -0,0 +1,318 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+// WebDAVConfig describes a WebDAV server, e.g. Nextcloud or rclone serve webdav
+type WebDAVConfig struct {
+	URL      string `json:"url"` // base URL, files are stored below it
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+}
+
+// WebDAV stores files on a WebDAV server, partial downloads are kept in a local spool directory
+type WebDAV struct {
+	config  WebDAVConfig
+	base    *url.URL
+	spool   string
+	client  *http.Client
+	ctx     context.Context
+	appends *appendBuffer // WebDAV has no append, appends are rewrites
+
+	dirsMu sync.Mutex
+	dirs   map[string]bool // collections known to exist
+}
+
+// NewWebDAV stores files on a WebDAV server, spool holds partial downloads
+func NewWebDAV(config WebDAVConfig, spool string, opts ...Option) (*WebDAV, error) {
+	base, err := url.Parse(config.URL)
+	if err != nil || base.Host == "" {
+		return nil, fmt.Errorf("storage: invalid webdav url %q", config.URL)
+	}
+	base.Path = strings.TrimSuffix(base.Path, "/")
+	o := newRemoteOptions(opts)
+	s := &WebDAV{
+		config: config,
+		base:   base,
+		spool:  spool,
+		client: o.client,
+		ctx:    o.ctx,
+		dirs:   make(map[string]bool),
+	}
+	s.appends = newAppendBuffer(o.ctx, s.appendFile)
+	return s, nil
+}
+
+func (s *WebDAV) TempPath(name string) string {
+	return spoolPath(s.spool, name)
+}
+
+func (s *WebDAV) Commit(tempPath, name string) error {
+	file, err := os.Open(tempPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	s.appends.drop(name)
+	if err := s.put(s.ctx, name, file, info.Size()); err != nil {
+		return err
+	}
+	file.Close()
+	return os.Remove(tempPath)
+}
+
+func (s *WebDAV) Stat(name string) (FileInfo, error) {
+	resp, err := s.do(s.ctx, http.MethodHead, name, nil, -1, nil)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	resp.Body.Close()
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return FileInfo{Name: cleanName(name), Size: resp.ContentLength, ModTime: modTime}, nil
+}
+
+func (s *WebDAV) Remove(name string) error {
+	s.appends.drop(name)
+	resp, err := s.do(s.ctx, http.MethodDelete, name, nil, -1, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// RemoveAll deletes a collection with everything in it, DELETE is recursive in WebDAV
+func (s *WebDAV) RemoveAll(name string) error {
+	err := s.Remove(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	s.dirsMu.Lock()
+	prefix := cleanName(name)
+	for dir := range s.dirs {
+		if dir == prefix || strings.HasPrefix(dir, prefix+"/") {
+			delete(s.dirs, dir)
+		}
+	}
+	s.dirsMu.Unlock()
+	return err
+}
+
+func (s *WebDAV) ReadFile(name string) ([]byte, error) {
+	if err := s.appends.flushName(name); err != nil {
+		return nil, err
+	}
+	return s.readFile(s.ctx, name)
+}
+
+func (s *WebDAV) WriteFile(name string, data []byte) error {
+	s.appends.drop(name)
+	return s.put(s.ctx, name, bytes.NewReader(data), int64(len(data)))
+}
+
+// AppendFile buffers data, it is written by Flush, by reading the file or once enough is buffered
+func (s *WebDAV) AppendFile(name string, data []byte) error {
+	return s.appends.add(name, data)
+}
+
+// Flush writes out the buffered appends
+func (s *WebDAV) Flush() error {
+	return s.appends.flush()
+}
+
+func (s *WebDAV) readFile(ctx context.Context, name string) ([]byte, error) {
+	resp, err := s.do(ctx, http.MethodGet, name, nil, -1, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return io.ReadAll(resp.Body)
+}
+
+// appendFile appends data to a file by uploading it again
+func (s *WebDAV) appendFile(ctx context.Context, name string, data []byte) error {
+	existing, err := s.readFile(ctx, name)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return s.put(ctx, name, bytes.NewReader(append(existing, data...)), int64(len(existing)+len(data)))
+}
+
+type multistatus struct {
+	Responses []struct {
+		Href     string `xml:"href"`
+		Propstat []struct {
+			Prop struct {
+				ResourceType struct {
+					Collection *struct{} `xml:"collection"`
+				} `xml:"resourcetype"`
+				ContentLength int64  `xml:"getcontentlength"`
+				LastModified  string `xml:"getlastmodified"`
+			} `xml:"prop"`
+		} `xml:"propstat"`
+	} `xml:"response"`
+}
+
+const propfindBody = `<?xml version="1.0" encoding="utf-8"?>
+<propfind xmlns="DAV:"><prop><resourcetype/><getcontentlength/><getlastmodified/></prop></propfind>`
+
+// Walk lists collections one level at a time, Depth: infinity is disabled on most servers
+func (s *WebDAV) Walk(root string, fn func(file FileInfo) error) error {
+	pending := []string{cleanName(root)}
+	for len(pending) > 0 {
+		dir := pending[0]
+		pending = pending[1:]
+
+		header := http.Header{"Depth": {"1"}, "Content-Type": {"application/xml"}}
+		resp, err := s.do(s.ctx, "PROPFIND", dir+"/", strings.NewReader(propfindBody), int64(len(propfindBody)), header)
+		if err != nil {
+			return err
+		}
+		var result multistatus
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("webdav: decoding listing of %s: %w", dir, err)
+		}
+
+		for _, r := range result.Responses {
+			name, ok := s.nameOf(r.Href)
+			if !ok || name == dir || len(r.Propstat) == 0 {
+				continue
+			}
+			prop := r.Propstat[0].Prop
+			if prop.ResourceType.Collection != nil {
+				pending = append(pending, name)
+				continue
+			}
+			modTime, _ := http.ParseTime(prop.LastModified)
+			if err := fn(FileInfo{Name: name, Size: prop.ContentLength, ModTime: modTime}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// nameOf turns an href from a PROPFIND response into a storage name
+func (s *WebDAV) nameOf(href string) (string, bool) {
+	u, err := url.Parse(href)
+	if err != nil {
+		return "", false
+	}
+	p := strings.TrimSuffix(u.Path, "/")
+	if p != s.base.Path && !strings.HasPrefix(p, s.base.Path+"/") {
+		return "", false
+	}
+	return cleanName(strings.TrimPrefix(p, s.base.Path)), true
+}
+
+// put uploads a file, creating missing parent collections first
+func (s *WebDAV) put(ctx context.Context, name string, body io.Reader, size int64) error {
+	if err := s.mkdirAll(ctx, path.Dir(cleanName(name))); err != nil {
+		return err
+	}
+	resp, err := s.do(ctx, http.MethodPut, name, body, size, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// mkdirAll creates a collection and its parents with MKCOL
+func (s *WebDAV) mkdirAll(ctx context.Context, dir string) error {
+	if dir == "." || dir == "" {
+		return nil
+	}
+	s.dirsMu.Lock()
+	known := s.dirs[dir]
+	s.dirsMu.Unlock()
+	if known {
+		return nil
+	}
+
+	if err := s.mkdirAll(ctx, path.Dir(dir)); err != nil {
+		return err
+	}
+	resp, err := s.do(ctx, "MKCOL", dir+"/", nil, -1, nil)
+	var werr *webdavError
+	switch {
+	case err == nil:
+		resp.Body.Close()
+	case errors.As(err, &werr) && werr.code == http.StatusMethodNotAllowed:
+		// The collection already exists
+	default:
+		return err
+	}
+
+	s.dirsMu.Lock()
+	s.dirs[dir] = true
+	s.dirsMu.Unlock()
+	return nil
+}
+
+// do sends a request for a name, non-2xx responses are returned as errors
+func (s *WebDAV) do(ctx context.Context, method, name string, body io.Reader, size int64, header http.Header) (*http.Response, error) {
+	u := *s.base
+	u.Path = s.base.Path + "/" + cleanName(name)
+	if strings.HasSuffix(name, "/") && !strings.HasSuffix(u.Path, "/") {
+		// Collections are addressed with a trailing slash
+		u.Path += "/"
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if size >= 0 {
+		req.ContentLength = size
+	}
+	if s.config.Username != "" {
+		req.SetBasicAuth(s.config.Username, s.config.Password)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, &fs.PathError{Op: strings.ToLower(method), Path: name, Err: fs.ErrNotExist}
+		}
+		return nil, &webdavError{method: method, name: name, status: resp.Status, code: resp.StatusCode}
+	}
+	return resp, nil
+}
+
+// webdavError is a non-2xx response of the server
+type webdavError struct {
+	method, name, status string
+	code                 int
+}
+
+func (e *webdavError) Error() string {
+	return fmt.Sprintf("webdav: %s %s: %s", e.method, e.name, e.status)
+}
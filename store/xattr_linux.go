@@ -0,0 +1,16 @@
+package store
+
+import "syscall"
+
+// setXattrs sets extended attributes on a file
+func setXattrs(path string, attrs map[string]string) error {
+	for name, value := range attrs {
+		if value == "" {
+			continue
+		}
+		if err := syscall.Setxattr(path, name, []byte(value), 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
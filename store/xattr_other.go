@@ -0,0 +1,10 @@
+//go:build !linux
+
+package store
+
+import "errors"
+
+// setXattrs sets extended attributes on a file
+func setXattrs(path string, attrs map[string]string) error {
+	return errors.ErrUnsupported
+}
@@ -1,64 +0,0 @@
-package main
-
-import (
-	"strings"
-
-	"github.com/tidwall/gjson"
-)
-
-type ThreadInfo struct {
-	Data    []byte
-	LastHit int64
-}
-
-func getThreads(api *DvachApi, catalog []byte, threadSubjSubstrings []string, ignoredSubstrings []string, lastHits map[string]int64) ([]ThreadInfo, int64) {
-	var threads []ThreadInfo
-	boardID := gjson.GetBytes(catalog, "board.id").String()
-
-	threadsCount := gjson.GetBytes(catalog, "threads.#").Int()
-
-	for _, thread := range gjson.GetBytes(catalog, "threads").Array() {
-		comment := gjson.GetBytes([]byte(thread.Raw), "comment").String()
-		tags := gjson.GetBytes([]byte(thread.Raw), "tags").String()
-		subject := gjson.GetBytes([]byte(thread.Raw), "subject").String()
-
-		// Check if thread contains desired substrings
-		hasDesired := containsSubstring(comment, threadSubjSubstrings) ||
-			containsSubstring(tags, threadSubjSubstrings) ||
-			containsSubstring(subject, threadSubjSubstrings)
-
-		// Check if thread contains ignored substrings
-		hasIgnored := containsSubstring(comment, ignoredSubstrings) ||
-			containsSubstring(tags, ignoredSubstrings) ||
-			containsSubstring(subject, ignoredSubstrings)
-
-		if hasDesired && !hasIgnored {
-			threadNum := gjson.GetBytes([]byte(thread.Raw), "num").String()
-			currentLastHit := gjson.GetBytes([]byte(thread.Raw), "files_count").Int()
-
-			// Check if lasthit is newer than what we remember
-			key := boardID + "_" + threadNum
-			storedLastHit, exists := lastHits[key]
-			if !exists || currentLastHit > storedLastHit {
-				Log.Debug("Found matching thread with new activity: %s (lasthit: %d -> %d)", threadNum, storedLastHit, currentLastHit)
-
-				threadData, err := api.threadGet(boardID, threadNum)
-				if err != nil {
-					Log.Error("Error getting thread %s: %v", threadNum, err)
-					continue
-				}
-				threads = append(threads, ThreadInfo{Data: threadData, LastHit: currentLastHit})
-			}
-		}
-	}
-	return threads, threadsCount
-}
-
-func containsSubstring(s string, substrings []string) bool {
-	for _, substring := range substrings {
-		if strings.Contains(strings.ToLower(s), strings.ToLower(substring)) {
-			return true
-		}
-	}
-	return false
-}